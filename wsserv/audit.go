@@ -0,0 +1,77 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/libwebsocketd"
+)
+
+// auditCommand runs "websocketd audit", printing the records of an audit log
+// that match the filter options. It returns the exit status.
+func auditCommand(args []string) int {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.Usage = func() {}
+	snFlag := flags.String("sn", "", "Records sent by or to this sn")
+	wsidFlag := flags.String("wsid", "", "Records of this wsid")
+	sinceFlag := flags.String("since", "", "Records at or after this time")
+	untilFlag := flags.String("until", "", "Records before this time")
+	jsonFlag := flags.Bool("json", false, "Print records as JSON lines")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Please specify the audit log FILE to search.\n")
+		ShortHelp()
+		return 1
+	}
+
+	now := time.Now()
+	filter := &libwebsocketd.AuditFilter{Sn: *snFlag, Wsid: *wsidFlag}
+	var err error
+	if filter.Since, err = parseAuditTime(*sinceFlag, now); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --since: %s.\n", err)
+		return 1
+	}
+	if filter.Until, err = parseAuditTime(*untilFlag, now); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --until: %s.\n", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	err = libwebsocketd.QueryAudit(flags.Arg(0), filter, func(r *libwebsocketd.AuditRecord) error {
+		if *jsonFlag {
+			return encoder.Encode(r)
+		}
+		from := r.From
+		if r.FromCType != "" {
+			from += "(" + r.FromCType + ")"
+		}
+		line := fmt.Sprintf("%s  %s -> %s  %s %s  %s %dms  %s", r.Time.Local().Format("2006-01-02 15:04:05.000"), from, r.To, r.Type, r.Wsid, r.Outcome, r.LatencyMs, r.Error)
+		_, err := fmt.Println(strings.TrimSpace(line))
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read audit log: %s\n", err)
+		return 4
+	}
+	return 0
+}
+
+// parseAuditTime parses an RFC 3339 time or a duration before now. The empty
+// string is the zero time.
+func parseAuditTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -23,6 +23,9 @@ type Config struct {
 	MaxForks          int      // Number of allowable concurrent forks
 	LogLevel          libwebsocketd.LogLevel
 	CertFile, KeyFile string
+	MetricsAddr       string // Separate TCP address serving /metrics, empty for none
+	MQTTAddr          string // TCP address of the MQTT bridge, empty for none
+	MQTTUsersFile     string // File of the usernames and passwords MQTT clients log in with
 	*libwebsocketd.Config
 }
 
@@ -71,6 +74,9 @@ func parseCommandLine() *Config {
 	sslCert := flag.String("sslcert", "", "Should point to certificate PEM file when --ssl is used")
 	sslKey := flag.String("sslkey", "", "Should point to certificate private key file when --ssl is used")
 	maxForksFlag := flag.Int("maxforks", 0, "Max forks, zero means unlimited")
+	metricsAddrFlag := flag.String("metricsaddr", "", "Address of a separate HTTP listener serving /metrics")
+	mqttFlag := flag.String("mqtt", "", "Address of an MQTT listener bridged to the smarthome broker")
+	mqttUsersFlag := flag.String("mqttusers", "", "File of usernames and passwords MQTT clients log in with")
 
 	// lib config options
 	reverseLookupFlag := flag.Bool("reverselookup", true, "Perform reverse DNS lookups on remote clients")
@@ -82,7 +88,34 @@ func parseCommandLine() *Config {
 	sameOriginFlag := flag.Bool("sameorigin", false, "Restrict upgrades if origin and host headers differ")
 	allowOriginsFlag := flag.String("origin", "", "Restrict upgrades if origin does not match the list")
 	smarthomeFlag := flag.Bool("smarthome", false, "Smarthome support")
-	logFile := flag.String("logfile", "", "Record Log in file") // lizm add
+	logFile := flag.String("logfile", "", "Record Log in file")
+	deviceFileFlag := flag.String("devices", "", "Registry file of smarthome devices allowed to authenticate")
+	apiTokenFlag := flag.String("apitoken", "", "Bearer token required by the smarthome HTTP API, empty to disable the API")
+	tokenTTLFlag := flag.Duration("tokenttl", 24*time.Hour, "Lifetime of tokens issued to smarthome devices")
+	replyTimeoutFlag := flag.Duration("replytimeout", 10*time.Second, "How long to wait for a device to answer a rest command")
+	queueDirFlag := flag.String("queuedir", "", "Directory storing persistent commands for offline devices")
+	queueTTLFlag := flag.Duration("queuettl", 24*time.Hour, "How long persistent commands wait for the device to connect")
+	queueLimitFlag := flag.Int("queuelimit", 100, "Most persistent commands queued per device, 0 for no limit")
+	aclFlag := flag.String("acl", "", "Access list of the devices each smarthome client may command and observe")
+	duplicateSnFlag := flag.String("duplicatesn", "replace", "What to do when a smarthome client connects as an sn that is connected already")
+	pingIntervalFlag := flag.Duration("pinginterval", 30*time.Second, "How often smarthome clients are pinged, 0 to disable")
+	pingMissesFlag := flag.Int("pingmisses", 3, "Ping intervals without any frame after which a smarthome client is dropped")
+	routesFlag := flag.String("routes", "", "Routing table for smarthome messages of custom types")
+	firmwareDirFlag := flag.String("firmwaredir", "", "Directory of firmware images offered to smarthome devices")
+	rulesFlag := flag.String("rules", "", "Automation rules sending commands to smarthome devices on notifications")
+	rulesDryRunFlag := flag.Bool("rulesdryrun", false, "Only log the commands automation rules would send")
+	schedulesFlag := flag.String("schedules", "", "File storing commands sent to smarthome devices at scheduled times")
+	groupsFlag := flag.String("groups", "", "File storing groups of smarthome devices commanded at once")
+	auditFlag := flag.String("auditlog", "", "JSON lines file recording every command routed between smarthome clients")
+	auditMaxSizeFlag := flag.Int64("auditmaxsize", 100, "Size in MiB after which the audit log is rotated, 0 for no limit")
+	auditRotateFlag := flag.Duration("auditrotate", 24*time.Hour, "Age after which the audit log is rotated, 0 for no limit")
+	auditRetainFlag := flag.Duration("auditretain", 90*24*time.Hour, "How long rotated audit logs are kept, 0 to keep them forever")
+	metricsFlag := flag.Bool("metrics", false, "Serve Prometheus metrics on /metrics")
+	maxFrameFlag := flag.Int("maxframe", 0, "Largest frame payload in bytes accepted from clients, 0 for 32 MiB")
+	rateMsgsFlag := flag.Float64("ratemsgs", 0, "Messages per second each client may send, 0 for no limit")
+	rateBytesFlag := flag.Float64("ratebytes", 0, "Payload bytes per second each client may send, 0 for no limit")
+	limitPolicyFlag := flag.String("limitpolicy", "disconnect", "What to do with frames exceeding the limits: drop, warn or disconnect")
+	protocolsFlag := flag.String("protocols", "", "Protocol handlers serving WebSocket paths instead of COMMAND, as PATH=NAME list")
 
 	err := flag.CommandLine.Parse(os.Args[1:])
 	if err != nil {
@@ -112,6 +145,9 @@ func parseCommandLine() *Config {
 		mainConfig.Addr = []string{fmt.Sprintf(":%d", port)}
 	}
 	mainConfig.MaxForks = *maxForksFlag
+	mainConfig.MetricsAddr = *metricsAddrFlag
+	mainConfig.MQTTAddr = *mqttFlag
+	mainConfig.MQTTUsersFile = *mqttUsersFlag
 	mainConfig.LogLevel = libwebsocketd.LevelFromString(*logLevelFlag)
 	if mainConfig.LogLevel == libwebsocketd.LogUnknown {
 		fmt.Printf("Incorrect loglevel flag '%s'. Use --help to see allowed values.\n", *logLevelFlag)
@@ -184,10 +220,113 @@ func parseCommandLine() *Config {
 
 	config.Smarthome = *smarthomeFlag
 	config.LogFile = *logFile
+	config.DeviceFile = *deviceFileFlag
+	config.TokenTTL = *tokenTTLFlag
+	config.APIToken = *apiTokenFlag
+	config.ReplyTimeout = *replyTimeoutFlag
+	config.QueueDir = *queueDirFlag
+	config.QueueTTL = *queueTTLFlag
+	config.QueueLimit = *queueLimitFlag
+	config.ACLFile = *aclFlag
+	config.DuplicateSn = *duplicateSnFlag
+	config.PingInterval = *pingIntervalFlag
+	config.PingMisses = *pingMissesFlag
+	config.RoutesFile = *routesFlag
+	config.FirmwareDir = *firmwareDirFlag
+	config.RulesFile = *rulesFlag
+	config.RulesDryRun = *rulesDryRunFlag
+	config.ScheduleFile = *schedulesFlag
+	config.GroupFile = *groupsFlag
+	config.AuditFile = *auditFlag
+	config.AuditMaxSize = *auditMaxSizeFlag << 20
+	config.AuditRotate = *auditRotateFlag
+	config.AuditRetain = *auditRetainFlag
+	config.Metrics = *metricsFlag
+	config.MaxFrameSize = *maxFrameFlag
+	config.MessageRate = *rateMsgsFlag
+	config.ByteRate = *rateBytesFlag
+	config.LimitPolicy = *limitPolicyFlag
+	if *protocolsFlag != "" {
+		config.Protocols = strings.Split(*protocolsFlag, ",")
+	}
+
+	if config.Smarthome && config.DeviceFile == "" {
+		fmt.Fprintf(os.Stderr, "Please specify --devices when using --smarthome.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if mainConfig.MQTTAddr != "" && !config.Smarthome {
+		fmt.Fprintf(os.Stderr, "Please specify --smarthome when using --mqtt.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if mainConfig.MQTTAddr != "" && mainConfig.MQTTUsersFile == "" {
+		fmt.Fprintf(os.Stderr, "Please specify --mqttusers when using --mqtt.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if config.TokenTTL <= 0 {
+		fmt.Fprintf(os.Stderr, "Token lifetime --tokenttl must be positive.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if config.ReplyTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Reply timeout --replytimeout must be positive.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if _, err := libwebsocketd.ParseTakeoverPolicy(config.DuplicateSn); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --duplicatesn: %s.\n", err)
+		ShortHelp()
+		os.Exit(1)
+	}
+	if config.PingInterval < 0 || config.PingMisses < 1 {
+		fmt.Fprintf(os.Stderr, "Keepalive needs --pinginterval >= 0 and --pingmisses >= 1.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	for _, entry := range config.Protocols {
+		_, name, err := libwebsocketd.ParseProtocolRoute(entry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --protocols: %s.\n", err)
+			ShortHelp()
+			os.Exit(1)
+		}
+		if name == "smarthome" && !config.Smarthome {
+			fmt.Fprintf(os.Stderr, "Please specify --smarthome when serving the smarthome protocol.\n")
+			ShortHelp()
+			os.Exit(1)
+		}
+	}
+	if config.AuditMaxSize < 0 || config.AuditRotate < 0 || config.AuditRetain < 0 {
+		fmt.Fprintf(os.Stderr, "Audit log limits --auditmaxsize, --auditrotate and --auditretain must not be negative.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if config.MaxFrameSize < 0 || config.MessageRate < 0 || config.ByteRate < 0 {
+		fmt.Fprintf(os.Stderr, "Connection limits --maxframe, --ratemsgs and --ratebytes must not be negative.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if _, err := libwebsocketd.ParseLimitPolicy(config.LimitPolicy); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --limitpolicy: %s.\n", err)
+		ShortHelp()
+		os.Exit(1)
+	}
+	if config.QueueTTL <= 0 {
+		fmt.Fprintf(os.Stderr, "Queue lifetime --queuettl must be positive.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
+	if config.QueueLimit < 0 {
+		fmt.Fprintf(os.Stderr, "Queue limit --queuelimit must not be negative.\n")
+		ShortHelp()
+		os.Exit(1)
+	}
 
 	args := flag.Args()
-	if len(args) < 1 && !config.Smarthome && config.ScriptDir == "" && config.StaticDir == "" && config.CgiDir == "" {
-		fmt.Fprintf(os.Stderr, "Please specify COMMAND or provide --dir, --staticdir or --cgidir argument.\n")
+	if len(args) < 1 && !config.Smarthome && len(config.Protocols) == 0 && config.ScriptDir == "" && config.StaticDir == "" && config.CgiDir == "" {
+		fmt.Fprintf(os.Stderr, "Please specify COMMAND or provide --dir, --staticdir, --cgidir or --protocols argument.\n")
 		ShortHelp()
 		os.Exit(1)
 	}
@@ -287,11 +287,17 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 	case TextFrame, BinaryFrame:
 		handler.payloadType = frame.PayloadType()
 	case CloseFrame:
+		closeMsg := make([]byte, maxControlFramePayloadLength)
+		n, _ := io.ReadFull(frame, closeMsg)
+		if n >= 2 {
+			handler.conn.closeStatus = int(binary.BigEndian.Uint16(closeMsg))
+			handler.conn.closeReason = string(closeMsg[2:n])
+		}
 		return nil, io.EOF
 	case PingFrame:
 		pingMsg := make([]byte, maxControlFramePayloadLength)
 		n, err := io.ReadFull(frame, pingMsg)
-		if err != nil && err != io.ErrUnexpectedEOF {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return nil, err
 		}
 		io.Copy(ioutil.Discard, frame)
@@ -301,29 +307,54 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 		}
 		return nil, nil
 	case PongFrame:
-		return nil, ErrNotImplemented
+		pongMsg := make([]byte, maxControlFramePayloadLength)
+		n, err := io.ReadFull(frame, pongMsg)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		io.Copy(ioutil.Discard, frame)
+		if handler.conn.pongHandler != nil {
+			handler.conn.pongHandler(pongMsg[:n])
+		}
+		return nil, nil
 	}
 	return frame, nil
 }
 
 func (handler *hybiFrameHandler) WriteClose(status int) (err error) {
+	return handler.WriteCloseReason(status, "")
+}
+
+func (handler *hybiFrameHandler) WriteCloseReason(status int, reason string) (err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
 	w, err := handler.conn.frameWriterFactory.NewFrameWriter(CloseFrame)
 	if err != nil {
 		return err
 	}
-	msg := make([]byte, 2)
+	if len(reason) > maxControlFramePayloadLength-2 {
+		reason = reason[:maxControlFramePayloadLength-2]
+	}
+	msg := make([]byte, 2, 2+len(reason))
 	binary.BigEndian.PutUint16(msg, uint16(status))
+	msg = append(msg, reason...)
 	_, err = w.Write(msg)
 	w.Close()
 	return err
 }
 
 func (handler *hybiFrameHandler) WritePong(msg []byte) (n int, err error) {
+	return handler.writeControl(PongFrame, msg)
+}
+
+func (handler *hybiFrameHandler) WritePing(msg []byte) (n int, err error) {
+	return handler.writeControl(PingFrame, msg)
+}
+
+func (handler *hybiFrameHandler) writeControl(payloadType byte, msg []byte) (n int, err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
-	w, err := handler.conn.frameWriterFactory.NewFrameWriter(PongFrame)
+	w, err := handler.conn.frameWriterFactory.NewFrameWriter(payloadType)
 	if err != nil {
 		return 0, err
 	}
@@ -58,6 +58,15 @@ var (
 	ErrNotSupported         = &ProtocolError{"not supported"}
 )
 
+// ErrFrameTooLarge is returned by Codec's Receive method if payload size
+// exceeds limit set by Conn.MaxPayloadBytes, and by Ping if the message does
+// not fit into a control frame.
+var ErrFrameTooLarge = errors.New("websocket: frame payload size exceeds limit")
+
+// DefaultMaxPayloadBytes is the maximum frame payload size Codec's Receive
+// method accepts unless Conn.MaxPayloadBytes is set.
+const DefaultMaxPayloadBytes = 32 << 20 // 32MB
+
 // Addr is an implementation of net.Addr for WebSocket.
 type Addr struct {
 	*url.URL
@@ -141,6 +150,8 @@ type frameWriterFactory interface {
 type frameHandler interface {
 	HandleFrame(frame frameReader) (r frameReader, err error)
 	WriteClose(status int) (err error)
+	WriteCloseReason(status int, reason string) (err error)
+	WritePing(msg []byte) (n int, err error)
 }
 
 // Conn represents a WebSocket connection.
@@ -161,6 +172,16 @@ type Conn struct {
 	frameHandler
 	PayloadType        byte
 	defaultCloseStatus int
+
+	// status and reason of the close frame received from the peer
+	closeStatus int
+	closeReason string
+
+	pongHandler func(msg []byte)
+
+	// MaxPayloadBytes limits the size of frame payload received over Conn
+	// by Codec's Receive method. If zero, DefaultMaxPayloadBytes is used.
+	MaxPayloadBytes int
 }
 
 // Read implements the io.Reader interface:
@@ -222,6 +243,39 @@ func (ws *Conn) Close() error {
 	return ws.rwc.Close()
 }
 
+// CloseWithStatus sends a close frame with given status code and reason to
+// the peer and closes the connection. Reason is cut to fit into the frame.
+func (ws *Conn) CloseWithStatus(status int, reason string) error {
+	err := ws.frameHandler.WriteCloseReason(status, reason)
+	if err != nil {
+		return err
+	}
+	return ws.rwc.Close()
+}
+
+// CloseStatus returns status code and reason of the close frame received
+// from the peer, or 0 if none was received.
+func (ws *Conn) CloseStatus() (status int, reason string) {
+	return ws.closeStatus, ws.closeReason
+}
+
+// Ping sends a ping frame with msg, at most 125 bytes, to the peer. The
+// peer's pong is passed to the handler set by SetPongHandler.
+func (ws *Conn) Ping(msg []byte) error {
+	if len(msg) > maxControlFramePayloadLength {
+		return ErrFrameTooLarge
+	}
+	_, err := ws.frameHandler.WritePing(msg)
+	return err
+}
+
+// SetPongHandler sets function called with the payload of each pong frame
+// received. It runs in the goroutine reading from ws and must be set before
+// reading starts.
+func (ws *Conn) SetPongHandler(handler func(msg []byte)) {
+	ws.pongHandler = handler
+}
+
 func (ws *Conn) IsClientConn() bool { return ws.request == nil }
 func (ws *Conn) IsServerConn() bool { return ws.request != nil }
 
@@ -322,6 +376,19 @@ again:
 	if frame == nil {
 		goto again
 	}
+	maxPayloadBytes := ws.MaxPayloadBytes
+	if maxPayloadBytes == 0 {
+		maxPayloadBytes = DefaultMaxPayloadBytes
+	}
+	if hf, ok := frame.(*hybiFrameReader); ok && hf.header.Length > int64(maxPayloadBytes) {
+		// payload size exceeds limit, no need to call Unmarshal
+		//
+		// set frameReader to current oversized frame so that
+		// the next call to this function can drain leftover
+		// data before processing the next frame
+		ws.frameReader = frame
+		return ErrFrameTooLarge
+	}
 	payloadType := frame.PayloadType()
 	data, err := ioutil.ReadAll(frame)
 	if err != nil {
@@ -28,6 +28,24 @@ Usage:
   Or, export an entire directory of executables as WebSocket endpoints:
     {{binary}} [options] --dir=SOMEDIR
 
+  Or, search the smarthome audit log written with --auditlog:
+    {{binary}} audit [--sn=SN] [--wsid=WSID] [--since=TIME] [--until=TIME]
+               [--json] FILE
+    TIME is RFC 3339 like 2016-03-01T23:00:00+08:00 or a duration like 2h
+    before now. --json prints the matching records as they are stored.
+
+  Or, simulate smarthome devices and rest clients against a broker:
+    {{binary}} simulate --devices=FILE [--count=N] [--ctypes=TYPE,...]
+               [--responses=FILE] [--notify=DURATION] [--msgtype=TYPE]
+               [--clients=SN,...] [--rate=N] [--command=JSON]
+               [--duration=DURATION] [--report=DURATION] URL
+    The devices authenticate with the credentials of the registry FILE,
+    except those named by --clients, and answer rest commands with the data
+    listed for their "cmd" in the --responses JSON object, else with the
+    command's data. The rest clients send --command to the devices in turn,
+    --rate times per second each, up to 1000000000. Every --report and at
+    the end the round trip latency percentiles are printed.
+
 Options:
 
   --port=PORT                    HTTP port to listen on.
@@ -41,6 +59,216 @@ Options:
                                  Host. Default: false.
 
   --smarthome={true,false}       Support connection of smarthome
+                                 devices. With --apitoken also serves the
+                                 HTTP API:
+                                 GET /api/stats returns broker counters,
+                                 GET /api/devices lists connected clients,
+                                 GET /api/devices/SN describes one of them,
+                                 GET /api/devices/SN/state returns the latest
+                                 notification of each msgtype from SN,
+                                 POST /api/devices/SN/commands sends the JSON
+                                 body {"data":{...}} to device SN as a rest
+                                 command and responds with the device's reply,
+                                 or queues it if "persist":true is given and
+                                 the device is offline.
+                                 Binary frames are passed to another client
+                                 as is, behind an envelope of 1 byte sn length,
+                                 sn, 1 byte wsid length and wsid. Senders name
+                                 the target sn, receivers see the sender's.
+
+  --devices=FILE                 Registry of smarthome devices allowed to
+                                 authenticate, one "sn mac secret" line per
+                                 device. Required with --smarthome. The sns
+                                 "api", "mqtt" and "rules" are reserved for
+                                 the broker, those starting with "mqtt:" for
+                                 --mqttusers.
+
+  --apitoken=TOKEN               Serve the smarthome HTTP API under /api/ to
+                                 requests with the header "Authorization:
+                                 Bearer TOKEN", others get 401. Without it
+                                 the API is disabled. The API runs as
+                                 identity "api" of the --acl file.
+
+  --tokenttl=DURATION            Lifetime of tokens issued to smarthome
+                                 devices by "auth". Default: 24h
+
+  --replytimeout=DURATION        How long to wait for a device to answer a
+                                 rest command before the rest client gets a
+                                 "timeout" error. Default: 10s
+
+  --queuedir=DIR                 Directory where rest commands sent with
+                                 "persist":true to an offline device are
+                                 stored until the device connects. Without it
+                                 such commands get a "queue_failed" error.
+
+  --queuettl=DURATION            How long persistent commands wait for the
+                                 device to connect before they expire.
+                                 Default: 24h
+
+  --queuelimit=N                 Most persistent commands queued for one
+                                 device. Further ones get a "queue_failed"
+                                 error. 0 means no limit. Default: 100
+
+  --acl=FILE                     Access list of smarthome clients, one
+                                 "identity permission sn..." line each.
+                                 Identity is the sn a client connected as, or
+                                 "api" for the HTTP API. Permission "command"
+                                 allows to send rest commands to and observe
+                                 the sns, "observe" only to receive their
+                                 notifications. Sn "*" means all devices.
+                                 Without it every client may use every device.
+
+  --duplicatesn={replace,reject,allow-multi}
+                                 What to do when a smarthome client connects
+                                 as an sn that is connected already: close
+                                 the old connection (close code 4000), refuse
+                                 the new one with an "sn_in_use" error, or keep
+                                 both and send commands to the newest.
+                                 Default: replace
+
+  --pinginterval=DURATION        How often smarthome clients are sent a
+                                 WebSocket ping. 0 disables keepalive.
+                                 Default: 30s
+
+  --pingmisses=N                 Drop a smarthome client and report it
+                                 offline after N ping intervals without any
+                                 frame from it, pongs included. Default: 3
+
+  --routes=FILE                  JSON routing table for smarthome messages
+                                 whose type is not built in, e.g.
+                                 {"default":"drop","routes":[
+                                  {"type":"curtain","action":"reply-to-from"}]}
+                                 Routes match "type" and/or sender "c_type",
+                                 actions are reply-to-from, broadcast-to-rest,
+                                 forward-to-sn, drop and reject. By default
+                                 router, tv and cond messages are replies and
+                                 other types are rejected.
+
+  --firmwaredir=DIR              Offer smarthome devices firmware updates
+                                 from DIR, which holds one image per file as
+                                 C_TYPE/VERSION. Devices download updates
+                                 with "ota_check" in acknowledged chunks.
+                                 Updates are offered only by rollouts:
+                                 POST /api/rollouts with body
+                                 {"c_type":...,"version":...,"percent":N}
+                                 offers VERSION to N% of the devices of
+                                 C_TYPE, GET /api/rollouts lists rollouts,
+                                 GET /api/rollouts/C_TYPE shows the progress
+                                 of each device and GET /api/firmware lists
+                                 the images.
+
+  --rules=FILE                   JSON automation rules that send rest
+                                 commands when devices report notifications:
+                                 {"rules":[{"name":"porch-light",
+                                  "debounce":"5m","when":{"sn":"door-1",
+                                  "msgtype":"door","conditions":[{"field":
+                                  "state","op":"==","value":"open"}]},
+                                  "then":[{"sn":"light-1","data":{...}}]}]}
+                                 "when" may also match "c_type", conditions
+                                 compare data fields with ==, !=, <, <=, >,
+                                 >= or test them with "exists". A rule fires
+                                 at most once per debounce and sn. Rules are
+                                 "rules" in the --acl file. GET /api/rules
+                                 lists them, POST /api/rules/NAME/enable and
+                                 /disable switch them while running.
+
+  --rulesdryrun                  Only log the commands rules would send.
+                                 Rules with "dry_run":true always do.
+
+  --schedules=FILE               Store scheduled commands in FILE and send
+                                 their rest data to the device whenever the
+                                 cron expression (minute hour day-of-month
+                                 month day-of-week, server time) matches.
+                                 Clients manage their own with "schedule"
+                                 messages, the API with POST /api/schedules
+                                 {"cron":"0 23 * * 1-5","sn":...,"data":{...}},
+                                 GET /api/schedules[/ID] and DELETE
+                                 /api/schedules/ID. The last 20 runs of each
+                                 schedule record whether the device answered,
+                                 timed out or was offline.
+
+  --groups=FILE                  Store device groups in FILE. A rest command
+                                 with "group":NAME instead of "sn" is sent to
+                                 every device of the group, one with
+                                 "sns":[...] to each listed device. The
+                                 client gets a single reply with the same
+                                 wsid once all devices answered or timed
+                                 out: {"type":"rest","wsid":...,"results":
+                                 [{"sn":...,"status":"ok","data":{...}},
+                                 {"sn":...,"status":"timeout",...}]}.
+                                 PUT /api/groups/NAME {"sns":[...]} defines
+                                 a group, GET /api/groups[/NAME] and DELETE
+                                 /api/groups/NAME manage them and POST
+                                 /api/groups/NAME/commands {"data":{...}}
+                                 commands a group over HTTP. Group commands
+                                 cannot be persistent.
+
+  --auditlog=FILE                Append a JSON line to FILE for every rest
+                                 command and forwarded message between
+                                 smarthome clients: time, sender sn and
+                                 c_type, target sn, wsid, type, SHA-256 of the
+                                 payload, outcome (answered, delivered,
+                                 timeout, offline, queued, forbidden,
+                                 rejected) and latency. Search it with
+                                 '{{binary}} audit'.
+
+  --auditmaxsize=MIB             Rotate the audit log to FILE.TIMESTAMP when
+                                 it reaches MIB MiB, 0 for no limit.
+                                 Default: 100
+
+  --auditrotate=DURATION         Rotate the audit log when its first record
+                                 is older than DURATION, 0 for no limit.
+                                 Default: 24h
+
+  --auditretain=DURATION         Delete rotated audit logs not written for
+                                 DURATION, 0 to keep them. Default: 2160h
+
+  --maxframe=BYTES               Refuse frames from clients with a payload
+                                 larger than BYTES while reading them.
+                                 Default: 0 (no limit for COMMAND and --dir,
+                                 32 MiB for --smarthome and --protocols)
+
+  --ratemsgs=N                   Allow each client N messages per second,
+                                 with bursts of up to N. Default: 0 (no limit)
+
+  --ratebytes=N                  Allow each client N payload bytes per
+                                 second, with bursts of up to N.
+                                 Default: 0 (no limit)
+
+  --limitpolicy=POLICY           What to do with frames exceeding --maxframe,
+                                 --ratemsgs or --ratebytes: drop them, warn
+                                 in the log at most every 10s and pass them
+                                 on, or disconnect the client with close
+                                 code 1009 (too big) or 1008 (too fast).
+                                 Violations are counted in --metrics.
+                                 Default: disconnect
+
+  --mqtt=ADDRESS                 Accept MQTT 3.1.1 clients at ADDRESS like
+                                 127.0.0.1:1883. They receive the topics
+                                 devices/{sn}/online (retained "true" or
+                                 "false") and
+                                 devices/{sn}/notification/{msgtype}, and
+                                 publish {"wsid":...,"data":...} to
+                                 devices/{sn}/command to send a rest command,
+                                 answered on devices/{sn}/response/{wsid}
+                                 to the client that sent the command. A
+                                 client logged in as USER has the identity
+                                 "mqtt:USER" in --acl, sends commands as it
+                                 and only receives the topics of the sns it
+                                 may observe. Requires --smarthome and
+                                 --mqttusers.
+
+  --mqttusers=FILE               Lines of "username password" MQTT clients
+                                 must log in with, # starts a comment.
+                                 Others are refused with CONNACK 4 (wrong
+                                 password) or 5 (no credentials).
+
+  --protocols=PATH=NAME[,PATH=NAME...]
+                                 Serve WebSocket connections to PATH and the
+                                 paths below it with the built-in protocol
+                                 handler NAME instead of COMMAND. The longest
+                                 matching PATH wins. With --smarthome, the
+                                 smarthome broker serves all other paths.
 
   --origin=host[:port][,host[:port]...]
                                  Restrict (HTTP 403) protocol upgrades if the
@@ -90,6 +318,18 @@ Options:
 
   --logfile=FILE                 Log File absolutely path for websocket
 
+  --metrics                      Serve metrics in the Prometheus text format
+                                 on /metrics: open sessions, forks in use and
+                                 --maxforks, 429 rejections, WebSocket bytes
+                                 and messages in and out, process launch
+                                 failures and exit codes and, with
+                                 --smarthome, clients online per c_type and
+                                 messages routed and dropped per type.
+
+  --metricsaddr=ADDRESS          Serve /metrics on a separate HTTP listener
+                                 at ADDRESS like 127.0.0.1:9100 instead,
+                                 keeping it off the public port.
+
 Full documentation at http://websocketd.com/
 
 Copyright 2013 Joe Walnes and the websocketd team. All rights reserved.
@@ -104,6 +344,12 @@ Usage:
   Or, export an entire directory of executables as WebSocket endpoints:
     {{binary}} [options] --dir=SOMEDIR
 
+  Or, search the smarthome audit log:
+    {{binary}} audit [--sn=SN] [--wsid=WSID] [--since=TIME] [--until=TIME] FILE
+
+  Or, simulate smarthome devices against a broker:
+    {{binary}} simulate --devices=FILE [options] URL
+
   Or, show extended help message using:
     {{binary}} --help
 `
@@ -10,21 +10,48 @@ import (
 )
 
 type Config struct {
-	CommandName    string    // limx debug Command to execute.
-	CommandArgs    []string  // Additional args to pass to command.
-	ReverseLookup  bool      // Perform reverse DNS lookups on hostnames (useful, but slower).
-	Ssl            bool      // websocketd works with --ssl which means TLS is in use
-	ScriptDir      string    // Base directory for websocket scripts.
-	UsingScriptDir bool      // Are we running with a script dir.
-	StartupTime    time.Time // Server startup time (used for dev console caching).
-	StaticDir      string    // If set, static files will be served from this dir over HTTP.
-	CgiDir         string    // If set, CGI scripts will be served from this dir over HTTP.
-	DevConsole     bool      // Enable dev console. This disables StaticDir and CgiDir.
-	ServerSoftware string    // Value to pass to SERVER_SOFTWARE environment variable (e.g. websocketd/1.2.3).
-	Env            []string  // Additional environment variables to pass to process ("key=value").
-	ParentEnv      []string  // Variables kept from os.Environ() before sanitizing it for subprocess.
-	AllowOrigins   []string  // List of allowed origin addresses for websocket upgrade.
-	SameOrigin     bool      // If set, requires websocket upgrades to be performed from same origin only.
-	Smarthome      bool      // Smarthome support
-	LogFile        string    // lizm add : websocketd log file absolutely path
+	CommandName    string        // Command to execute.
+	CommandArgs    []string      // Additional args to pass to command.
+	ReverseLookup  bool          // Perform reverse DNS lookups on hostnames (useful, but slower).
+	Ssl            bool          // websocketd works with --ssl which means TLS is in use
+	ScriptDir      string        // Base directory for websocket scripts.
+	UsingScriptDir bool          // Are we running with a script dir.
+	StartupTime    time.Time     // Server startup time (used for dev console caching).
+	StaticDir      string        // If set, static files will be served from this dir over HTTP.
+	CgiDir         string        // If set, CGI scripts will be served from this dir over HTTP.
+	DevConsole     bool          // Enable dev console. This disables StaticDir and CgiDir.
+	ServerSoftware string        // Value to pass to SERVER_SOFTWARE environment variable (e.g. websocketd/1.2.3).
+	Env            []string      // Additional environment variables to pass to process ("key=value").
+	ParentEnv      []string      // Variables kept from os.Environ() before sanitizing it for subprocess.
+	AllowOrigins   []string      // List of allowed origin addresses for websocket upgrade.
+	SameOrigin     bool          // If set, requires websocket upgrades to be performed from same origin only.
+	Smarthome      bool          // Smarthome support
+	LogFile        string        // File the log is written to, empty for stdout.
+	DeviceFile     string        // Registry of smarthome devices (sn, mac, shared secret) allowed to authenticate.
+	TokenTTL       time.Duration // Lifetime of tokens issued to smarthome devices by "auth".
+	APIToken       string        // Bearer token the smarthome HTTP API requires, empty to disable the API.
+	ReplyTimeout   time.Duration // How long a rest client waits for the device to answer a command.
+	QueueDir       string        // Directory storing persistent commands for offline devices, empty to disable.
+	QueueTTL       time.Duration // How long persistent commands wait for the device to connect.
+	QueueLimit     int           // Most persistent commands queued per sn, 0 for no limit.
+	ACLFile        string        // Access list of the sns each smarthome client may command and observe, empty allows everything.
+	DuplicateSn    string        // Takeover policy when a smarthome client connects as an sn that is connected already.
+	PingInterval   time.Duration // How often smarthome clients are pinged, 0 disables keepalive.
+	PingMisses     int           // Number of ping intervals without any frame after which a smarthome client is dropped.
+	RoutesFile     string        // Routing table for smarthome messages of custom types, empty for the built-in one.
+	Protocols      []string      // Protocol handlers serving WebSocket paths instead of the command, as "PATH=NAME".
+	FirmwareDir    string        // Directory of firmware images for smarthome devices as C_TYPE/VERSION, empty to disable updates.
+	RulesFile      string        // Automation rules sending commands when devices report notifications, empty for none.
+	RulesDryRun    bool          // Only log the commands automation rules would send.
+	ScheduleFile   string        // File storing scheduled commands, empty to disable them.
+	GroupFile      string        // File storing device groups rest commands can address, empty to disable them.
+	AuditFile      string        // JSON lines log of the commands routed between smarthome clients, empty to disable it.
+	AuditMaxSize   int64         // Size in bytes after which the audit log is rotated, 0 for no limit.
+	AuditRotate    time.Duration // Age after which the audit log is rotated, 0 for no limit.
+	AuditRetain    time.Duration // How long rotated audit logs are kept, 0 to keep them forever.
+	Metrics        bool          // Serve Prometheus metrics on /metrics of the WebSocket listener.
+	MaxFrameSize   int           // Largest frame payload in bytes accepted from clients, 0 for no limit on processes and 32 MiB on protocol handlers.
+	MessageRate    float64       // Messages per second each client may send, 0 for no limit.
+	ByteRate       float64       // Payload bytes per second each client may send, 0 for no limit.
+	LimitPolicy    string        // What to do with frames exceeding the limits: drop, warn or disconnect.
 }
@@ -0,0 +1,159 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSpec is a parsed cron expression of five fields: minute, hour, day of
+// month, month and day of week. Each field is "*", a number, a range "a-b"
+// or a comma separated list of those, optionally followed by a step "/n".
+// Day of week 0 and 7 are Sunday. As in cron, if both day of month and day
+// of week are restricted a day matching either one matches.
+type CronSpec struct {
+	minute, hour, dom, month, dow uint64 // bit n set if value n matches
+	anyDom, anyDow                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCron parses a cron expression such as "0 23 * * 1-5".
+func ParseCron(expr string) (*CronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q does not have 5 fields", expr)
+	}
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s of cron expression %q: %s", cronFields[i].name, expr, err)
+		}
+		sets[i] = set
+	}
+	spec := &CronSpec{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	return spec, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+		from, to := min, max
+		switch i := strings.Index(part, "-"); {
+		case part == "*":
+		case i >= 0:
+			var err error
+			if from, err = cronValue(part[:i], min, max); err != nil {
+				return 0, err
+			}
+			if to, err = cronValue(part[i+1:], min, max); err != nil {
+				return 0, err
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			var err error
+			if from, err = cronValue(part, min, max); err != nil {
+				return 0, err
+			}
+			if step == 1 {
+				to = from
+			}
+		}
+		for n := from; n <= to; n += step {
+			set |= 1 << uint(n)
+		}
+	}
+	return set, nil
+}
+
+func cronValue(s string, min, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%q is not a number from %d to %d", s, min, max)
+	}
+	return n, nil
+}
+
+func hasBit(set uint64, n int) bool {
+	return set&(1<<uint(n)) != 0
+}
+
+// Matches reports whether the minute of t matches s.
+func (s *CronSpec) Matches(t time.Time) bool {
+	return hasBit(s.minute, t.Minute()) && hasBit(s.hour, t.Hour()) && s.matchesDay(t)
+}
+
+func (s *CronSpec) matchesDay(t time.Time) bool {
+	if !hasBit(s.month, int(t.Month())) {
+		return false
+	}
+	dom, dow := hasBit(s.dom, t.Day()), hasBit(s.dow, int(t.Weekday()))
+	switch {
+	case s.anyDom && s.anyDow:
+		return true
+	case s.anyDom:
+		return dow
+	case s.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t matching s, or the zero time if
+// there is none within five years, as for "0 0 31 2 *".
+func (s *CronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		y, m, d := t.Date()
+		switch {
+		case !s.matchesDay(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case !hasBit(s.hour, t.Hour()):
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case !hasBit(s.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,57 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"testing"
+	"time"
+)
+
+var cronNextTests = []struct {
+	expr, from, want string
+}{
+	{"* * * * *", "2016-03-01 10:15", "2016-03-01 10:16"},
+	{"0 23 * * 1-5", "2016-03-04 23:00", "2016-03-07 23:00"}, // Friday to Monday
+	{"0 23 * * 1-5", "2016-03-07 22:59", "2016-03-07 23:00"},
+	{"*/15 * * * *", "2016-03-01 10:15", "2016-03-01 10:30"},
+	{"5,35 8-9 * * *", "2016-03-01 09:35", "2016-03-02 08:05"},
+	{"0 0 29 2 *", "2016-03-01 00:00", "2020-02-29 00:00"},
+	{"0 12 1 * 0", "2016-03-02 00:00", "2016-03-06 12:00"}, // day of month or Sunday
+	{"0 12 * * 7", "2016-03-02 00:00", "2016-03-06 12:00"},
+	{"30 4 1/10 * *", "2016-03-01 05:00", "2016-03-11 04:30"},
+	{"0 0 31 2 *", "2016-03-01 00:00", ""},
+}
+
+func TestCronNext(t *testing.T) {
+	const layout = "2006-01-02 15:04"
+	for _, test := range cronNextTests {
+		spec, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		from, _ := time.ParseInLocation(layout, test.from, time.Local)
+		next := spec.Next(from)
+		got := ""
+		if !next.IsZero() {
+			got = next.Format(layout)
+			if !spec.Matches(next) {
+				t.Errorf("%s: %s does not match", test.expr, got)
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s from %s: got %q, want %q", test.expr, test.from, got, test.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "* * * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q accepted", expr)
+		}
+	}
+}
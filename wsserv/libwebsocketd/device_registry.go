@@ -0,0 +1,190 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DeviceEntry is a smarthome client bound to an sn by "connect".
+type DeviceEntry struct {
+	lastSeen int64 // unix nanoseconds, accessed atomically
+
+	Sn          string
+	CType       string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Endpoint    *SmarthomeWebSocketEndpoint
+}
+
+// NewDeviceEntry creates entry for endpoint that has just connected as sn.
+func NewDeviceEntry(sn, ctype, remoteAddr string, endpoint *SmarthomeWebSocketEndpoint) *DeviceEntry {
+	now := time.Now()
+	return &DeviceEntry{
+		Sn:          sn,
+		CType:       ctype,
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: now,
+		Endpoint:    endpoint,
+		lastSeen:    now.UnixNano(),
+	}
+}
+
+// Touch records that a message was received from the device at t.
+func (e *DeviceEntry) Touch(t time.Time) {
+	atomic.StoreInt64(&e.lastSeen, t.UnixNano())
+}
+
+// LastSeen returns time of the last message received from the device.
+func (e *DeviceEntry) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&e.lastSeen))
+}
+
+// TakeoverPolicy decides what happens when a client connects as an sn that
+// already has a connection.
+type TakeoverPolicy string
+
+const (
+	TakeoverReplace    TakeoverPolicy = "replace"     // close the old connection
+	TakeoverReject     TakeoverPolicy = "reject"      // refuse the new connection
+	TakeoverAllowMulti TakeoverPolicy = "allow-multi" // keep both, route to the newest
+)
+
+// ParseTakeoverPolicy checks that name is one of the takeover policies.
+func ParseTakeoverPolicy(name string) (TakeoverPolicy, error) {
+	switch policy := TakeoverPolicy(name); policy {
+	case TakeoverReplace, TakeoverReject, TakeoverAllowMulti:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown takeover policy %q, expected replace, reject or allow-multi", name)
+}
+
+// TakeoverStats counts connections to an sn that was connected already, by
+// the outcome.
+type TakeoverStats struct {
+	Replaced uint64 `json:"replaced"`
+	Rejected uint64 `json:"rejected"`
+	Multi    uint64 `json:"multi"`
+}
+
+// DeviceRegistry keeps track of connected smarthome clients by sn.
+// It is safe for concurrent use by the connection goroutines.
+type DeviceRegistry struct {
+	mutex   sync.RWMutex
+	entries map[string][]*DeviceEntry // oldest first
+	stats   TakeoverStats
+}
+
+func NewDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{entries: make(map[string][]*DeviceEntry)}
+}
+
+// Bind adds entry according to policy, TakeoverReplace if empty. Existing are
+// the entries bound to the sn before: with TakeoverReplace they have been
+// removed and it is up to the caller to close them, with TakeoverReject entry
+// was not added and ok is false, with TakeoverAllowMulti they stay and
+// entry is the one Lookup returns from now on.
+func (r *DeviceRegistry) Bind(entry *DeviceEntry, policy TakeoverPolicy) (existing []*DeviceEntry, ok bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	existing = r.entries[entry.Sn]
+	switch {
+	case len(existing) == 0:
+		r.entries[entry.Sn] = []*DeviceEntry{entry}
+	case policy == TakeoverReject:
+		r.stats.Rejected++
+		return existing, false
+	case policy == TakeoverAllowMulti:
+		r.stats.Multi++
+		r.entries[entry.Sn] = append(existing[:len(existing):len(existing)], entry)
+	default:
+		r.stats.Replaced++
+		r.entries[entry.Sn] = []*DeviceEntry{entry}
+	}
+	return existing, true
+}
+
+// Register binds entry to its sn, replacing other entries, and returns the
+// newest entry it replaced, if any.
+func (r *DeviceRegistry) Register(entry *DeviceEntry) *DeviceEntry {
+	existing, _ := r.Bind(entry, TakeoverReplace)
+	if len(existing) == 0 {
+		return nil
+	}
+	return existing[len(existing)-1]
+}
+
+// Unregister removes entry from the registry. It returns true if that left
+// the sn without connection. Nothing is removed if the sn has been taken over
+// by another entry since, in which case false is returned.
+func (r *DeviceRegistry) Unregister(entry *DeviceEntry) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	existing := r.entries[entry.Sn]
+	for i, e := range existing {
+		if e != entry {
+			continue
+		}
+		if len(existing) == 1 {
+			delete(r.entries, entry.Sn)
+			return true
+		}
+		rest := make([]*DeviceEntry, 0, len(existing)-1)
+		r.entries[entry.Sn] = append(append(rest, existing[:i]...), existing[i+1:]...)
+		return false
+	}
+	return false
+}
+
+// Lookup returns the newest entry bound to sn or nil if sn is not connected.
+func (r *DeviceRegistry) Lookup(sn string) *DeviceEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	existing := r.entries[sn]
+	if len(existing) == 0 {
+		return nil
+	}
+	return existing[len(existing)-1]
+}
+
+// ByType returns entries of given client type, or all entries if ctype is
+// empty. The result is a snapshot, so it is fine to send to the endpoints
+// while other goroutines connect and disconnect.
+func (r *DeviceRegistry) ByType(ctype string) []*DeviceEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	result := make([]*DeviceEntry, 0, len(r.entries))
+	for _, existing := range r.entries {
+		for _, entry := range existing {
+			if ctype == "" || entry.CType == ctype {
+				result = append(result, entry)
+			}
+		}
+	}
+	return result
+}
+
+// Len returns number of connected clients.
+func (r *DeviceRegistry) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	n := 0
+	for _, existing := range r.entries {
+		n += len(existing)
+	}
+	return n
+}
+
+// Takeovers returns how often clients connected as an sn that was connected
+// already.
+func (r *DeviceRegistry) Takeovers() TakeoverStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.stats
+}
@@ -0,0 +1,142 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeviceRegistryTakeover(t *testing.T) {
+	r := NewDeviceRegistry()
+	first := NewDeviceEntry("router-1", "router", "10.0.0.1:1000", nil)
+	second := NewDeviceEntry("router-1", "router", "10.0.0.2:1000", nil)
+
+	if previous := r.Register(first); previous != nil {
+		t.Errorf("unexpected previous entry %v", previous)
+	}
+	if previous := r.Register(second); previous != first {
+		t.Errorf("expected first entry to be replaced, got %v", previous)
+	}
+	if r.Unregister(first) {
+		t.Error("stale entry should not unregister its successor")
+	}
+	if r.Lookup("router-1") != second {
+		t.Error("successor was removed")
+	}
+	if !r.Unregister(second) {
+		t.Error("current entry should unregister")
+	}
+	if r.Lookup("router-1") != nil || r.Len() != 0 {
+		t.Error("registry should be empty")
+	}
+}
+
+func TestDeviceRegistryBindPolicies(t *testing.T) {
+	r := NewDeviceRegistry()
+	first := NewDeviceEntry("tv-1", "tv", "10.0.0.1:1000", nil)
+	second := NewDeviceEntry("tv-1", "tv", "10.0.0.2:1000", nil)
+	third := NewDeviceEntry("tv-1", "tv", "10.0.0.3:1000", nil)
+
+	if existing, ok := r.Bind(first, TakeoverReject); !ok || len(existing) != 0 {
+		t.Fatalf("first bind failed: %v %v", existing, ok)
+	}
+	if existing, ok := r.Bind(second, TakeoverReject); ok || len(existing) != 1 || existing[0] != first {
+		t.Errorf("reject policy accepted %v %v", existing, ok)
+	}
+	if existing, ok := r.Bind(second, TakeoverAllowMulti); !ok || len(existing) != 1 {
+		t.Errorf("allow-multi policy returned %v %v", existing, ok)
+	}
+	if r.Lookup("tv-1") != second || r.Len() != 2 {
+		t.Errorf("expected newest of 2 connections, got %v of %d", r.Lookup("tv-1"), r.Len())
+	}
+	if r.Unregister(second) {
+		t.Error("sn should stay online while first is connected")
+	}
+	if r.Lookup("tv-1") != first {
+		t.Error("expected to fall back to first connection")
+	}
+	if existing, ok := r.Bind(third, TakeoverReplace); !ok || len(existing) != 1 || existing[0] != first {
+		t.Errorf("replace policy returned %v %v", existing, ok)
+	}
+	if r.Len() != 1 {
+		t.Errorf("replace should leave one connection, got %d", r.Len())
+	}
+
+	stats := r.Takeovers()
+	if stats.Rejected != 1 || stats.Multi != 1 || stats.Replaced != 1 {
+		t.Errorf("unexpected takeover stats %+v", stats)
+	}
+
+	if _, err := ParseTakeoverPolicy("allow-multi"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseTakeoverPolicy("newest"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestDeviceRegistryByType(t *testing.T) {
+	r := NewDeviceRegistry()
+	r.Register(NewDeviceEntry("router-1", "router", "", nil))
+	r.Register(NewDeviceEntry("tv-1", "tv", "", nil))
+	r.Register(NewDeviceEntry("app-1", "rest", "", nil))
+	r.Register(NewDeviceEntry("app-2", "rest", "", nil))
+
+	if n := len(r.ByType("rest")); n != 2 {
+		t.Errorf("expected 2 rest clients, got %d", n)
+	}
+	if n := len(r.ByType("cond")); n != 0 {
+		t.Errorf("expected no cond clients, got %d", n)
+	}
+	if n := len(r.ByType("")); n != 4 {
+		t.Errorf("expected 4 clients in total, got %d", n)
+	}
+}
+
+func TestDeviceEntryTouch(t *testing.T) {
+	entry := NewDeviceEntry("router-1", "router", "", nil)
+	if !entry.LastSeen().Equal(entry.ConnectedAt) {
+		t.Error("last seen should start at connect time")
+	}
+	later := entry.ConnectedAt.Add(time.Minute)
+	entry.Touch(later)
+	if !entry.LastSeen().Equal(later) {
+		t.Errorf("last seen %s, expected %s", entry.LastSeen(), later)
+	}
+}
+
+// TestDeviceRegistryConcurrentConnect hammers the registry the way connection
+// goroutines do. Run with -race.
+func TestDeviceRegistryConcurrentConnect(t *testing.T) {
+	r := NewDeviceRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sn := fmt.Sprintf("sn-%d", i%8) // several goroutines fight for every sn
+			for j := 0; j < 200; j++ {
+				entry := NewDeviceEntry(sn, "router", "", nil)
+				r.Register(entry)
+				if found := r.Lookup(sn); found != nil {
+					found.Touch(time.Now())
+					found.LastSeen()
+				}
+				for _, other := range r.ByType("router") {
+					other.Touch(time.Now())
+				}
+				r.Unregister(entry)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if r.Len() != 0 {
+		t.Errorf("expected every connection to clean up, %d left", r.Len())
+	}
+}
@@ -64,7 +64,9 @@ func (e *TestEndpoint) Send(msg string) bool {
 func TestEndpointPipe(t *testing.T) {
 	one := &TestEndpoint{2, "one:", make(chan string), make([]string, 0)}
 	two := &TestEndpoint{4, "two:", make(chan string), make([]string, 0)}
-	PipeEndpoints(one, two)
+	log := new(LogScope)
+	log.LogFunc = func(*LogScope, LogLevel, string, string, string, ...interface{}) {}
+	PipeEndpoints(one, two, log)
 	if len(one.result) != 4 || len(two.result) != 2 {
 		t.Errorf("Invalid lengths, should be 4 and 2: %v %v", one.result, two.result)
 	} else if one.result[0] != "two:0" || two.result[0] != "one:0" {
@@ -24,10 +24,25 @@ var ForkNotAllowedError = errors.New("too many forks active")
 
 // WebsocketdServer presents http.Handler interface for requests libwebsocketd is handling.
 type WebsocketdServer struct {
-	Config                         *Config
-	Log                            *LogScope
-	forks                          chan byte
-	SmarthomeWebSocketEndpointPool map[string]*SmarthomeWebSocketEndpoint
+	Config      *Config
+	Log         *LogScope
+	forks       chan byte
+	protocols   []protocolRoute    // Protocol handlers by URL path, longest path first
+	Devices     *DeviceRegistry    // Smarthome clients currently connected, by sn
+	Pending     *PendingRequests   // Rest commands waiting for the device to answer
+	Credentials *DeviceCredentials // Devices allowed to use the smarthome broker
+	Queue       *CommandQueue      // Persistent commands for offline devices, nil if disabled
+	States      *StateCache        // Latest notifications per device and msgtype
+	Subscribers *SubscriptionIndex // Notifications each client asked for
+	Authorizer  Authorizer         // Access control for smarthome clients, nil allows everything
+	Routes      *RoutingTable      // What to do with smarthome messages of custom types
+	OTA         *OTAManager        // Firmware rollouts, nil if disabled
+	Rules       *RuleEngine        // Automation rules run on notifications, nil if none
+	Schedules   *ScheduleStore     // Commands sent at scheduled times, nil if disabled
+	Groups      *GroupStore        // Named lists of sns rest commands can address, nil if disabled
+	Audit       *AuditLog          // Record of the commands routed between clients, nil if disabled
+	Metrics     *Metrics           // Counters served on /metrics
+	MQTT        *MQTTBridge        // MQTT clients receiving notifications and sending commands, nil if disabled
 }
 
 // NewWebsocketdServer creates WebsocketdServer struct with pre-determined config, logscope and maxforks limit
@@ -40,15 +55,28 @@ func NewWebsocketdServer(config *Config, log *LogScope, maxforks int) *Websocket
 		mux.forks = make(chan byte, maxforks)
 	}
 
-	mux.SmarthomeWebSocketEndpointPool = make(map[string]*SmarthomeWebSocketEndpoint)
+	mux.protocols = protocolRoutes(config)
+	mux.Devices = NewDeviceRegistry()
+	mux.Pending = NewPendingRequests()
+	mux.States = NewStateCache()
+	mux.Subscribers = NewSubscriptionIndex()
+	mux.Routes = DefaultRoutingTable()
+	mux.Metrics = NewMetrics()
 
 	return mux
 }
 
 // wshandshake returns closure to verify websocket origin header according to configured rules
-func (h *WebsocketdServer) wshandshake(log *LogScope) func(*websocket.Config, *http.Request) error {
+// and to pick the subprotocol if protocol negotiates one
+func (h *WebsocketdServer) wshandshake(protocol ProtocolHandler, log *LogScope) func(*websocket.Config, *http.Request) error {
 	return func(wsconf *websocket.Config, req *http.Request) error {
-		return checkOrigin(wsconf, req, h.Config, log)
+		if err := checkOrigin(wsconf, req, h.Config, log); err != nil {
+			return err
+		}
+		if sub, ok := protocol.(SubprotocolHandler); ok {
+			wsconf.Protocol = selectSubprotocol(sub.Subprotocols(), wsconf.Protocol)
+		}
+		return nil
 	}
 }
 
@@ -80,21 +108,20 @@ func (h *WebsocketdServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 				// Now we are ready for connection upgrade dance...
 				wsServer := &websocket.Server{
-					Handshake: h.wshandshake(log),
+					Handshake: h.wshandshake(handler.protocol, log),
 					Handler:   handler.wshandler(log),
 				}
 				wsServer.ServeHTTP(w, req)
 			} else {
 				log.Error("http", "Max of possible forks already active, upgrade rejected")
+				h.Metrics.ForkRejected()
 				http.Error(w, "429 Too Many Requests", 429)
 			}
 			return
 		}
 	}
 
-	if h.Config.Smarthome {
-		log.Debug("limx debug", "smarthome serve http doing ...")
-
+	if len(h.protocols) > 0 {
 		hdrs := req.Header
 		upgradeRe := regexp.MustCompile("(?i)(^|[,\\s])Upgrade($|[,\\s])")
 		// WebSocket, limited to size of h.forks
@@ -116,18 +143,30 @@ func (h *WebsocketdServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 				// Now we are ready for connection upgrade dance...
 				wsServer := &websocket.Server{
-					Handshake: h.wshandshake(log),
+					Handshake: h.wshandshake(handler.protocol, log),
 					Handler:   handler.wshandler(log),
 				}
 				wsServer.ServeHTTP(w, req)
 			} else {
 				log.Error("http", "Max of possible forks already active, upgrade rejected")
+				h.Metrics.ForkRejected()
 				http.Error(w, "429 Too Many Requests", 429)
 			}
 			return
 		}
 	}
 
+	if h.Config.Metrics && req.URL.Path == "/metrics" {
+		log.Access("http", "METRICS")
+		h.ServeMetrics(w, req)
+		return
+	}
+
+	if h.Config.Smarthome && strings.HasPrefix(req.URL.Path, "/api/") {
+		h.serveSmarthomeAPI(w, req, log)
+		return
+	}
+
 	// Dev console (if enabled)
 	if h.Config.DevConsole {
 		log.Access("http", "DEVCONSOLE")
@@ -164,6 +203,7 @@ func (h *WebsocketdServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				cgiHandler.ServeHTTP(w, req)
 			} else {
 				log.Error("http", "Fork not allowed since maxforks amount has been reached. CGI was not run.")
+				h.Metrics.ForkRejected()
 				http.Error(w, "429 Too Many Requests", 429)
 			}
 			return
@@ -8,6 +8,8 @@ package libwebsocketd
 import (
 	"io"
 	"os/exec"
+	"strconv"
+	"syscall"
 )
 
 type LaunchedProcess struct {
@@ -43,3 +45,22 @@ func launchCmd(commandName string, commandArgs []string, env []string) (*Launche
 
 	return &LaunchedProcess{cmd, stdin, stdout, stderr}, err
 }
+
+// exitCode describes how the process ended once it has been waited for: its
+// exit status or the name of the signal that killed it.
+func (p *LaunchedProcess) exitCode() string {
+	state := p.cmd.ProcessState
+	if state == nil {
+		return "unknown"
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			return status.Signal().String()
+		}
+		return strconv.Itoa(status.ExitStatus())
+	}
+	if state.Success() {
+		return "0"
+	}
+	return "unknown"
+}
@@ -0,0 +1,193 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Close codes sent when a connection violates its limits.
+const (
+	ClosePolicyViolation = 1008 // client exceeded its message or byte rate
+	CloseMessageTooBig   = 1009 // client sent a frame larger than --maxframe
+)
+
+// Kinds of limit violations counted in Metrics.
+const (
+	LimitRate = "rate"
+	LimitSize = "size"
+)
+
+// LimitPolicy decides what happens to frames exceeding the limits of a
+// connection.
+type LimitPolicy string
+
+const (
+	LimitDrop       LimitPolicy = "drop"       // discard the frame
+	LimitWarn       LimitPolicy = "warn"       // log it and let it through
+	LimitDisconnect LimitPolicy = "disconnect" // close the connection
+)
+
+// ParseLimitPolicy checks that name is one of the limit policies.
+func ParseLimitPolicy(name string) (LimitPolicy, error) {
+	switch policy := LimitPolicy(name); policy {
+	case LimitDrop, LimitWarn, LimitDisconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown limit policy %q, expected drop, warn or disconnect", name)
+}
+
+// TokenBucket allows rate tokens per second with bursts of up to one
+// second's worth. A single take may exceed what the bucket holds if the
+// bucket is full, leaving it in debt, so any size can pass eventually.
+type TokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, now time.Time) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// Take removes n tokens and returns true if enough are available at now.
+func (b *TokenBucket) Take(n float64, now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	need := n
+	if need > b.rate {
+		need = b.rate
+	}
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// warnInterval limits how often the warn policy logs a connection's
+// violations.
+const warnInterval = 10 * time.Second
+
+// ConnLimiter applies the message rate, byte rate and frame size limits of
+// the configuration to the frames read from one connection. A nil
+// *ConnLimiter allows everything. It is used by the reading goroutine only.
+type ConnLimiter struct {
+	policy   LimitPolicy
+	maxFrame int
+	messages *TokenBucket // nil if unlimited
+	bytes    *TokenBucket // nil if unlimited
+	metrics  *Metrics
+	log      *LogScope
+
+	warned     time.Time // last time a violation was logged
+	suppressed int       // violations not logged since
+}
+
+// NewConnLimiter returns the limiter for a new connection, or nil if config
+// sets no limits.
+func NewConnLimiter(config *Config, metrics *Metrics, log *LogScope) *ConnLimiter {
+	if config.MaxFrameSize <= 0 && config.MessageRate <= 0 && config.ByteRate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	l := &ConnLimiter{
+		policy:   LimitPolicy(config.LimitPolicy),
+		maxFrame: config.MaxFrameSize,
+		metrics:  metrics,
+		log:      log,
+	}
+	if l.policy == "" {
+		l.policy = LimitDisconnect
+	}
+	if config.MessageRate > 0 {
+		l.messages = NewTokenBucket(config.MessageRate, now)
+	}
+	if config.ByteRate > 0 {
+		l.bytes = NewTokenBucket(config.ByteRate, now)
+	}
+	return l
+}
+
+// unlimitedPayload as websocket.Conn.MaxPayloadBytes reads frames of any
+// size.
+const unlimitedPayload = int(^uint(0) >> 1)
+
+// Prepare makes ws refuse frames larger than the limit while reading them.
+// With the warn policy or without a limit frames are only refused beyond the
+// library's default of websocket.DefaultMaxPayloadBytes, and not at all if
+// unbounded is set. Process endpoints set it to read frames of any size, as
+// they did before limits existed.
+func (l *ConnLimiter) Prepare(ws *websocket.Conn, unbounded bool) {
+	switch {
+	case l != nil && l.maxFrame > 0 && l.policy != LimitWarn:
+		ws.MaxPayloadBytes = l.maxFrame
+	case unbounded:
+		ws.MaxPayloadBytes = unlimitedPayload
+	}
+}
+
+// Oversized handles a frame the connection refused with
+// websocket.ErrFrameTooLarge. It returns the close code to send if the
+// connection has to be closed, else 0 and the frame is skipped.
+func (l *ConnLimiter) Oversized() int {
+	if l == nil {
+		return CloseMessageTooBig
+	}
+	return l.violation(LimitSize, fmt.Sprintf("frame larger than %d bytes", l.maxFrame), time.Now())
+}
+
+// Allow checks a frame of size bytes read at now against the limits. It
+// returns whether to pass the frame on and, if the connection has to be
+// closed, the close code.
+func (l *ConnLimiter) Allow(size int, now time.Time) (pass bool, closeCode int) {
+	if l == nil {
+		return true, 0
+	}
+	kind, reason := "", ""
+	switch {
+	case l.maxFrame > 0 && size > l.maxFrame:
+		kind, reason = LimitSize, fmt.Sprintf("%d bytes frame larger than %d bytes", size, l.maxFrame)
+	case l.messages != nil && !l.messages.Take(1, now):
+		kind, reason = LimitRate, fmt.Sprintf("more than %g messages per second", l.messages.rate)
+	case l.bytes != nil && !l.bytes.Take(float64(size), now):
+		kind, reason = LimitRate, fmt.Sprintf("more than %g bytes per second", l.bytes.rate)
+	default:
+		return true, 0
+	}
+	closeCode = l.violation(kind, reason, now)
+	return l.policy == LimitWarn, closeCode
+}
+
+func (l *ConnLimiter) violation(kind, reason string, now time.Time) int {
+	l.metrics.LimitViolation(kind)
+	switch l.policy {
+	case LimitDisconnect:
+		l.log.Access("websocket", "LIMIT: %s, disconnecting", reason)
+		if kind == LimitSize {
+			return CloseMessageTooBig
+		}
+		return ClosePolicyViolation
+	case LimitWarn:
+		if now.Sub(l.warned) < warnInterval {
+			l.suppressed++
+			return 0
+		}
+		l.log.Access("websocket", "LIMIT: %s, %d more violations since last warning", reason, l.suppressed)
+		l.warned, l.suppressed = now, 0
+	default:
+		l.log.Debug("websocket", "LIMIT: %s, frame dropped", reason)
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := NewTokenBucket(2, start)
+	if !b.Take(1, start) || !b.Take(1, start) {
+		t.Error("burst of 2 not allowed")
+	}
+	if b.Take(1, start) {
+		t.Error("third take allowed")
+	}
+	if !b.Take(1, start.Add(500*time.Millisecond)) {
+		t.Error("take after refill not allowed")
+	}
+
+	// a take larger than the bucket passes when it is full, leaving debt
+	b = NewTokenBucket(10, start)
+	if !b.Take(25, start) {
+		t.Error("large take on full bucket not allowed")
+	}
+	if b.Take(1, start.Add(time.Second)) {
+		t.Error("take allowed while in debt")
+	}
+	if !b.Take(1, start.Add(2*time.Second)) {
+		t.Error("take not allowed after debt paid")
+	}
+}
+
+func TestParseLimitPolicy(t *testing.T) {
+	for _, name := range []string{"drop", "warn", "disconnect"} {
+		if policy, err := ParseLimitPolicy(name); err != nil || string(policy) != name {
+			t.Errorf("%s: %q %v", name, policy, err)
+		}
+	}
+	if _, err := ParseLimitPolicy("ignore"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	if NewConnLimiter(&Config{LimitPolicy: "drop"}, nil, testLogScope()) != nil {
+		t.Error("limiter without limits")
+	}
+	var none *ConnLimiter
+	if pass, code := none.Allow(1<<20, time.Now()); !pass || code != 0 {
+		t.Error("nil limiter refused frame")
+	}
+
+	now := time.Now()
+	metrics := NewMetrics()
+	cases := []struct {
+		policy     string
+		pass       bool
+		size, rate int
+	}{
+		{"disconnect", false, CloseMessageTooBig, ClosePolicyViolation},
+		{"drop", false, 0, 0},
+		{"warn", true, 0, 0},
+	}
+	for _, c := range cases {
+		l := NewConnLimiter(&Config{MaxFrameSize: 100, MessageRate: 1, LimitPolicy: c.policy}, metrics, testLogScope())
+		if pass, code := l.Allow(101, now); pass != c.pass || code != c.size {
+			t.Errorf("%s: oversized frame %v %d", c.policy, pass, code)
+		}
+		if pass, code := l.Allow(10, now); !pass || code != 0 {
+			t.Errorf("%s: first frame %v %d", c.policy, pass, code)
+		}
+		if pass, code := l.Allow(10, now); pass != c.pass || code != c.rate {
+			t.Errorf("%s: second frame %v %d", c.policy, pass, code)
+		}
+	}
+	if metrics.violations[LimitSize] != 3 || metrics.violations[LimitRate] != 3 {
+		t.Errorf("violations counted %v", metrics.violations)
+	}
+}
+
+func TestConnLimiterPrepare(t *testing.T) {
+	cases := []struct {
+		config    *Config
+		unbounded bool
+		want      int
+	}{
+		{&Config{}, true, unlimitedPayload},
+		{&Config{}, false, 0},
+		{&Config{MaxFrameSize: 100}, true, 100},
+		{&Config{MaxFrameSize: 100}, false, 100},
+		{&Config{MaxFrameSize: 100, LimitPolicy: "warn"}, true, unlimitedPayload},
+		{&Config{MaxFrameSize: 100, LimitPolicy: "warn"}, false, 0},
+	}
+	for _, c := range cases {
+		ws := &websocket.Conn{}
+		NewConnLimiter(c.config, nil, testLogScope()).Prepare(ws, c.unbounded)
+		if ws.MaxPayloadBytes != c.want {
+			t.Errorf("%+v, unbounded %t: limit %d", c.config, c.unbounded, ws.MaxPayloadBytes)
+		}
+	}
+}
+
+func TestSmarthomeLimits(t *testing.T) {
+	b := newTestBroker(t, &Config{MaxFrameSize: 256, MessageRate: 5, Metrics: true})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.sendRaw(`{"type":"ping","pad":"` + strings.Repeat("x", 300) + `"}`)
+	app.expectClosed()
+	if status, _ := app.ws.CloseStatus(); status != CloseMessageTooBig {
+		t.Errorf("expected close status %d for oversized frame, got %d", CloseMessageTooBig, status)
+	}
+
+	flood := b.connect("app-2", "-", "appsecret", "rest")
+	defer flood.Close()
+	for i := 0; i < 10; i++ {
+		flood.sendRaw(`{"type":"subscribe","wsid":"s1","msgtypes":["devicestate"]}`)
+	}
+	flood.expectClosed()
+	if status, _ := flood.ws.CloseStatus(); status != ClosePolicyViolation {
+		t.Errorf("expected close status %d for flood, got %d", ClosePolicyViolation, status)
+	}
+
+	b.server.Metrics.mutex.Lock()
+	violations := copyCounts(b.server.Metrics.violations)
+	b.server.Metrics.mutex.Unlock()
+	if violations[LimitSize] != 1 || violations[LimitRate] != 1 {
+		t.Errorf("violations counted %v", violations)
+	}
+}
+
+func TestSmarthomeLimitsDrop(t *testing.T) {
+	b := newTestBroker(t, &Config{MaxFrameSize: 256, LimitPolicy: "drop"})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.sendRaw(`{"type":"subscribe","wsid":"big","pad":"` + strings.Repeat("x", 300) + `"}`)
+	app.send(map[string]interface{}{"type": "subscribe", "wsid": "s1", "msgtypes": []string{"devicestate"}})
+	if reply := app.receive(); reply["wsid"] != "s1" {
+		t.Errorf("oversized frame not dropped, got %v", reply)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Directions of the byte and message counters, seen from the server.
+const (
+	DirectionIn  = "in"  // received from WebSocket clients
+	DirectionOut = "out" // sent to WebSocket clients
+)
+
+// Metrics counts what the server and its endpoints do, for the Prometheus
+// /metrics endpoint. A nil *Metrics counts nothing. It is safe for
+// concurrent use.
+type Metrics struct {
+	sessions       int64 // accessed atomically
+	forkRejections uint64
+	launchFailures uint64
+	bytesIn        uint64
+	bytesOut       uint64
+	messagesIn     uint64
+	messagesOut    uint64
+
+	mutex      sync.Mutex
+	exitCodes  map[string]uint64 // by exit code, or signal name
+	violations map[string]uint64 // frames exceeding connection limits, by kind
+	routed     map[string]uint64 // smarthome messages passed on, by type
+	dropped    map[string]uint64 // smarthome messages not passed on, by type
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		exitCodes:  make(map[string]uint64),
+		violations: make(map[string]uint64),
+		routed:     make(map[string]uint64),
+		dropped:    make(map[string]uint64),
+	}
+}
+
+// SessionStarted and SessionEnded track the active WebSocket sessions.
+func (m *Metrics) SessionStarted() {
+	if m != nil {
+		atomic.AddInt64(&m.sessions, 1)
+	}
+}
+
+func (m *Metrics) SessionEnded() {
+	if m != nil {
+		atomic.AddInt64(&m.sessions, -1)
+	}
+}
+
+// ForkRejected counts a request rejected with 429 because --maxforks was
+// reached.
+func (m *Metrics) ForkRejected() {
+	if m != nil {
+		atomic.AddUint64(&m.forkRejections, 1)
+	}
+}
+
+// LaunchFailed counts a process that could not be started.
+func (m *Metrics) LaunchFailed() {
+	if m != nil {
+		atomic.AddUint64(&m.launchFailures, 1)
+	}
+}
+
+// ProcessExited counts a process that ended with code, an exit status or the
+// name of the signal that killed it.
+func (m *Metrics) ProcessExited(code string) {
+	if m != nil {
+		m.mutex.Lock()
+		m.exitCodes[code]++
+		m.mutex.Unlock()
+	}
+}
+
+// Message counts a WebSocket message of size bytes in direction.
+func (m *Metrics) Message(direction string, size int) {
+	if m == nil {
+		return
+	}
+	if direction == DirectionIn {
+		atomic.AddUint64(&m.messagesIn, 1)
+		atomic.AddUint64(&m.bytesIn, uint64(size))
+	} else {
+		atomic.AddUint64(&m.messagesOut, 1)
+		atomic.AddUint64(&m.bytesOut, uint64(size))
+	}
+}
+
+// LimitViolation counts a frame exceeding the rate or size limits of its
+// connection, LimitRate or LimitSize.
+func (m *Metrics) LimitViolation(kind string) {
+	if m != nil {
+		m.mutex.Lock()
+		m.violations[kind]++
+		m.mutex.Unlock()
+	}
+}
+
+// Routed counts a smarthome message of msgtype the broker passed on to
+// another client.
+func (m *Metrics) Routed(msgtype string) {
+	if m != nil {
+		m.mutex.Lock()
+		m.routed[msgtype]++
+		m.mutex.Unlock()
+	}
+}
+
+// Dropped counts a smarthome message of msgtype the broker did not pass on.
+func (m *Metrics) Dropped(msgtype string) {
+	if m != nil {
+		m.mutex.Lock()
+		m.dropped[msgtype]++
+		m.mutex.Unlock()
+	}
+}
+
+// metricsWriter formats metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (w *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *metricsWriter) value(name string, value interface{}) {
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+// labeled writes one sample per key of values with the key as label.
+func (w *metricsWriter) labeled(name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(key), values[key])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for key, n := range counts {
+		copied[key] = n
+	}
+	return copied
+}
+
+// ServeMetrics responds with the server's metrics in the Prometheus text
+// format.
+func (h *WebsocketdServer) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	m := h.Metrics
+	if m == nil {
+		m = NewMetrics()
+	}
+	m.mutex.Lock()
+	exitCodes, violations := copyCounts(m.exitCodes), copyCounts(m.violations)
+	routed, dropped := copyCounts(m.routed), copyCounts(m.dropped)
+	m.mutex.Unlock()
+
+	out := &metricsWriter{}
+	out.header("websocketd_sessions_active", "gauge", "WebSocket sessions currently open.")
+	out.value("websocketd_sessions_active", atomic.LoadInt64(&m.sessions))
+	out.header("websocketd_forks_in_use", "gauge", "Processes and protocol sessions counted against --maxforks.")
+	out.value("websocketd_forks_in_use", len(h.forks))
+	out.header("websocketd_forks_max", "gauge", "Value of --maxforks, 0 for no limit.")
+	out.value("websocketd_forks_max", cap(h.forks))
+	out.header("websocketd_fork_rejections_total", "counter", "Requests rejected with 429 because --maxforks was reached.")
+	out.value("websocketd_fork_rejections_total", atomic.LoadUint64(&m.forkRejections))
+	out.header("websocketd_bytes_total", "counter", "WebSocket message payload bytes by direction.")
+	out.labeled("websocketd_bytes_total", "direction", map[string]uint64{
+		DirectionIn:  atomic.LoadUint64(&m.bytesIn),
+		DirectionOut: atomic.LoadUint64(&m.bytesOut),
+	})
+	out.header("websocketd_messages_total", "counter", "WebSocket messages by direction.")
+	out.labeled("websocketd_messages_total", "direction", map[string]uint64{
+		DirectionIn:  atomic.LoadUint64(&m.messagesIn),
+		DirectionOut: atomic.LoadUint64(&m.messagesOut),
+	})
+	out.header("websocketd_limit_violations_total", "counter", "Frames exceeding the rate or size limits of their connection, by kind.")
+	out.labeled("websocketd_limit_violations_total", "kind", violations)
+	out.header("websocketd_process_launch_failures_total", "counter", "Processes that could not be started.")
+	out.value("websocketd_process_launch_failures_total", atomic.LoadUint64(&m.launchFailures))
+	out.header("websocketd_process_exits_total", "counter", "Processes ended, by exit code or signal.")
+	out.labeled("websocketd_process_exits_total", "code", exitCodes)
+
+	if h.Config.Smarthome {
+		online := make(map[string]uint64)
+		for _, entry := range h.Devices.ByType("") {
+			online[entry.CType]++
+		}
+		out.header("websocketd_smarthome_devices_online", "gauge", "Smarthome clients connected, by c_type.")
+		out.labeled("websocketd_smarthome_devices_online", "c_type", online)
+		out.header("websocketd_smarthome_messages_routed_total", "counter", "Smarthome messages passed on to another client, by type.")
+		out.labeled("websocketd_smarthome_messages_routed_total", "type", routed)
+		out.header("websocketd_smarthome_messages_dropped_total", "counter", "Smarthome messages not passed on, by type.")
+		out.labeled("websocketd_smarthome_messages_dropped_total", "type", dropped)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
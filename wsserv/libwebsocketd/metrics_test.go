@@ -0,0 +1,69 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLaunchedProcessExitCode(t *testing.T) {
+	launched, err := launchCmd("/bin/sh", []string{"-c", "exit 3"}, nil)
+	if err != nil {
+		t.Skip("no /bin/sh:", err)
+	}
+	launched.cmd.Wait()
+	if code := launched.exitCode(); code != "3" {
+		t.Errorf("exit code %q", code)
+	}
+}
+
+func TestSmarthomeMetrics(t *testing.T) {
+	b := newTestBroker(t, &Config{Metrics: true})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app.send(map[string]interface{}{"type": "rest", "wsid": "r1", "sn": "router-1", "data": map[string]string{"cmd": "reboot"}})
+	router.receiveType("rest")
+	router.send(map[string]interface{}{"type": "router", "wsid": "r1", "from": "app-1", "data": map[string]string{"status": "ok"}})
+	app.receiveType("rest")
+	router.send(map[string]interface{}{"type": "router", "wsid": "r1", "from": "app-1", "data": map[string]string{"status": "ok"}})
+	b.waitFor("unsolicited reply", func() bool {
+		b.server.Metrics.mutex.Lock()
+		defer b.server.Metrics.mutex.Unlock()
+		return b.server.Metrics.dropped["router"] == 1
+	})
+	app.send(map[string]interface{}{"type": "rest", "wsid": "r2", "sn": "tv-1", "data": map[string]string{"cmd": "on"}})
+	expectError(t, app.receive(), "target_offline", "r2")
+
+	resp, err := http.Get(b.http.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	metrics := string(data)
+	for _, want := range []string{
+		"# TYPE websocketd_sessions_active gauge\nwebsocketd_sessions_active 2\n",
+		"websocketd_forks_max 0\n",
+		`websocketd_messages_total{direction="in"} 8` + "\n",
+		`websocketd_smarthome_devices_online{c_type="rest"} 1` + "\n",
+		`websocketd_smarthome_devices_online{c_type="router"} 1` + "\n",
+		`websocketd_smarthome_messages_routed_total{type="rest"} 1` + "\n",
+		`websocketd_smarthome_messages_routed_total{type="router"} 1` + "\n",
+		`websocketd_smarthome_messages_dropped_total{type="rest"} 1` + "\n",
+		`websocketd_smarthome_messages_dropped_total{type="router"} 1` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("missing %q in\n%s", want, metrics)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK return codes.
+const (
+	mqttAccepted           = 0
+	mqttBadProtocolVersion = 1
+	mqttIdentifierRejected = 2
+	mqttBadCredentials     = 4
+	mqttNotAuthorized      = 5
+)
+
+// mqttMaxPacket limits the remaining length of packets read from clients.
+const mqttMaxPacket = 1 << 20
+
+var MQTTMalformedError = errors.New("malformed MQTT packet")
+
+// mqttPacket is an MQTT control packet: the type and flags of the fixed
+// header and the variable header and payload as body.
+type mqttPacket struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// readMQTTPacket reads the next packet from r.
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, MQTTMalformedError
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacket {
+		return nil, fmt.Errorf("MQTT packet of %d bytes exceeds limit of %d bytes", length, mqttMaxPacket)
+	}
+	p := &mqttPacket{Type: first >> 4, Flags: first & 0x0f, Body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Bytes encodes p with its fixed header.
+func (p *mqttPacket) Bytes() []byte {
+	out := []byte{p.Type<<4 | p.Flags}
+	length := len(p.Body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(out, p.Body...)
+}
+
+// mqttReader decodes the fields of a packet body.
+type mqttReader struct {
+	data []byte
+	err  error
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if r.err != nil || len(r.data) < 2 {
+		r.err = MQTTMalformedError
+		return 0
+	}
+	n := binary.BigEndian.Uint16(r.data)
+	r.data = r.data[2:]
+	return n
+}
+
+func (r *mqttReader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = MQTTMalformedError
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+// bytes reads a length prefixed field.
+func (r *mqttReader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.data) < n {
+		r.err = MQTTMalformedError
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func appendMQTTString(out []byte, s string) []byte {
+	out = append(out, byte(len(s)>>8), byte(len(s)))
+	return append(out, s...)
+}
+
+func appendMQTTUint16(out []byte, n uint16) []byte {
+	return append(out, byte(n>>8), byte(n))
+}
+
+// mqttConnectPacket holds the fields of CONNECT the bridge uses.
+type mqttConnectPacket struct {
+	Level        byte
+	CleanSession bool
+	KeepAlive    uint16 // seconds, 0 for none
+	ClientId     string
+	Username     string
+	Password     []byte // nil if not given
+}
+
+func parseMQTTConnect(p *mqttPacket) (*mqttConnectPacket, error) {
+	r := &mqttReader{data: p.Body}
+	if name := r.string(); r.err == nil && name != "MQTT" {
+		return nil, fmt.Errorf("unsupported protocol %q", name)
+	}
+	c := &mqttConnectPacket{Level: r.byte()}
+	flags := r.byte()
+	c.KeepAlive = r.uint16()
+	if r.err != nil || flags&0x01 != 0 {
+		return nil, MQTTMalformedError
+	}
+	if c.Level != 4 {
+		return c, nil
+	}
+	c.CleanSession = flags&0x02 != 0
+	c.ClientId = r.string()
+	if flags&0x04 != 0 {
+		r.string() // will topic and message are not supported and ignored
+		r.bytes()
+	}
+	if flags&0x80 != 0 {
+		c.Username = r.string()
+	}
+	if flags&0x40 != 0 {
+		c.Password = r.bytes()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+// mqttPublishPacket is a PUBLISH packet.
+type mqttPublishPacket struct {
+	Topic    string
+	Qos      byte
+	Retain   bool
+	PacketId uint16 // only if Qos > 0
+	Payload  []byte
+}
+
+func parseMQTTPublish(p *mqttPacket) (*mqttPublishPacket, error) {
+	r := &mqttReader{data: p.Body}
+	m := &mqttPublishPacket{Topic: r.string(), Qos: p.Flags >> 1 & 3, Retain: p.Flags&1 != 0}
+	if m.Qos > 0 {
+		m.PacketId = r.uint16()
+	}
+	if r.err != nil || m.Qos == 3 || !validMQTTTopic(m.Topic) {
+		return nil, MQTTMalformedError
+	}
+	m.Payload = r.data
+	return m, nil
+}
+
+// Packet encodes m. The packet id is only encoded for Qos > 0.
+func (m *mqttPublishPacket) Packet() *mqttPacket {
+	body := appendMQTTString(nil, m.Topic)
+	if m.Qos > 0 {
+		body = appendMQTTUint16(body, m.PacketId)
+	}
+	flags := m.Qos << 1
+	if m.Retain {
+		flags |= 1
+	}
+	return &mqttPacket{Type: mqttPublish, Flags: flags, Body: append(body, m.Payload...)}
+}
+
+// parseMQTTSubscribe returns the packet id and topic filters of SUBSCRIBE
+// or UNSUBSCRIBE. The requested QoS of SUBSCRIBE is skipped, the bridge
+// grants QoS 0 only.
+func parseMQTTSubscribe(p *mqttPacket) (uint16, []string, error) {
+	if p.Flags != 2 {
+		return 0, nil, MQTTMalformedError
+	}
+	r := &mqttReader{data: p.Body}
+	id := r.uint16()
+	filters := []string{}
+	for r.err == nil && len(r.data) > 0 {
+		filters = append(filters, r.string())
+		if p.Type == mqttSubscribe {
+			r.byte()
+		}
+	}
+	if r.err != nil || len(filters) == 0 {
+		return 0, nil, MQTTMalformedError
+	}
+	return id, filters, nil
+}
+
+// validMQTTTopic reports whether topic may be published to.
+func validMQTTTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// validMQTTFilter reports whether filter may be subscribed to: "+" matches
+// one level of the topic, "#" as the last level matches all remaining ones.
+func validMQTTFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && level != "+" && level != "#" {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// mqttTopicMatches reports whether topic matches the valid filter. Topics
+// starting with "$" are not matched by wildcards in the first level.
+func mqttTopicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filters, topics := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range filters {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topics) || (level != "+" && level != topics[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
@@ -0,0 +1,95 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestMQTTPacketLength(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, 300000} {
+		p := &mqttPacket{Type: mqttPublish, Flags: 1, Body: bytes.Repeat([]byte{'x'}, size)}
+		got, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(p.Bytes())))
+		if err != nil {
+			t.Errorf("%d bytes: %s", size, err)
+			continue
+		}
+		if got.Type != p.Type || got.Flags != p.Flags || len(got.Body) != size {
+			t.Errorf("%d bytes: read %d %d %d", size, got.Type, got.Flags, len(got.Body))
+		}
+	}
+	tooLong := []byte{mqttPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	if _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(tooLong))); err != MQTTMalformedError {
+		t.Errorf("five bytes length: %v", err)
+	}
+	huge := (&mqttPacket{Type: mqttPublish}).Bytes()[:1]
+	huge = append(huge, 0x80, 0x80, 0x80, 0x01)
+	if _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(huge))); err == nil {
+		t.Error("packet over limit accepted")
+	}
+}
+
+func TestMQTTParsePackets(t *testing.T) {
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, 0x82, 0, 30)
+	body = appendMQTTString(body, "client-1")
+	body = appendMQTTString(body, "alice")
+	connect, err := parseMQTTConnect(&mqttPacket{Type: mqttConnect, Body: body})
+	if err != nil || connect.Level != 4 || !connect.CleanSession || connect.KeepAlive != 30 ||
+		connect.ClientId != "client-1" || connect.Username != "alice" {
+		t.Errorf("connect %+v %v", connect, err)
+	}
+	if _, err := parseMQTTConnect(&mqttPacket{Type: mqttConnect, Body: body[:12]}); err == nil {
+		t.Error("truncated connect accepted")
+	}
+
+	publish := &mqttPublishPacket{Topic: "devices/tv-1/command", Qos: 1, PacketId: 7, Payload: []byte("{}")}
+	got, err := parseMQTTPublish(publish.Packet())
+	if err != nil || got.Topic != publish.Topic || got.Qos != 1 || got.PacketId != 7 || string(got.Payload) != "{}" {
+		t.Errorf("publish %+v %v", got, err)
+	}
+	if _, err := parseMQTTPublish((&mqttPublishPacket{Topic: "devices/+/command"}).Packet()); err == nil {
+		t.Error("publish to wildcard topic accepted")
+	}
+
+	body = appendMQTTUint16(nil, 3)
+	body = append(appendMQTTString(body, "devices/#"), 1)
+	body = append(appendMQTTString(body, "devices/+/online"), 0)
+	id, filters, err := parseMQTTSubscribe(&mqttPacket{Type: mqttSubscribe, Flags: 2, Body: body})
+	if err != nil || id != 3 || len(filters) != 2 || filters[1] != "devices/+/online" {
+		t.Errorf("subscribe %d %v %v", id, filters, err)
+	}
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"devices/tv-1/online", "devices/tv-1/online", true},
+		{"devices/+/online", "devices/tv-1/online", true},
+		{"devices/+/online", "devices/tv-1/notification/channel", false},
+		{"devices/#", "devices/tv-1/notification/channel", true},
+		{"devices/tv-1/#", "devices/tv-1", true},
+		{"#", "devices/tv-1/online", true},
+		{"+/+", "devices/tv-1/online", false},
+		{"devices/+", "devices", false},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, c := range cases {
+		if got := mqttTopicMatches(c.filter, c.topic); got != c.match {
+			t.Errorf("%s matches %s: %t", c.filter, c.topic, got)
+		}
+	}
+	for filter, valid := range map[string]bool{"devices/#": true, "+": true, "devices/#/online": false, "devices/tv+": false, "": false} {
+		if validMQTTFilter(filter) != valid {
+			t.Errorf("filter %q valid: %t", filter, !valid)
+		}
+	}
+}
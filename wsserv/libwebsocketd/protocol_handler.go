@@ -0,0 +1,247 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// ProtocolHandler speaks a message protocol on WebSocket connections itself,
+// instead of passing them to a process. One handler serves every connection
+// of the URL paths it is selected for, so it must be safe for concurrent use
+// and keep per connection state in Session.State.
+type ProtocolHandler interface {
+	// OnConnect is called once the WebSocket handshake is done. Returning an
+	// error closes the connection without calling OnDisconnect.
+	OnConnect(s *Session) error
+	// OnMessage is called for every text message the client sends, in order.
+	// Returning an error closes the connection.
+	OnMessage(s *Session, msg string) error
+	// OnDisconnect is called when the connection is gone.
+	OnDisconnect(s *Session)
+}
+
+// BinaryHandler is implemented by protocol handlers that accept binary
+// frames. Clients of other handlers are disconnected when they send one.
+type BinaryHandler interface {
+	// OnBinary is called for every binary frame the client sends, in order
+	// with the text messages. Returning an error closes the connection.
+	OnBinary(s *Session, data []byte) error
+}
+
+// SubprotocolHandler is implemented by protocol handlers that negotiate a
+// WebSocket subprotocol with the Sec-WebSocket-Protocol header.
+type SubprotocolHandler interface {
+	// Subprotocols returns the subprotocols the handler speaks, preferred
+	// first. If the client offers none of them, no subprotocol is selected.
+	Subprotocols() []string
+}
+
+// selectSubprotocol returns the first of supported the client offered, as
+// the value of websocket.Config.Protocol for the handshake.
+func selectSubprotocol(supported, offered []string) []string {
+	for _, name := range supported {
+		for _, offer := range offered {
+			if offer == name {
+				return []string{name}
+			}
+		}
+	}
+	return nil
+}
+
+// Session is a client connection served by a ProtocolHandler.
+type Session struct {
+	Server *WebsocketdServer // Registry of connected clients and the other broker state
+
+	Id string
+	*RemoteInfo
+	*URLInfo
+
+	Endpoint    *SmarthomeWebSocketEndpoint
+	Subprotocol string // Selected in the handshake, "" if none
+	Log         *LogScope
+	State       interface{} // For use by the ProtocolHandler
+}
+
+// Send sends msg to the client in a text frame. It returns false if the
+// client is gone.
+func (s *Session) Send(msg string) bool {
+	return s.Endpoint.Send(msg)
+}
+
+// SendBinary sends data to the client in a binary frame. It returns false if
+// the client is gone.
+func (s *Session) SendBinary(data []byte) bool {
+	return s.Endpoint.SendBinary(data)
+}
+
+// SendMessage sends msg encoded as JSON to the client. It returns false if
+// the client is gone.
+func (s *Session) SendMessage(msg interface{}) bool {
+	return s.Endpoint.SendMessage(msg)
+}
+
+var (
+	protocolsMutex sync.RWMutex
+	protocols      = make(map[string]ProtocolHandler)
+)
+
+// RegisterProtocol makes handler available by name, for use in --protocols.
+// It panics if name is registered already.
+func RegisterProtocol(name string, handler ProtocolHandler) {
+	protocolsMutex.Lock()
+	defer protocolsMutex.Unlock()
+	if handler == nil {
+		panic("RegisterProtocol: handler is nil")
+	}
+	if _, dup := protocols[name]; dup {
+		panic("RegisterProtocol: protocol " + name + " registered twice")
+	}
+	protocols[name] = handler
+}
+
+// LookupProtocol returns the handler registered as name, or nil.
+func LookupProtocol(name string) ProtocolHandler {
+	protocolsMutex.RLock()
+	defer protocolsMutex.RUnlock()
+	return protocols[name]
+}
+
+// ProtocolNames returns the names of the registered protocols, sorted.
+func ProtocolNames() []string {
+	protocolsMutex.RLock()
+	defer protocolsMutex.RUnlock()
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// protocolRoute selects the protocol served below a URL path.
+type protocolRoute struct {
+	Prefix string
+	Name   string
+}
+
+// ParseProtocolRoute splits a "PATH=NAME" entry of Config.Protocols and
+// checks that NAME is registered.
+func ParseProtocolRoute(s string) (prefix, name string, err error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return "", "", fmt.Errorf("%q is not PATH=NAME", s)
+	}
+	prefix, name = s[:i], s[i+1:]
+	if !strings.HasPrefix(prefix, "/") {
+		return "", "", fmt.Errorf("path %q does not start with /", prefix)
+	}
+	if LookupProtocol(name) == nil {
+		return "", "", fmt.Errorf("unknown protocol %q, expected one of %s", name, strings.Join(ProtocolNames(), ", "))
+	}
+	return prefix, name, nil
+}
+
+// protocolRoutes builds the routes of config, longest path first. With
+// Smarthome the broker serves every path no other protocol is configured for.
+func protocolRoutes(config *Config) []protocolRoute {
+	var routes []protocolRoute
+	for _, entry := range config.Protocols {
+		prefix, name, err := ParseProtocolRoute(entry)
+		if err != nil {
+			continue // checked when the flags were parsed
+		}
+		routes = append(routes, protocolRoute{prefix, name})
+	}
+	if config.Smarthome {
+		routes = append(routes, protocolRoute{"/", "smarthome"})
+	}
+	sort.Stable(byPrefixLength(routes))
+	return routes
+}
+
+type byPrefixLength []protocolRoute
+
+func (r byPrefixLength) Len() int           { return len(r) }
+func (r byPrefixLength) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byPrefixLength) Less(i, j int) bool { return len(r[i].Prefix) > len(r[j].Prefix) }
+
+// protocolFor returns the handler serving WebSocket connections to path, or
+// nil if connections to path go to the command. A path prefix matches whole
+// path segments only: "/chat" matches "/chat" and "/chat/room" but not
+// "/chatter".
+func (h *WebsocketdServer) protocolFor(path string) ProtocolHandler {
+	for _, route := range h.protocols {
+		dir := strings.TrimSuffix(route.Prefix, "/") + "/"
+		if path == route.Prefix || strings.HasPrefix(path, dir) {
+			return LookupProtocol(route.Name)
+		}
+	}
+	return nil
+}
+
+// acceptProtocol serves ws with the protocol handler of this connection until
+// either side closes it.
+func (wsh *WebsocketdHandler) acceptProtocol(ws *websocket.Conn, log *LogScope) {
+	endpoint := NewSmarthomeWebSocketEndpoint(ws, log)
+	endpoint.metrics = wsh.server.Metrics
+	endpoint.limits = NewConnLimiter(wsh.server.Config, wsh.server.Metrics, log)
+	if wsh.server.Config.PingInterval > 0 {
+		endpoint.StartKeepalive(wsh.server.Config.PingInterval, wsh.server.Config.PingMisses)
+	}
+	endpoint.StartReading()
+	defer endpoint.Terminate()
+
+	session := &Session{
+		Server:     wsh.server,
+		Id:         wsh.Id,
+		RemoteInfo: wsh.RemoteInfo,
+		URLInfo:    wsh.URLInfo,
+		Endpoint:   endpoint,
+		Log:        log,
+	}
+	if protocols := ws.Config().Protocol; len(protocols) == 1 {
+		session.Subprotocol = protocols[0]
+		log.Associate("subprotocol", session.Subprotocol)
+	}
+	if err := wsh.protocol.OnConnect(session); err != nil {
+		log.Access("session", "REJECTED: %s", err)
+		return
+	}
+	defer wsh.protocol.OnDisconnect(session)
+
+	binaryHandler, _ := wsh.protocol.(BinaryHandler)
+	for {
+		var err error
+		select {
+		case msg, ok := <-endpoint.Output():
+			if !ok {
+				return
+			}
+			err = wsh.protocol.OnMessage(session, msg)
+		case data, ok := <-endpoint.Binary():
+			if !ok {
+				return
+			}
+			if binaryHandler == nil {
+				log.Access("session", "CLOSING: binary frames are not supported")
+				endpoint.Close(CloseUnsupportedData, "binary frames are not supported")
+				return
+			}
+			err = binaryHandler.OnBinary(session, data)
+		}
+		if err != nil {
+			log.Access("session", "CLOSING: %s", err)
+			return
+		}
+	}
+}
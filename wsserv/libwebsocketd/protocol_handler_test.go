@@ -0,0 +1,143 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// echoProtocol answers every message with the message and the path the
+// client connected to, and hangs up on "bye".
+type echoProtocol struct {
+	disconnected chan string
+}
+
+func (p echoProtocol) OnConnect(s *Session) error {
+	if s.PathInfo == "/echo/closed" {
+		return errors.New("closed")
+	}
+	s.State = s.PathInfo
+	return nil
+}
+
+func (p echoProtocol) OnMessage(s *Session, msg string) error {
+	if msg == "bye" {
+		return errors.New("client said bye")
+	}
+	s.Send(s.State.(string) + " " + msg)
+	return nil
+}
+
+func (p echoProtocol) OnDisconnect(s *Session) {
+	p.disconnected <- s.State.(string)
+}
+
+var testEcho = echoProtocol{disconnected: make(chan string, 10)}
+
+func init() {
+	RegisterProtocol("test-echo", testEcho)
+}
+
+func TestParseProtocolRoute(t *testing.T) {
+	prefix, name, err := ParseProtocolRoute("/a=b=test-echo")
+	if err != nil || prefix != "/a=b" || name != "test-echo" {
+		t.Errorf("got %q, %q, %v", prefix, name, err)
+	}
+	for _, entry := range []string{"test-echo", "echo=test-echo", "/echo=nosuch"} {
+		if _, _, err := ParseProtocolRoute(entry); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
+
+func TestProtocolFor(t *testing.T) {
+	server := NewWebsocketdServer(&Config{Protocols: []string{"/echo=test-echo", "/echo/sh=smarthome"}}, testLogScope(), 0)
+	for path, want := range map[string]ProtocolHandler{
+		"/":           nil,
+		"/echo":       testEcho,
+		"/echo/":      testEcho,
+		"/echo/room":  testEcho,
+		"/echoes":     nil,
+		"/echo/sh":    SmarthomeBroker{},
+		"/echo/sh/x":  SmarthomeBroker{},
+		"/echo/shell": testEcho,
+	} {
+		if got := server.protocolFor(path); got != want {
+			t.Errorf("protocolFor(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	server = NewWebsocketdServer(&Config{Smarthome: true, Protocols: []string{"/echo=test-echo"}}, testLogScope(), 0)
+	if got := server.protocolFor("/devices"); got != (SmarthomeBroker{}) {
+		t.Errorf("smarthome does not serve other paths, got %v", got)
+	}
+}
+
+func TestSelectSubprotocol(t *testing.T) {
+	supported := []string{"v2", "v1"}
+	for _, test := range []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"v1", "v2"}, "v2"},
+		{[]string{"v1", "v0"}, "v1"},
+		{[]string{"v0"}, ""},
+		{nil, ""},
+	} {
+		got := selectSubprotocol(supported, test.offered)
+		if test.want == "" && got != nil || test.want != "" && (len(got) != 1 || got[0] != test.want) {
+			t.Errorf("offered %v, selected %v, want %q", test.offered, got, test.want)
+		}
+	}
+}
+
+func TestProtocolHandlerSession(t *testing.T) {
+	b := newTestBroker(t, &Config{Protocols: []string{"/echo=test-echo"}})
+	defer b.Close()
+	url := "ws" + strings.TrimPrefix(b.http.URL, "http")
+
+	ws, err := websocket.Dial(url+"/echo/room", "", b.http.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, ws: ws}
+	c.sendRaw("hello")
+	var reply string
+	if err := websocket.Message.Receive(ws, &reply); err != nil || reply != "/echo/room hello" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	c.sendRaw("bye")
+	c.expectClosed()
+	if path := <-testEcho.disconnected; path != "/echo/room" {
+		t.Errorf("disconnected %q", path)
+	}
+
+	// echoProtocol does not implement BinaryHandler
+	ws, err = websocket.Dial(url+"/echo/room", "", b.http.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &testClient{t: t, ws: ws}
+	websocket.Message.Send(ws, []byte{1, 2, 3})
+	c.expectClosed()
+	if path := <-testEcho.disconnected; path != "/echo/room" {
+		t.Errorf("disconnected %q", path)
+	}
+
+	ws, err = websocket.Dial(url+"/echo/closed", "", b.http.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&testClient{t: t, ws: ws}).expectClosed()
+
+	// the broker still serves the other paths
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	app.Close()
+}
@@ -0,0 +1,137 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// Authorizer decides which devices a client identity may control and watch.
+// The identity is the sn the client connected as, or APISn for the HTTP API.
+// Implementations must be safe for concurrent use.
+type Authorizer interface {
+	// CanCommand reports whether identity may send rest commands to sn.
+	CanCommand(identity, sn string) bool
+	// CanObserve reports whether identity may receive notifications and state
+	// of sn.
+	CanObserve(identity, sn string) bool
+}
+
+// ACL is an Authorizer backed by an access list file. It is read-only once
+// loaded, so it is safe for concurrent use.
+type ACL struct {
+	command map[string]map[string]bool // identity -> sns, "*" for all
+	observe map[string]map[string]bool
+}
+
+// LoadACL reads access list from file.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL reads an access list. Every non-empty line that is not a # comment
+// holds whitespace separated identity, permission and one or more sns, or "*"
+// for all devices. Permission "command" allows to send commands to and to
+// observe the sns, "observe" allows only the latter. Identities may appear on
+// several lines. Identities not listed are denied everything.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{
+		command: make(map[string]map[string]bool),
+		observe: make(map[string]map[string]bool),
+	}
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected identity, permission and sns", lineno)
+		}
+		identity, permission, sns := fields[0], fields[1], fields[2:]
+		for _, sn := range sns {
+			if ReservedSn(sn) {
+				return nil, fmt.Errorf("line %d: sn %s is reserved for the broker", lineno, sn)
+			}
+		}
+		switch permission {
+		case "command":
+			grant(acl.command, identity, sns)
+			grant(acl.observe, identity, sns)
+		case "observe":
+			grant(acl.observe, identity, sns)
+		default:
+			return nil, fmt.Errorf("line %d: unknown permission %q, expected command or observe", lineno, permission)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func grant(permissions map[string]map[string]bool, identity string, sns []string) {
+	allowed := permissions[identity]
+	if allowed == nil {
+		allowed = make(map[string]bool)
+		permissions[identity] = allowed
+	}
+	for _, sn := range sns {
+		allowed[sn] = true
+	}
+}
+
+func (acl *ACL) CanCommand(identity, sn string) bool {
+	allowed := acl.command[identity]
+	return allowed["*"] || allowed[sn]
+}
+
+func (acl *ACL) CanObserve(identity, sn string) bool {
+	allowed := acl.observe[identity]
+	return allowed["*"] || allowed[sn]
+}
+
+// Len returns number of identities in the access list.
+func (acl *ACL) Len() int {
+	return len(acl.observe)
+}
+
+// canCommand reports whether identity may send commands to sn. Without an
+// Authorizer everything is allowed.
+func (h *WebsocketdServer) canCommand(identity, sn string) bool {
+	return h.Authorizer == nil || h.Authorizer.CanCommand(identity, sn)
+}
+
+// canObserve reports whether identity may receive notifications and state of
+// sn. Without an Authorizer everything is allowed.
+func (h *WebsocketdServer) canObserve(identity, sn string) bool {
+	return h.Authorizer == nil || h.Authorizer.CanObserve(identity, sn)
+}
+
+// observable returns those of notifications identity may observe.
+func (h *WebsocketdServer) observable(identity string, notifications []*smarthome.NotificationMessage) []*smarthome.NotificationMessage {
+	result := []*smarthome.NotificationMessage{}
+	for _, m := range notifications {
+		if h.canObserve(identity, m.From) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
@@ -0,0 +1,100 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testACL = `
+# app-1 owns the router and may watch the tv
+app-1  command  router-1
+app-1  observe  tv-1
+app-2  observe  *
+api    command  *
+`
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		identity, sn     string
+		command, observe bool
+	}{
+		{"app-1", "router-1", true, true},
+		{"app-1", "tv-1", false, true},
+		{"app-1", "cond-1", false, false},
+		{"app-2", "router-1", false, true},
+		{"api", "anything", true, true},
+		{"stranger", "router-1", false, false},
+	}
+	for _, test := range tests {
+		if got := acl.CanCommand(test.identity, test.sn); got != test.command {
+			t.Errorf("CanCommand(%s, %s) = %v", test.identity, test.sn, got)
+		}
+		if got := acl.CanObserve(test.identity, test.sn); got != test.observe {
+			t.Errorf("CanObserve(%s, %s) = %v", test.identity, test.sn, got)
+		}
+	}
+	if acl.Len() != 3 {
+		t.Errorf("expected 3 identities, got %d", acl.Len())
+	}
+
+	for _, bad := range []string{"app-1 command", "app-1 admin router-1", "app-1 command router-1 api", "app-1 observe mqtt"} {
+		if _, err := ParseACL(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSmarthomeACL(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	acl, _ := ParseACL(strings.NewReader("app-1 command router-1\napi observe router-1\n"))
+	b.server.Authorizer = acl
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	defer tv.Close()
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "tv-1", "data": map[string]string{"msgtype": "channel"}})
+	b.waitFor("tv state", func() bool { return len(b.server.States.Device("tv-1")) == 2 })
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	for _, n := range app.snapshot["notifications"].([]interface{}) {
+		if n.(map[string]interface{})["from"] != "router-1" {
+			t.Errorf("snapshot leaks %v", n)
+		}
+	}
+
+	app.send(map[string]interface{}{"type": "subscribe", "wsid": "s1", "sns": []string{"tv-1"}})
+	expectError(t, app.receive(), "forbidden", "s1")
+	app.subscribe(map[string]interface{}{"wsid": "s2"})
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "tv-1", "data": map[string]string{}})
+	expectError(t, app.receive(), "forbidden", "w1")
+
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n2", "from": "tv-1", "data": map[string]string{"msgtype": "channel"}})
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n3", "from": "router-1", "data": map[string]string{"msgtype": "wifi"}})
+	if msg := app.receiveType("notification"); msg["from"] != "router-1" {
+		t.Errorf("received notification of unobservable device %v", msg)
+	}
+
+	if status, reply := b.request("POST", "/api/devices/router-1/commands", `{"data":{}}`); status != http.StatusForbidden {
+		t.Errorf("expected 403 for API command, got %d %v", status, reply)
+	}
+	if status, reply := b.request("GET", "/api/devices/tv-1/state", ""); status != http.StatusForbidden {
+		t.Errorf("expected 403 for API state, got %d %v", status, reply)
+	}
+	if status, reply := b.request("GET", "/api/devices/router-1/state", ""); status != http.StatusOK {
+		t.Errorf("expected 200 for API state, got %d %v", status, reply)
+	}
+}
@@ -0,0 +1,685 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// APISn is the sn the HTTP API uses as "from" when it sends commands to
+// devices. Devices answer it like any rest client.
+const APISn = "api"
+
+// maxAPIBody limits the size of HTTP API request bodies.
+const maxAPIBody = 1 << 20
+
+// Error codes only the HTTP API uses, next to those of package smarthome.
+const (
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeInternal         = "internal"
+	codeUnauthorized     = "unauthorized"
+)
+
+// apiWsidSeq keeps generated wsids unique among concurrent API requests.
+var apiWsidSeq uint64
+
+// serveSmarthomeAPI handles the HTTP API of the smarthome broker under /api/.
+// Callers must present the configured token as "Authorization: Bearer TOKEN".
+func (h *WebsocketdServer) serveSmarthomeAPI(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	if !h.apiAuthorized(w, req, log) {
+		return
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "stats":
+		if !allowMethods(w, req, "GET") {
+			return
+		}
+		h.serveStats(w, req, log)
+	case len(parts) == 2 && parts[1] == "devices":
+		if !allowMethods(w, req, "GET") {
+			return
+		}
+		h.serveDeviceList(w, req, log)
+	case len(parts) == 3 && parts[1] == "devices":
+		if !allowMethods(w, req, "GET") {
+			return
+		}
+		h.serveDevice(w, req, parts[2], log)
+	case len(parts) == 4 && parts[1] == "devices" && parts[3] == "state":
+		if !allowMethods(w, req, "GET") {
+			return
+		}
+		h.serveDeviceState(w, req, parts[2], log)
+	case len(parts) == 4 && parts[1] == "devices" && parts[3] == "commands":
+		if !allowMethods(w, req, "POST") {
+			return
+		}
+		h.serveDeviceCommand(w, req, parts[2], log)
+	case len(parts) == 2 && parts[1] == "firmware":
+		if !allowMethods(w, req, "GET") || !h.otaEnabled(w, log) {
+			return
+		}
+		h.serveFirmwareList(w, req, log)
+	case len(parts) == 2 && parts[1] == "rollouts":
+		if !allowMethods(w, req, "GET", "POST") || !h.otaEnabled(w, log) {
+			return
+		}
+		if req.Method == "POST" {
+			h.serveStartRollout(w, req, log)
+		} else {
+			h.serveRolloutList(w, req, log)
+		}
+	case len(parts) == 3 && parts[1] == "rollouts":
+		if !allowMethods(w, req, "GET") || !h.otaEnabled(w, log) {
+			return
+		}
+		h.serveRollout(w, req, parts[2], log)
+	case len(parts) == 2 && parts[1] == "rules":
+		if !allowMethods(w, req, "GET") {
+			return
+		}
+		h.serveRuleList(w, req, log)
+	case len(parts) == 4 && parts[1] == "rules" && (parts[3] == "enable" || parts[3] == "disable"):
+		if !allowMethods(w, req, "POST") {
+			return
+		}
+		h.serveRuleSwitch(w, req, parts[2], parts[3] == "enable", log)
+	case len(parts) == 2 && parts[1] == "schedules":
+		if !allowMethods(w, req, "GET", "POST") || !h.schedulesEnabled(w, log) {
+			return
+		}
+		if req.Method == "POST" {
+			h.serveCreateSchedule(w, req, log)
+		} else {
+			h.serveScheduleList(w, req, log)
+		}
+	case len(parts) == 3 && parts[1] == "schedules":
+		if !allowMethods(w, req, "GET", "DELETE") || !h.schedulesEnabled(w, log) {
+			return
+		}
+		if req.Method == "DELETE" {
+			h.serveDeleteSchedule(w, req, parts[2], log)
+		} else {
+			h.serveSchedule(w, req, parts[2], log)
+		}
+	case len(parts) == 2 && parts[1] == "groups":
+		if !allowMethods(w, req, "GET") || !h.groupsEnabled(w, log) {
+			return
+		}
+		h.serveGroupList(w, req, log)
+	case len(parts) == 3 && parts[1] == "groups":
+		if !allowMethods(w, req, "GET", "PUT", "DELETE") || !h.groupsEnabled(w, log) {
+			return
+		}
+		switch req.Method {
+		case "PUT":
+			h.serveSetGroup(w, req, parts[2], log)
+		case "DELETE":
+			h.serveDeleteGroup(w, req, parts[2], log)
+		default:
+			h.serveGroup(w, req, parts[2], log)
+		}
+	case len(parts) == 4 && parts[1] == "groups" && parts[3] == "commands":
+		if !allowMethods(w, req, "POST") || !h.groupsEnabled(w, log) {
+			return
+		}
+		h.serveGroupCommand(w, req, parts[2], log)
+	default:
+		log.Access("http", "NOT FOUND")
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "no such API"))
+	}
+}
+
+// brokerStats is the response of GET /api/stats.
+type brokerStats struct {
+	Connections     int           `json:"connections"`
+	PendingRequests int           `json:"pending_requests"`
+	Takeovers       TakeoverStats `json:"takeovers"`
+}
+
+// serveStats responds with counters of the smarthome broker.
+func (h *WebsocketdServer) serveStats(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	log.Access("http", "STATS")
+	writeAPIJSON(w, http.StatusOK, &brokerStats{
+		Connections:     h.Devices.Len(),
+		PendingRequests: h.Pending.Len(),
+		Takeovers:       h.Devices.Takeovers(),
+	})
+}
+
+// deviceInfo describes a connected client in GET /api/devices responses.
+type deviceInfo struct {
+	Sn               string    `json:"sn"`
+	CType            string    `json:"c_type"`
+	Subprotocol      string    `json:"subprotocol"`
+	RemoteAddr       string    `json:"remote_addr"`
+	ConnectedAt      time.Time `json:"connected_at"`
+	LastSeen         time.Time `json:"last_seen"`
+	MessagesReceived uint64    `json:"messages_received"`
+	MessagesSent     uint64    `json:"messages_sent"`
+}
+
+func newDeviceInfo(entry *DeviceEntry) *deviceInfo {
+	received, sent := entry.Endpoint.Counters()
+	return &deviceInfo{
+		Sn:               entry.Sn,
+		CType:            entry.CType,
+		Subprotocol:      entry.Endpoint.Subprotocol(),
+		RemoteAddr:       entry.RemoteAddr,
+		ConnectedAt:      entry.ConnectedAt,
+		LastSeen:         entry.LastSeen(),
+		MessagesReceived: received,
+		MessagesSent:     sent,
+	}
+}
+
+type deviceInfos []*deviceInfo
+
+func (d deviceInfos) Len() int           { return len(d) }
+func (d deviceInfos) Less(i, j int) bool { return d[i].Sn < d[j].Sn }
+func (d deviceInfos) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// serveDeviceList lists the connected clients the API may observe, sorted by
+// sn. The c_type query parameter restricts the list to one client type.
+func (h *WebsocketdServer) serveDeviceList(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	entries := h.Devices.ByType(req.URL.Query().Get("c_type"))
+	devices := make(deviceInfos, 0, len(entries))
+	for _, entry := range entries {
+		if h.canObserve(APISn, entry.Sn) {
+			devices = append(devices, newDeviceInfo(entry))
+		}
+	}
+	sort.Sort(devices)
+	log.Access("http", "DEVICES: %d listed", len(devices))
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"count": len(devices), "devices": devices})
+}
+
+// serveDevice describes the client connected as sn.
+func (h *WebsocketdServer) serveDevice(w http.ResponseWriter, req *http.Request, sn string, log *LogScope) {
+	if !h.canObserve(APISn, sn) {
+		log.Access("http", "FORBIDDEN: device %s", sn)
+		writeAPIError(w, http.StatusForbidden, smarthome.NewError(smarthome.CodeForbidden, "", "not allowed to observe sn "+sn))
+		return
+	}
+	entry := h.Devices.Lookup(sn)
+	if entry == nil {
+		log.Access("http", "DEVICE: sn %s is not connected", sn)
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "sn "+sn+" is not connected"))
+		return
+	}
+	log.Access("http", "DEVICE: sn %s", sn)
+	writeAPIJSON(w, http.StatusOK, newDeviceInfo(entry))
+}
+
+// serveDeviceState responds with the latest notifications from sn, in the
+// same form as the snapshot sent to rest clients. It works whether or not
+// sn is connected.
+func (h *WebsocketdServer) serveDeviceState(w http.ResponseWriter, req *http.Request, sn string, log *LogScope) {
+	if !h.canObserve(APISn, sn) {
+		log.Access("http", "FORBIDDEN: state of sn %s", sn)
+		writeAPIError(w, http.StatusForbidden, smarthome.NewError(smarthome.CodeForbidden, "", "not allowed to observe sn "+sn))
+		return
+	}
+	if !h.Credentials.Known(sn) {
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "unknown sn "+sn))
+		return
+	}
+	states := h.States.Device(sn)
+	log.Access("http", "STATE: sn %s, %d msgtypes", sn, len(states))
+	writeAPIJSON(w, http.StatusOK, smarthome.NewSnapshot(states))
+}
+
+// commandRequest is the body of POST /api/devices/{sn}/commands.
+type commandRequest struct {
+	Wsid    string          `json:"wsid"`
+	Data    json.RawMessage `json:"data"`
+	Persist bool            `json:"persist"`
+}
+
+// commandResponse is returned when the device answers the command.
+type commandResponse struct {
+	Type string          `json:"type"`
+	Wsid string          `json:"wsid"`
+	Sn   string          `json:"sn"`
+	Data json.RawMessage `json:"data"`
+}
+
+// serveDeviceCommand sends the posted command to device sn as a rest message
+// and responds with the device's reply.
+func (h *WebsocketdServer) serveDeviceCommand(w http.ResponseWriter, req *http.Request, sn string, log *LogScope) {
+	var body commandRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxAPIBody)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, smarthome.NewError(smarthome.CodeBadMessage, "", "invalid JSON: "+err.Error()))
+		return
+	}
+	if body.Wsid == "" {
+		body.Wsid = newWsid(APISn, &apiWsidSeq)
+	}
+	msg := &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: body.Wsid, Sn: sn, Data: body.Data, Persist: body.Persist}
+	if err := msg.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !h.canCommand(APISn, sn) {
+		log.Access("http", "FORBIDDEN: rest %s to sn %s", msg.Wsid, sn)
+		h.audit(&AuditRecord{From: APISn, To: sn, Wsid: msg.Wsid, Type: msg.Type, Outcome: AuditForbidden}, msg.Data, time.Time{})
+		writeAPIError(w, http.StatusForbidden, smarthome.NewError(smarthome.CodeForbidden, msg.Wsid, "not allowed to command sn "+sn))
+		return
+	}
+	if !h.Credentials.Known(sn) {
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, msg.Wsid, "unknown sn "+sn))
+		return
+	}
+
+	if msg.Persist && h.Devices.Lookup(sn) == nil {
+		if err := h.queueRest(APISn, msg, log); err != nil {
+			writeAPIError(w, errorStatus(err), err)
+			return
+		}
+		writeAPIJSON(w, http.StatusAccepted, smarthome.NewDelivery(msg.Wsid, sn, smarthome.DeliveryQueued))
+		return
+	}
+
+	replies := make(chan *smarthome.ResponseMessage, 1)
+	onReply := func(reply *smarthome.ResponseMessage) {
+		replies <- reply
+	}
+	onTimeout := func() {
+		close(replies)
+	}
+	pending := NewPendingRequest(msg.Wsid, APISn, sn, onReply, onTimeout)
+	if err := h.forwardRest(pending, msg.Data); err != nil {
+		log.Access("http", "COMMAND REJECTED: rest %s to sn %s: %s", msg.Wsid, sn, err)
+		writeAPIError(w, errorStatus(err), err)
+		return
+	}
+
+	reply, ok := <-replies
+	if !ok {
+		log.Access("http", "COMMAND TIMEOUT: sn %s did not answer rest %s", sn, msg.Wsid)
+		writeAPIError(w, http.StatusGatewayTimeout, smarthome.NewError(smarthome.CodeTimeout, msg.Wsid, "sn "+sn+" did not answer"))
+		return
+	}
+	log.Access("http", "COMMAND: rest %s answered by sn %s", msg.Wsid, sn)
+	writeAPIJSON(w, http.StatusOK, &commandResponse{Type: reply.Type, Wsid: reply.Wsid, Sn: sn, Data: reply.Data})
+}
+
+// otaEnabled responds with 404 unless firmware updates are enabled.
+func (h *WebsocketdServer) otaEnabled(w http.ResponseWriter, log *LogScope) bool {
+	if h.OTA == nil {
+		log.Access("http", "NOT FOUND: firmware updates are disabled")
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "firmware updates are disabled"))
+		return false
+	}
+	return true
+}
+
+// serveFirmwareList lists the firmware images.
+func (h *WebsocketdServer) serveFirmwareList(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	images, err := h.OTA.Firmware.List()
+	if err != nil {
+		log.Error("http", "Could not list firmware: %s", err)
+		writeAPIError(w, http.StatusInternalServerError, smarthome.NewError(codeInternal, "", "could not list firmware"))
+		return
+	}
+	log.Access("http", "FIRMWARE: %d images", len(images))
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"count": len(images), "images": images})
+}
+
+// rolloutRequest is the body of POST /api/rollouts.
+type rolloutRequest struct {
+	CType   string `json:"c_type"`
+	Version string `json:"version"`
+	Percent int    `json:"percent"`
+}
+
+// rolloutStatus describes a rollout with the number of devices in each
+// update state.
+type rolloutStatus struct {
+	*Rollout
+	States   map[string]int `json:"states"`
+	Notified *int           `json:"notified,omitempty"`
+}
+
+func (h *WebsocketdServer) newRolloutStatus(r *Rollout) *rolloutStatus {
+	status := &rolloutStatus{Rollout: r, States: make(map[string]int)}
+	for _, p := range h.OTA.Progress(r.CType) {
+		if p.Version == r.Version {
+			status.States[p.State]++
+		}
+	}
+	return status
+}
+
+// serveStartRollout starts or changes the rollout of a device type and tells
+// the connected devices included.
+func (h *WebsocketdServer) serveStartRollout(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	var body rolloutRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxAPIBody)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, smarthome.NewError(smarthome.CodeBadMessage, "", "invalid JSON: "+err.Error()))
+		return
+	}
+	if body.CType == "" || body.Version == "" {
+		writeAPIError(w, http.StatusBadRequest, smarthome.NewError(smarthome.CodeBadMessage, "", "c_type and version are required"))
+		return
+	}
+	r, err := h.OTA.SetRollout(body.CType, body.Version, body.Percent)
+	if err != nil {
+		log.Access("http", "ROLLOUT REJECTED: %s", err)
+		writeAPIError(w, http.StatusBadRequest, smarthome.ErrorReply(smarthome.CodeNoFirmware, "", err))
+		return
+	}
+	status := h.newRolloutStatus(r)
+	notified := h.announceRollout(r, log)
+	status.Notified = &notified
+	writeAPIJSON(w, http.StatusOK, status)
+}
+
+// serveRolloutList lists the rollouts.
+func (h *WebsocketdServer) serveRolloutList(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	rollouts := []*rolloutStatus{}
+	for _, r := range h.OTA.Rollouts() {
+		rollouts = append(rollouts, h.newRolloutStatus(r))
+	}
+	log.Access("http", "ROLLOUTS: %d listed", len(rollouts))
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"count": len(rollouts), "rollouts": rollouts})
+}
+
+// serveRollout describes the rollout of ctype with the update progress of
+// each device.
+func (h *WebsocketdServer) serveRollout(w http.ResponseWriter, req *http.Request, ctype string, log *LogScope) {
+	r := h.OTA.Rollout(ctype)
+	if r == nil {
+		log.Access("http", "ROLLOUT: no rollout for c_type %s", ctype)
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "no rollout for c_type "+ctype))
+		return
+	}
+	log.Access("http", "ROLLOUT: c_type %s", ctype)
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"rollout": h.newRolloutStatus(r),
+		"devices": h.OTA.Progress(ctype),
+	})
+}
+
+// serveRuleList lists the automation rules.
+func (h *WebsocketdServer) serveRuleList(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	rules := []*RuleStatus{}
+	if h.Rules != nil {
+		rules = h.Rules.Status()
+	}
+	log.Access("http", "RULES: %d listed", len(rules))
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"count": len(rules), "rules": rules})
+}
+
+// serveRuleSwitch enables or disables rule name.
+func (h *WebsocketdServer) serveRuleSwitch(w http.ResponseWriter, req *http.Request, name string, enabled bool, log *LogScope) {
+	if h.Rules == nil || !h.Rules.SetEnabled(name, enabled) {
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "no rule "+name))
+		return
+	}
+	log.Access("http", "RULE: %s enabled %t", name, enabled)
+	for _, status := range h.Rules.Status() {
+		if status.Name == name {
+			writeAPIJSON(w, http.StatusOK, status)
+		}
+	}
+}
+
+// schedulesEnabled responds with 404 unless scheduled commands are enabled.
+func (h *WebsocketdServer) schedulesEnabled(w http.ResponseWriter, log *LogScope) bool {
+	if h.Schedules == nil {
+		log.Access("http", "NOT FOUND: schedules are disabled")
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "schedules are disabled"))
+		return false
+	}
+	return true
+}
+
+// scheduleRequest is the body of POST /api/schedules.
+type scheduleRequest struct {
+	Name string          `json:"name"`
+	Cron string          `json:"cron"`
+	Sn   string          `json:"sn"`
+	Data json.RawMessage `json:"data"`
+}
+
+// serveCreateSchedule stores the posted schedule, owned by the API.
+func (h *WebsocketdServer) serveCreateSchedule(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	var body scheduleRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxAPIBody)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, smarthome.NewError(smarthome.CodeBadMessage, "", "invalid JSON: "+err.Error()))
+		return
+	}
+	if !h.canCommand(APISn, body.Sn) {
+		log.Access("http", "FORBIDDEN: schedule to sn %s", body.Sn)
+		writeAPIError(w, http.StatusForbidden, smarthome.NewError(smarthome.CodeForbidden, "", "not allowed to command sn "+body.Sn))
+		return
+	}
+	sched, err := h.Schedules.Add(&Schedule{Name: body.Name, Cron: body.Cron, Sn: body.Sn, Data: body.Data, Owner: APISn})
+	if err != nil {
+		if errorStatus(err) == http.StatusInternalServerError {
+			log.Error("http", "Could not store schedule: %s", err)
+			err = smarthome.NewError(codeInternal, "", "could not store schedule")
+		}
+		writeAPIError(w, errorStatus(err), err)
+		return
+	}
+	log.Access("http", "SCHEDULED: schedule %s, %q to sn %s", sched.Id, sched.Cron, sched.Sn)
+	writeAPIJSON(w, http.StatusCreated, sched)
+}
+
+// serveScheduleList lists the schedules of all owners.
+func (h *WebsocketdServer) serveScheduleList(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	schedules := h.Schedules.List("")
+	log.Access("http", "SCHEDULES: %d listed", len(schedules))
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"count": len(schedules), "schedules": schedules})
+}
+
+// serveSchedule describes schedule id with its recent runs.
+func (h *WebsocketdServer) serveSchedule(w http.ResponseWriter, req *http.Request, id string, log *LogScope) {
+	sched := h.Schedules.Get(id)
+	if sched == nil {
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "no schedule "+id))
+		return
+	}
+	log.Access("http", "SCHEDULE: %s", id)
+	writeAPIJSON(w, http.StatusOK, sched)
+}
+
+// serveDeleteSchedule deletes schedule id, whoever owns it.
+func (h *WebsocketdServer) serveDeleteSchedule(w http.ResponseWriter, req *http.Request, id string, log *LogScope) {
+	deleted, err := h.Schedules.Delete(id)
+	if err != nil {
+		log.Error("http", "Could not delete schedule %s: %s", id, err)
+		writeAPIError(w, http.StatusInternalServerError, smarthome.NewError(codeInternal, "", "could not delete schedule"))
+		return
+	}
+	if !deleted {
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "no schedule "+id))
+		return
+	}
+	log.Access("http", "UNSCHEDULED: schedule %s", id)
+	writeAPIJSON(w, http.StatusOK, map[string]string{"id": id, "status": "deleted"})
+}
+
+// groupsEnabled responds with 404 unless device groups are enabled.
+func (h *WebsocketdServer) groupsEnabled(w http.ResponseWriter, log *LogScope) bool {
+	if h.Groups == nil {
+		log.Access("http", "NOT FOUND: device groups are disabled")
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "device groups are disabled"))
+		return false
+	}
+	return true
+}
+
+// serveGroupList lists the device groups.
+func (h *WebsocketdServer) serveGroupList(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	groups := h.Groups.List()
+	log.Access("http", "GROUPS: %d listed", len(groups))
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{"count": len(groups), "groups": groups})
+}
+
+// serveGroup lists the sns of group name.
+func (h *WebsocketdServer) serveGroup(w http.ResponseWriter, req *http.Request, name string, log *LogScope) {
+	sns := h.Groups.Get(name)
+	if sns == nil {
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "no device group "+name))
+		return
+	}
+	log.Access("http", "GROUP: %s", name)
+	writeAPIJSON(w, http.StatusOK, &DeviceGroup{Name: name, Sns: sns})
+}
+
+// serveSetGroup defines group name as the posted {"sns":[...]}.
+func (h *WebsocketdServer) serveSetGroup(w http.ResponseWriter, req *http.Request, name string, log *LogScope) {
+	var body struct {
+		Sns []string `json:"sns"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxAPIBody)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, smarthome.NewError(smarthome.CodeBadMessage, "", "invalid JSON: "+err.Error()))
+		return
+	}
+	if err := h.Groups.Set(name, body.Sns); err != nil {
+		if errorStatus(err) == http.StatusInternalServerError {
+			log.Error("http", "Could not store device group %s: %s", name, err)
+			err = smarthome.NewError(codeInternal, "", "could not store device group")
+		}
+		writeAPIError(w, errorStatus(err), err)
+		return
+	}
+	log.Access("http", "GROUP SET: %s, %d sns", name, len(body.Sns))
+	writeAPIJSON(w, http.StatusOK, &DeviceGroup{Name: name, Sns: body.Sns})
+}
+
+// serveDeleteGroup deletes group name.
+func (h *WebsocketdServer) serveDeleteGroup(w http.ResponseWriter, req *http.Request, name string, log *LogScope) {
+	deleted, err := h.Groups.Delete(name)
+	if err != nil {
+		log.Error("http", "Could not delete device group %s: %s", name, err)
+		writeAPIError(w, http.StatusInternalServerError, smarthome.NewError(codeInternal, "", "could not delete device group"))
+		return
+	}
+	if !deleted {
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "no device group "+name))
+		return
+	}
+	log.Access("http", "GROUP DELETED: %s", name)
+	writeAPIJSON(w, http.StatusOK, map[string]string{"name": name, "status": "deleted"})
+}
+
+// serveGroupCommand sends the posted command to each device of group name and
+// responds with the outcome for every device once all answered or timed out.
+func (h *WebsocketdServer) serveGroupCommand(w http.ResponseWriter, req *http.Request, name string, log *LogScope) {
+	var body commandRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxAPIBody)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, smarthome.NewError(smarthome.CodeBadMessage, "", "invalid JSON: "+err.Error()))
+		return
+	}
+	if body.Persist {
+		writeAPIError(w, http.StatusBadRequest, smarthome.NewError(smarthome.CodeBadMessage, body.Wsid, "persist is not supported for group commands"))
+		return
+	}
+	if body.Wsid == "" {
+		body.Wsid = newWsid(APISn, &apiWsidSeq)
+	}
+	msg := &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: body.Wsid, Group: name, Data: body.Data}
+	if err := msg.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	replies := make(chan *smarthome.MultiRestReply, 1)
+	onDone := func(reply *smarthome.MultiRestReply) {
+		replies <- reply
+	}
+	if err := h.fanOutRest(APISn, msg, onDone, log); err != nil {
+		log.Access("http", "COMMAND REJECTED: rest %s to group %s: %s", msg.Wsid, name, err)
+		writeAPIError(w, errorStatus(err), err)
+		return
+	}
+	reply := <-replies
+	log.Access("http", "COMMAND: rest %s to group %s, %d devices", msg.Wsid, name, len(reply.Results))
+	writeAPIJSON(w, http.StatusOK, reply)
+}
+
+// apiAuthorized responds with 401 unless req carries the API token, or with
+// 404 if no token is configured and the API is disabled.
+func (h *WebsocketdServer) apiAuthorized(w http.ResponseWriter, req *http.Request, log *LogScope) bool {
+	if h.Config.APIToken == "" {
+		log.Access("http", "NOT FOUND: the HTTP API is disabled")
+		writeAPIError(w, http.StatusNotFound, smarthome.NewError(codeNotFound, "", "the HTTP API is disabled"))
+		return false
+	}
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(h.Config.APIToken)) != 1 {
+		log.Access("http", "UNAUTHORIZED: missing or wrong API token")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="websocketd"`)
+		writeAPIError(w, http.StatusUnauthorized, smarthome.NewError(codeUnauthorized, "", "missing or wrong API token"))
+		return false
+	}
+	return true
+}
+
+// allowMethods responds with 405 unless req uses one of methods.
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, smarthome.NewError(codeMethodNotAllowed, "", req.Method+" is not allowed"))
+	return false
+}
+
+// errorStatus maps smarthome error codes to HTTP status codes.
+func errorStatus(err error) int {
+	switch smarthome.ErrorReply("", "", err).Code {
+	case smarthome.CodeBadMessage:
+		return http.StatusBadRequest
+	case smarthome.CodeTargetOffline:
+		return http.StatusServiceUnavailable
+	case smarthome.CodeTimeout:
+		return http.StatusGatewayTimeout
+	case smarthome.CodeDuplicateWsid:
+		return http.StatusConflict
+	case smarthome.CodeQueueFailed:
+		return http.StatusServiceUnavailable
+	case smarthome.CodeForbidden:
+		return http.StatusForbidden
+	case smarthome.CodeUnknownGroup:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, smarthome.ErrorReply(codeInternal, "", err))
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
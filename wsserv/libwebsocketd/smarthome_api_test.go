@@ -0,0 +1,208 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// request performs an HTTP request against the broker and decodes the JSON
+// response.
+func (b *testBroker) request(method, path, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, b.http.URL+path, strings.NewReader(body))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+b.server.Config.APIToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		b.t.Fatalf("%s %s returned invalid JSON %q", method, path, data)
+	}
+	return resp.StatusCode, msg
+}
+
+func TestSmarthomeAPICommand(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+
+	go func() {
+		cmd := router.receiveType("rest")
+		router.send(map[string]interface{}{"type": "router", "wsid": cmd["wsid"], "from": cmd["from"], "data": map[string]string{"status": "ok"}})
+	}()
+
+	status, reply := b.request("POST", "/api/devices/router-1/commands", `{"wsid":"h1","data":{"cmd":"status"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d %v", status, reply)
+	}
+	if reply["wsid"] != "h1" || reply["sn"] != "router-1" || reply["data"].(map[string]interface{})["status"] != "ok" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+}
+
+func TestSmarthomeAPICommandErrors(t *testing.T) {
+	b := newTestBroker(t, &Config{ReplyTimeout: 50 * time.Millisecond})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{"POST", "/api/devices/router-1/commands", `{"data":{}}`, http.StatusGatewayTimeout, "timeout"},
+		{"POST", "/api/devices/tv-1/commands", `{"data":{}}`, http.StatusServiceUnavailable, "target_offline"},
+		{"POST", "/api/devices/nobody/commands", `{"data":{}}`, http.StatusNotFound, "not_found"},
+		{"POST", "/api/devices/router-1/commands", `{"data":"oops"}`, http.StatusBadRequest, "bad_message"},
+		{"POST", "/api/devices/router-1/commands", `not json`, http.StatusBadRequest, "bad_message"},
+		{"GET", "/api/devices/router-1/commands", ``, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"GET", "/api/nothing", ``, http.StatusNotFound, "not_found"},
+	}
+	for _, test := range tests {
+		status, reply := b.request(test.method, test.path, test.body)
+		if status != test.status || reply["code"] != test.code {
+			t.Errorf("%s %s %s: expected %d %s, got %d %v", test.method, test.path, test.body, test.status, test.code, status, reply)
+		}
+	}
+	if b.server.Pending.Len() != 0 {
+		t.Errorf("%d requests still pending", b.server.Pending.Len())
+	}
+}
+
+func TestSmarthomeAPIDevices(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.subscribe(map[string]interface{}{"wsid": "s1"})
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "router-1", "data": map[string]string{"msgtype": "wifi"}})
+	app.receiveType("notification")
+
+	status, list := b.request("GET", "/api/devices", "")
+	if status != http.StatusOK || list["count"] != 2.0 {
+		t.Fatalf("unexpected device list %d %v", status, list)
+	}
+	devices := list["devices"].([]interface{})
+	if devices[0].(map[string]interface{})["sn"] != "app-1" || devices[1].(map[string]interface{})["sn"] != "router-1" {
+		t.Errorf("devices not sorted by sn: %v", devices)
+	}
+
+	status, list = b.request("GET", "/api/devices?c_type=router", "")
+	if status != http.StatusOK || list["count"] != 1.0 {
+		t.Errorf("unexpected filtered device list %d %v", status, list)
+	}
+
+	status, device := b.request("GET", "/api/devices/router-1", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d %v", status, device)
+	}
+	if device["c_type"] != "router" || device["remote_addr"] == "" || device["connected_at"] == nil || device["last_seen"] == nil {
+		t.Errorf("unexpected device %v", device)
+	}
+	// auth, connect and the notification
+	if device["messages_received"] != 3.0 || device["messages_sent"] != 2.0 {
+		t.Errorf("unexpected counters %v", device)
+	}
+
+	status, stats := b.request("GET", "/api/stats", "")
+	if status != http.StatusOK || stats["connections"] != 2.0 || stats["takeovers"] == nil {
+		t.Errorf("unexpected stats %d %v", status, stats)
+	}
+
+	status, device = b.request("GET", "/api/devices/tv-1", "")
+	if status != http.StatusNotFound || device["code"] != "not_found" {
+		t.Errorf("expected 404 for offline device, got %d %v", status, device)
+	}
+
+	// the API sees only the devices its access list lets it observe
+	acl, err := ParseACL(strings.NewReader("api observe router-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Authorizer = acl
+	status, list = b.request("GET", "/api/devices", "")
+	if devices, _ := list["devices"].([]interface{}); status != http.StatusOK || len(devices) != 1 || devices[0].(map[string]interface{})["sn"] != "router-1" {
+		t.Errorf("unexpected observable device list %d %v", status, list)
+	}
+	if status, device = b.request("GET", "/api/devices/app-1", ""); status != http.StatusForbidden || device["code"] != "forbidden" {
+		t.Errorf("expected 403 for unobservable device, got %d %v", status, device)
+	}
+}
+
+func TestSmarthomeAPIDeviceState(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "router-1", "data": map[string]string{"msgtype": "wifi"}})
+	b.waitFor("notification", func() bool { return len(b.server.States.Device("router-1")) == 2 })
+	router.Close()
+	b.waitFor("disconnect", func() bool { return b.server.Devices.Len() == 0 })
+
+	status, state := b.request("GET", "/api/devices/router-1/state", "")
+	if status != http.StatusOK || state["type"] != "snapshot" {
+		t.Fatalf("unexpected state %d %v", status, state)
+	}
+	notifications := state["notifications"].([]interface{})
+	if len(notifications) != 2 || notifications[0].(map[string]interface{})["data"].(map[string]interface{})["state"] != "offline" {
+		t.Errorf("expected offline devicestate and wifi, got %v", notifications)
+	}
+
+	status, state = b.request("GET", "/api/devices/tv-1/state", "")
+	if status != http.StatusOK || len(state["notifications"].([]interface{})) != 0 {
+		t.Errorf("expected empty state, got %d %v", status, state)
+	}
+	status, state = b.request("GET", "/api/devices/nobody/state", "")
+	if status != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown sn, got %d %v", status, state)
+	}
+}
+
+func TestSmarthomeAPIAuth(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	for _, auth := range []string{"", "Bearer", "Bearer wrong", "Basic " + testAPIToken, testAPIToken} {
+		req, _ := http.NewRequest("GET", b.http.URL+"/api/devices", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: %d", auth, resp.StatusCode)
+		}
+	}
+	if status, _ := b.request("GET", "/api/devices", ""); status != http.StatusOK {
+		t.Errorf("with token: %d", status)
+	}
+
+	b.server.Config.APIToken = ""
+	if status, reply := b.request("GET", "/api/devices", ""); status != http.StatusNotFound {
+		t.Errorf("without configured token: %d %v", status, reply)
+	}
+}
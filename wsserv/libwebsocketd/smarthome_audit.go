@@ -0,0 +1,284 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of commands in AuditRecord.
+const (
+	AuditAnswered  = "answered"  // device answered the rest command
+	AuditDelivered = "delivered" // message was handed to the device, no answer expected
+	AuditTimeout   = "timeout"   // device did not answer in time
+	AuditOffline   = "offline"   // device was not connected
+	AuditQueued    = "queued"    // command waits for the device to connect
+	AuditForbidden = "forbidden" // access list does not allow the sender to command the device
+	AuditRejected  = "rejected"  // command could not be sent for another reason
+)
+
+var AuditClosedError = errors.New("audit log is closed")
+
+// auditTimeFormat is the suffix of rotated audit logs. It sorts in time order.
+const auditTimeFormat = "20060102T150405.000000"
+
+// AuditRecord is one line of the audit log: a command one client sent to
+// another and what became of it.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	From      string    `json:"from"`
+	FromCType string    `json:"from_c_type,omitempty"`
+	To        string    `json:"to"`
+	Wsid      string    `json:"wsid"`
+	Type      string    `json:"type"`
+	Digest    string    `json:"digest"`
+	Size      int       `json:"size"`
+	Outcome   string    `json:"outcome"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// PayloadDigest identifies a command payload in the audit log without
+// recording its content.
+func PayloadDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// AuditLog appends AuditRecords as JSON lines to a file. The file is renamed
+// to PATH.TIMESTAMP once it grows beyond MaxSize bytes or gets older than
+// MaxAge, and renamed files older than Retain are deleted. Zero values
+// disable each of these. It is safe for concurrent use.
+type AuditLog struct {
+	MaxSize int64
+	MaxAge  time.Duration
+	Retain  time.Duration
+
+	path    string
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time // time of the first record in file
+}
+
+// OpenAuditLog opens the audit log at path for appending.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{path: path}
+	if err := a.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open(now time.Time) error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file, a.size, a.started = file, stat.Size(), now
+	if a.size > 0 {
+		a.started = firstAuditTime(a.path, now)
+	}
+	return nil
+}
+
+// firstAuditTime returns the time of the first record in the file at path,
+// or now if it can not be read.
+func firstAuditTime(path string, now time.Time) time.Time {
+	file, err := os.Open(path)
+	if err != nil {
+		return now
+	}
+	defer file.Close()
+	line, _ := bufio.NewReader(file).ReadBytes('\n')
+	var r AuditRecord
+	if json.Unmarshal(line, &r) != nil || r.Time.IsZero() {
+		return now
+	}
+	return r.Time
+}
+
+// Record appends r to the log, rotating it first if needed.
+func (a *AuditLog) Record(r *AuditRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return AuditClosedError
+	}
+	if a.size > 0 && ((a.MaxSize > 0 && a.size+int64(len(line)) > a.MaxSize) || (a.MaxAge > 0 && r.Time.Sub(a.started) >= a.MaxAge)) {
+		if err := a.rotate(r.Time); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) rotate(now time.Time) error {
+	a.file.Close()
+	a.file = nil
+	if err := os.Rename(a.path, a.path+"."+now.UTC().Format(auditTimeFormat)); err != nil {
+		a.open(now)
+		return err
+	}
+	if err := a.open(now); err != nil {
+		return err
+	}
+	if a.Retain > 0 {
+		rotated, _ := rotatedAuditFiles(a.path)
+		for _, name := range rotated {
+			if stat, err := os.Stat(name); err == nil && now.Sub(stat.ModTime()) > a.Retain {
+				os.Remove(name)
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the log file. Later records fail.
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// rotatedAuditFiles returns the rotated files of the audit log at path,
+// oldest first.
+func rotatedAuditFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := []string{}
+	for _, name := range matches {
+		if _, err := time.Parse(auditTimeFormat, strings.TrimPrefix(name, path+".")); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// AuditFilter selects audit records. Empty fields match everything.
+type AuditFilter struct {
+	Sn    string    // sender or target
+	Wsid  string    // wsid of the command
+	Since time.Time // records at or after
+	Until time.Time // records before
+}
+
+// Matches reports whether r is selected by f.
+func (f *AuditFilter) Matches(r *AuditRecord) bool {
+	switch {
+	case f.Sn != "" && r.From != f.Sn && r.To != f.Sn:
+		return false
+	case f.Wsid != "" && r.Wsid != f.Wsid:
+		return false
+	case !f.Since.IsZero() && r.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !r.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// QueryAudit calls fn with the records of the audit log at path and its
+// rotated files that match f, oldest first.
+func QueryAudit(path string, f *AuditFilter, fn func(*AuditRecord) error) error {
+	files, err := rotatedAuditFiles(path)
+	if err != nil {
+		return err
+	}
+	files = append(files, path)
+	for _, name := range files {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = queryAuditFile(file, f, fn)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func queryAuditFile(file io.Reader, f *AuditFilter, fn func(*AuditRecord) error) error {
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var r AuditRecord
+			if err := json.Unmarshal(line, &r); err != nil {
+				return fmt.Errorf("line %d: %s", n, err)
+			}
+			if f.Matches(&r) {
+				if err := fn(&r); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// audit completes r with the payload data and the time since the command was
+// sent, if known, and writes it to the audit log if one is enabled.
+func (h *WebsocketdServer) audit(r *AuditRecord, data []byte, sent time.Time) {
+	if h.Audit == nil {
+		return
+	}
+	r.Time = time.Now()
+	r.Digest = PayloadDigest(data)
+	r.Size = len(data)
+	if !sent.IsZero() {
+		r.LatencyMs = int64(r.Time.Sub(sent) / time.Millisecond)
+	}
+	if entry := h.Devices.Lookup(r.From); entry != nil {
+		r.FromCType = entry.CType
+	}
+	if err := h.Audit.Record(r); err != nil {
+		h.Log.Error("audit", "Could not write audit record of %s %s from %s to sn %s: %s", r.Type, r.Wsid, r.From, r.To, err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempAuditLog opens an audit log in a temporary directory.
+func tempAuditLog(t *testing.T) (*AuditLog, func()) {
+	dir, cleanup := tempDir(t, "audit")
+	audit, err := OpenAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return audit, func() {
+		audit.Close()
+		cleanup()
+	}
+}
+
+func queryAll(t *testing.T, path string, f *AuditFilter) []*AuditRecord {
+	records := []*AuditRecord{}
+	err := QueryAudit(path, f, func(r *AuditRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	audit, cleanup := tempAuditLog(t)
+	defer cleanup()
+	audit.MaxSize = 400
+	audit.MaxAge = time.Hour
+
+	start := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	wsids := []string{"w1", "w2", "w3", "w4", "w5"}
+	for i, wsid := range wsids {
+		r := &AuditRecord{Time: start.Add(time.Duration(i) * time.Minute), From: "app-1", To: "tv-1", Wsid: wsid, Type: "rest", Outcome: AuditAnswered}
+		if err := audit.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := rotatedAuditFiles(audit.path)
+	if len(rotated) < 2 {
+		t.Fatalf("not rotated by size: %v", rotated)
+	}
+	if err := audit.Record(&AuditRecord{Time: start.Add(2 * time.Hour), From: "app-2", To: "router-1", Wsid: "w6", Type: "rest", Outcome: AuditOffline}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := rotatedAuditFiles(audit.path); len(again) != len(rotated)+1 {
+		t.Errorf("not rotated by age: %v", again)
+	}
+
+	records := queryAll(t, audit.path, &AuditFilter{})
+	if len(records) != 6 {
+		t.Fatalf("got %d records", len(records))
+	}
+	for i, r := range records[:5] {
+		if r.Wsid != wsids[i] {
+			t.Errorf("record %d is %s", i, r.Wsid)
+		}
+	}
+	if got := queryAll(t, audit.path, &AuditFilter{Sn: "router-1"}); len(got) != 1 || got[0].Wsid != "w6" {
+		t.Errorf("by sn: %v", got)
+	}
+	if got := queryAll(t, audit.path, &AuditFilter{Wsid: "w2"}); len(got) != 1 {
+		t.Errorf("by wsid: %v", got)
+	}
+	if got := queryAll(t, audit.path, &AuditFilter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}); len(got) != 2 {
+		t.Errorf("by time: %v", got)
+	}
+
+	// rotated files not written for longer than Retain are deleted
+	audit.Retain = time.Hour
+	old := start.Add(-2 * time.Hour)
+	for _, name := range rotated {
+		os.Chtimes(name, old, old)
+	}
+	audit.MaxSize = 1
+	audit.Record(&AuditRecord{Time: time.Now(), From: "app-1", To: "tv-1", Wsid: "w7", Type: "rest", Outcome: AuditAnswered})
+	audit.Record(&AuditRecord{Time: time.Now(), From: "app-1", To: "tv-1", Wsid: "w8", Type: "rest", Outcome: AuditAnswered})
+	for _, name := range rotated {
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("%s not deleted", name)
+		}
+	}
+}
+
+func TestSmarthomeAudit(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	audit, cleanup := tempAuditLog(t)
+	defer cleanup()
+	b.server.Audit = audit
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.send(map[string]interface{}{"type": "rest", "wsid": "r1", "sn": "router-1", "data": map[string]string{"cmd": "reboot"}})
+	expectError(t, app.receive(), "target_offline", "r1")
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app.send(map[string]interface{}{"type": "rest", "wsid": "r2", "sn": "router-1", "data": map[string]string{"cmd": "reboot"}})
+	cmd := router.receiveType("rest")
+	router.send(map[string]interface{}{"type": "router", "wsid": cmd["wsid"], "from": "app-1", "data": map[string]string{"status": "ok"}})
+	app.receiveType("rest")
+
+	records := queryAll(t, audit.path, &AuditFilter{Sn: "router-1"})
+	if len(records) != 2 {
+		t.Fatalf("got %d records", len(records))
+	}
+	offline, answered := records[0], records[1]
+	if offline.Wsid != "r1" || offline.Outcome != AuditOffline || offline.Error == "" {
+		t.Errorf("unexpected record %+v", offline)
+	}
+	if answered.Wsid != "r2" || answered.Outcome != AuditAnswered || answered.From != "app-1" || answered.FromCType != "rest" ||
+		answered.Digest != PayloadDigest([]byte(`{"cmd":"reboot"}`)) || answered.Size != 16 {
+		t.Errorf("unexpected record %+v", answered)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	UnknownDeviceError  = errors.New("unknown device")
+	BadCredentialsError = errors.New("bad device credentials")
+	InvalidTokenError   = errors.New("invalid token")
+	ExpiredTokenError   = errors.New("token expired")
+)
+
+// DeviceCredential is a single entry of the device registry file.
+type DeviceCredential struct {
+	Sn     string
+	Mac    string
+	Secret string
+}
+
+// DeviceCredentials is the set of devices that are allowed to authenticate
+// with the smarthome broker. It is read-only once loaded, so it is safe for
+// concurrent use.
+type DeviceCredentials struct {
+	devices map[string]*DeviceCredential
+}
+
+// reservedSns are the identities the broker itself sends commands as. They
+// hold rights of their own in the access list, so no client may use them,
+// nor the identities of MQTT users.
+var reservedSns = map[string]bool{APISn: true, MQTTSn: true, RulesSn: true}
+
+// ReservedSn reports whether sn is an identity of the broker itself or of
+// an MQTT user.
+func ReservedSn(sn string) bool {
+	return reservedSns[sn] || strings.HasPrefix(sn, MQTTSn+":")
+}
+
+// LoadDeviceCredentials reads the device registry from file.
+func LoadDeviceCredentials(path string) (*DeviceCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDeviceCredentials(f)
+}
+
+// ParseDeviceCredentials reads a device registry. Every non-empty line that
+// is not a # comment holds whitespace separated sn, mac and shared secret.
+func ParseDeviceCredentials(r io.Reader) (*DeviceCredentials, error) {
+	dc := &DeviceCredentials{devices: make(map[string]*DeviceCredential)}
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected sn, mac and secret", lineno)
+		}
+		if ReservedSn(fields[0]) {
+			return nil, fmt.Errorf("line %d: sn %s is reserved for the broker", lineno, fields[0])
+		}
+		if _, ok := dc.devices[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate sn %s", lineno, fields[0])
+		}
+		dc.devices[fields[0]] = &DeviceCredential{Sn: fields[0], Mac: fields[1], Secret: fields[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// Len returns number of registered devices.
+func (dc *DeviceCredentials) Len() int {
+	return len(dc.devices)
+}
+
+// Known reports whether sn is registered.
+func (dc *DeviceCredentials) Known(sn string) bool {
+	_, ok := dc.devices[sn]
+	return ok
+}
+
+// List returns the registered devices sorted by sn.
+func (dc *DeviceCredentials) List() []*DeviceCredential {
+	list := make([]*DeviceCredential, 0, len(dc.devices))
+	for _, device := range dc.devices {
+		list = append(list, device)
+	}
+	sort.Sort(credentialsBySn(list))
+	return list
+}
+
+type credentialsBySn []*DeviceCredential
+
+func (l credentialsBySn) Len() int           { return len(l) }
+func (l credentialsBySn) Less(i, j int) bool { return l[i].Sn < l[j].Sn }
+func (l credentialsBySn) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Authenticate checks that sn is registered with given mac and shared secret.
+func (dc *DeviceCredentials) Authenticate(sn, mac, secret string) error {
+	device, ok := dc.devices[sn]
+	if !ok {
+		return UnknownDeviceError
+	}
+	macOk := strings.EqualFold(device.Mac, mac)
+	secretOk := hmac.Equal([]byte(device.Secret), []byte(secret))
+	if !macOk || !secretOk {
+		return BadCredentialsError
+	}
+	return nil
+}
+
+// IssueToken returns a token for sn that is valid until expiry. Tokens have
+// the form "<expiry unix time>.<hex HMAC-SHA256 over sn, mac and expiry>",
+// keyed with the device's shared secret.
+func (dc *DeviceCredentials) IssueToken(sn string, expiry time.Time) (string, error) {
+	device, ok := dc.devices[sn]
+	if !ok {
+		return "", UnknownDeviceError
+	}
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+	return exp + "." + hex.EncodeToString(device.sign(exp)), nil
+}
+
+// VerifyToken checks that token was issued for sn and has not expired at now.
+func (dc *DeviceCredentials) VerifyToken(sn, token string, now time.Time) error {
+	device, ok := dc.devices[sn]
+	if !ok {
+		return UnknownDeviceError
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return InvalidTokenError
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return InvalidTokenError
+	}
+	sig, err := hex.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, device.sign(parts[0])) {
+		return InvalidTokenError
+	}
+	if now.Unix() >= expiry {
+		return ExpiredTokenError
+	}
+	return nil
+}
+
+func (d *DeviceCredential) sign(expiry string) []byte {
+	mac := hmac.New(sha256.New, []byte(d.Secret))
+	io.WriteString(mac, d.Sn)
+	io.WriteString(mac, "|")
+	io.WriteString(mac, strings.ToLower(d.Mac))
+	io.WriteString(mac, "|")
+	io.WriteString(mac, expiry)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,104 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDeviceRegistry = `
+# sn        mac                 secret
+router-1    00:11:22:33:44:55   s3cret
+app-1       -                   appsecret
+`
+
+func testCredentials(t *testing.T) *DeviceCredentials {
+	dc, err := ParseDeviceCredentials(strings.NewReader(testDeviceRegistry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc
+}
+
+func TestParseDeviceCredentials(t *testing.T) {
+	dc := testCredentials(t)
+	if dc.Len() != 2 {
+		t.Errorf("expected 2 devices, got %d", dc.Len())
+	}
+
+	bad := []string{
+		"router-1 00:11:22:33:44:55",
+		"router-1 00:11:22:33:44:55 s3cret extra",
+		"router-1 a b\nrouter-1 c d",
+		"api 00:11:22:33:44:55 s3cret",
+		"mqtt - s3cret",
+		"rules - s3cret",
+		"mqtt:bridge - s3cret",
+	}
+	for _, registry := range bad {
+		if _, err := ParseDeviceCredentials(strings.NewReader(registry)); err == nil {
+			t.Errorf("registry %q should not parse", registry)
+		}
+	}
+}
+
+var authenticateTests = []struct {
+	sn, mac, secret string
+	err             error
+}{
+	{"router-1", "00:11:22:33:44:55", "s3cret", nil},
+	{"router-1", "00:11:22:33:44:AA", "s3cret", BadCredentialsError},
+	{"router-1", "00:11:22:33:44:55", "wrong", BadCredentialsError},
+	{"router-1", "00:11:22:33:44:55", "", BadCredentialsError},
+	{"router-2", "00:11:22:33:44:55", "s3cret", UnknownDeviceError},
+	{"app-1", "-", "appsecret", nil},
+}
+
+func TestAuthenticate(t *testing.T) {
+	dc := testCredentials(t)
+	for _, testcase := range authenticateTests {
+		err := dc.Authenticate(testcase.sn, testcase.mac, testcase.secret)
+		if err != testcase.err {
+			t.Errorf("Authenticate(%s, %s, %s) = %v, expected %v", testcase.sn, testcase.mac, testcase.secret, err, testcase.err)
+		}
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	dc := testCredentials(t)
+	now := time.Now()
+
+	token, err := dc.IssueToken("router-1", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.VerifyToken("router-1", token, now); err != nil {
+		t.Errorf("fresh token rejected: %s", err)
+	}
+	if err := dc.VerifyToken("router-1", token, now.Add(2*time.Hour)); err != ExpiredTokenError {
+		t.Errorf("expected expired token, got %v", err)
+	}
+	if err := dc.VerifyToken("app-1", token, now); err != InvalidTokenError {
+		t.Errorf("token of another sn accepted: %v", err)
+	}
+	if err := dc.VerifyToken("router-9", token, now); err != UnknownDeviceError {
+		t.Errorf("expected unknown device, got %v", err)
+	}
+
+	// moving the expiry invalidates the signature
+	forged := strings.Replace(token, token[:strings.Index(token, ".")], "9999999999", 1)
+	for _, bad := range []string{"", "12345678", forged, token + "00", "x." + token} {
+		if err := dc.VerifyToken("router-1", bad, now); err != InvalidTokenError {
+			t.Errorf("token %q: expected invalid token, got %v", bad, err)
+		}
+	}
+
+	if _, err := dc.IssueToken("router-9", now); err != UnknownDeviceError {
+		t.Errorf("token issued for unknown device: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// DeviceGroup is a named list of sns rest commands can address at once.
+type DeviceGroup struct {
+	Name string   `json:"name"`
+	Sns  []string `json:"sns"`
+}
+
+type groupList []*DeviceGroup
+
+func (l groupList) Len() int           { return len(l) }
+func (l groupList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l groupList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// GroupStore keeps device groups in a JSON file, which is rewritten on every
+// change. The file may be edited by hand while the server is stopped:
+// {"groups":{"living-room":["light-1","light-2","tv-1"]}}.
+// It is safe for concurrent use.
+type GroupStore struct {
+	path   string
+	mutex  sync.Mutex
+	groups map[string][]string
+}
+
+// groupFile is the content of the group file.
+type groupFile struct {
+	Groups map[string][]string `json:"groups"`
+}
+
+// OpenGroupStore reads the groups stored in path. A missing file is created
+// with the first group.
+func OpenGroupStore(path string) (*GroupStore, error) {
+	s := &GroupStore{path: path, groups: make(map[string][]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file groupFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for name, sns := range file.Groups {
+		if err := validateGroup(name, sns); err != nil {
+			return nil, fmt.Errorf("group %s: %s", name, smarthome.ErrorReply("", "", err).Message)
+		}
+		s.groups[name] = sns
+	}
+	return s, nil
+}
+
+// validateGroup checks name and sns the way rest commands addressing them
+// are checked. The returned error is a smarthome.ErrorMessage.
+func validateGroup(name string, sns []string) error {
+	if sns == nil {
+		sns = []string{}
+	}
+	if err := (&smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: "group", Group: name, Data: json.RawMessage("{}")}).Validate(); err != nil {
+		reply := smarthome.ErrorReply(smarthome.CodeBadMessage, "", err)
+		return smarthome.NewError(reply.Code, "", reply.Message)
+	}
+	if err := (&smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: "group", Sns: sns, Data: json.RawMessage("{}")}).Validate(); err != nil {
+		reply := smarthome.ErrorReply(smarthome.CodeBadMessage, "", err)
+		return smarthome.NewError(reply.Code, "", reply.Message)
+	}
+	return nil
+}
+
+// Get returns the sns of group name, or nil if there is no such group.
+func (s *GroupStore) Get(name string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sns := s.groups[name]
+	if sns == nil {
+		return nil
+	}
+	return append([]string{}, sns...)
+}
+
+// List returns the groups sorted by name.
+func (s *GroupStore) List() []*DeviceGroup {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := groupList{}
+	for name, sns := range s.groups {
+		list = append(list, &DeviceGroup{Name: name, Sns: append([]string{}, sns...)})
+	}
+	sort.Sort(list)
+	return list
+}
+
+// Set defines group name as sns, replacing the group if it exists. Invalid
+// groups are rejected with a smarthome.ErrorMessage.
+func (s *GroupStore) Set(name string, sns []string) error {
+	if err := validateGroup(name, sns); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, existed := s.groups[name]
+	s.groups[name] = append([]string{}, sns...)
+	if err := s.save(); err != nil {
+		if existed {
+			s.groups[name] = previous
+		} else {
+			delete(s.groups, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes group name. It returns false if there is no such group.
+func (s *GroupStore) Delete(name string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sns, ok := s.groups[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.groups, name)
+	if err := s.save(); err != nil {
+		s.groups[name] = sns
+		return false, err
+	}
+	return true, nil
+}
+
+// Len returns the number of groups.
+func (s *GroupStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.groups)
+}
+
+func (s *GroupStore) save() error {
+	data, err := json.MarshalIndent(&groupFile{Groups: s.groups}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// restTargets returns the sns m is addressed to. Unknown groups are rejected
+// with a smarthome.ErrorMessage.
+func (h *WebsocketdServer) restTargets(m *smarthome.RestMessage) ([]string, error) {
+	switch {
+	case m.Group != "" && h.Groups == nil:
+		return nil, smarthome.NewError(smarthome.CodeUnknownGroup, m.Wsid, "device groups are disabled")
+	case m.Group != "":
+		sns := h.Groups.Get(m.Group)
+		if sns == nil {
+			return nil, smarthome.NewError(smarthome.CodeUnknownGroup, m.Wsid, "no device group "+m.Group)
+		}
+		return sns, nil
+	case m.Sns != nil:
+		return m.Sns, nil
+	}
+	return []string{m.Sn}, nil
+}
+
+// fanOutRest sends rest command m from sn from to each of its targets under
+// m.Wsid and calls onDone once with the outcome for every target, after all
+// of them answered, timed out or could not be reached. Targets from may not
+// command are reported as forbidden without being sent anything.
+func (h *WebsocketdServer) fanOutRest(from string, m *smarthome.RestMessage, onDone func(*smarthome.MultiRestReply), log *LogScope) error {
+	targets, err := h.restTargets(m)
+	if err != nil {
+		return err
+	}
+	reply := &smarthome.MultiRestReply{Type: smarthome.TypeRest, Wsid: m.Wsid, Group: m.Group, Results: make([]*smarthome.TargetResult, len(targets))}
+	var mutex sync.Mutex
+	remaining := len(targets)
+	done := func(i int, result *smarthome.TargetResult) {
+		mutex.Lock()
+		reply.Results[i] = result
+		remaining--
+		finished := remaining == 0
+		mutex.Unlock()
+		if finished {
+			onDone(reply)
+		}
+	}
+	failed := func(i int, err error) {
+		e := smarthome.ErrorReply(smarthome.CodeBadMessage, m.Wsid, err)
+		done(i, &smarthome.TargetResult{Sn: targets[i], Status: e.Code, Message: e.Message})
+	}
+
+	for i, sn := range targets {
+		i, sn := i, sn
+		if !h.canCommand(from, sn) {
+			log.Access("smarthome", "FORBIDDEN: rest %s from %s to sn %s", m.Wsid, from, sn)
+			h.audit(&AuditRecord{From: from, To: sn, Wsid: m.Wsid, Type: m.Type, Outcome: AuditForbidden}, m.Data, time.Time{})
+			h.Metrics.Dropped(m.Type)
+			failed(i, smarthome.NewError(smarthome.CodeForbidden, m.Wsid, "not allowed to command sn "+sn))
+			continue
+		}
+		onReply := func(r *smarthome.ResponseMessage) {
+			done(i, &smarthome.TargetResult{Sn: sn, Status: smarthome.StatusOK, Data: r.Data})
+		}
+		onTimeout := func() {
+			log.Access("smarthome", "TIMEOUT: sn %s did not answer rest %s", sn, m.Wsid)
+			failed(i, smarthome.NewError(smarthome.CodeTimeout, m.Wsid, "sn "+sn+" did not answer"))
+		}
+		if err := h.forwardRest(NewPendingRequest(m.Wsid, from, sn, onReply, onTimeout), m.Data); err != nil {
+			log.Access("smarthome", "REJECTED: rest %s to sn %s: %s", m.Wsid, sn, err)
+			failed(i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempGroups opens an empty group store in a temporary directory.
+func tempGroups(t *testing.T) (*GroupStore, func()) {
+	dir, cleanup := tempDir(t, "groups")
+	store, err := OpenGroupStore(filepath.Join(dir, "groups.json"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return store, cleanup
+}
+
+func TestGroupStore(t *testing.T) {
+	store, cleanup := tempGroups(t)
+	defer cleanup()
+
+	for name, sns := range map[string][]string{"living room": {"tv-1"}, "empty": {}, "dup": {"tv-1", "tv-1"}, "bad": {"tv 1"}} {
+		if err := store.Set(name, sns); errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("group %q of %v: %v", name, sns, err)
+		}
+	}
+	if err := store.Set("living", []string{"tv-1", "light-1"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Set("bedroom", []string{"light-2"})
+	store.Set("kitchen", []string{"light-3"})
+	store.Set("bedroom", []string{"light-2", "light-4"})
+	if deleted, err := store.Delete("kitchen"); !deleted || err != nil {
+		t.Errorf("delete kitchen: %t, %v", deleted, err)
+	}
+	if deleted, _ := store.Delete("kitchen"); deleted {
+		t.Error("deleted kitchen twice")
+	}
+	if sns := store.Get("nosuch"); sns != nil {
+		t.Errorf("unknown group has %v", sns)
+	}
+
+	reopened, err := OpenGroupStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*DeviceGroup{&DeviceGroup{Name: "bedroom", Sns: []string{"light-2", "light-4"}}, &DeviceGroup{Name: "living", Sns: []string{"tv-1", "light-1"}}}
+	if got := reopened.List(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reopened %v", got)
+	}
+
+	ioutil.WriteFile(store.path, []byte(`{"groups":{"living":[]}}`), 0600)
+	if _, err := OpenGroupStore(store.path); err == nil || !strings.Contains(err.Error(), "living") {
+		t.Errorf("empty group loaded: %v", err)
+	}
+}
+
+func TestSmarthomeGroupCommand(t *testing.T) {
+	b := newTestBroker(t, &Config{ReplyTimeout: 100 * time.Millisecond})
+	defer b.Close()
+	groups, cleanup := tempGroups(t)
+	defer cleanup()
+	b.server.Groups = groups
+	groups.Set("living", []string{"router-1", "tv-1", "app-2"})
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	defer tv.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	// the router answers, the tv does not and app-2 is offline
+	app.send(map[string]interface{}{"type": "rest", "wsid": "g1", "group": "living", "data": map[string]string{"cmd": "off"}})
+	if cmd := router.receiveType("rest"); cmd["wsid"] != "g1" || cmd["from"] != "app-1" {
+		t.Fatalf("unexpected command %v", cmd)
+	}
+	if cmd := tv.receiveType("rest"); cmd["wsid"] != "g1" {
+		t.Fatalf("unexpected command %v", cmd)
+	}
+	router.send(map[string]interface{}{"type": "router", "wsid": "g1", "from": "app-1", "data": map[string]string{"power": "off"}})
+
+	reply := app.receiveType("rest")
+	results, _ := reply["results"].([]interface{})
+	if reply["wsid"] != "g1" || reply["group"] != "living" || len(results) != 3 {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	for i, want := range [][2]string{{"router-1", "ok"}, {"tv-1", "timeout"}, {"app-2", "target_offline"}} {
+		result := results[i].(map[string]interface{})
+		if result["sn"] != want[0] || result["status"] != want[1] {
+			t.Errorf("result %d: %v, want %v", i, result, want)
+		}
+	}
+	if data, _ := results[0].(map[string]interface{})["data"].(map[string]interface{}); data["power"] != "off" {
+		t.Errorf("router answered %v", results[0])
+	}
+	if b.server.Pending.Len() != 0 {
+		t.Errorf("%d requests still pending", b.server.Pending.Len())
+	}
+
+	// lists of sns need no group, sns the client may not command are skipped
+	acl, err := ParseACL(strings.NewReader("app-1 command tv-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Authorizer = acl
+	app.send(map[string]interface{}{"type": "rest", "wsid": "g2", "sns": []string{"tv-1", "router-1"}, "data": map[string]string{}})
+	tv.receiveType("rest")
+	tv.send(map[string]interface{}{"type": "tv", "wsid": "g2", "from": "app-1", "data": map[string]string{}})
+	reply = app.receiveType("rest")
+	results, _ = reply["results"].([]interface{})
+	if len(results) != 2 || results[0].(map[string]interface{})["status"] != "ok" || results[1].(map[string]interface{})["status"] != "forbidden" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "g3", "group": "nosuch", "data": map[string]string{}})
+	expectError(t, app.receiveType("error"), "unknown_group", "g3")
+}
+
+func TestSmarthomeGroupAPI(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	if status, _ := b.request("GET", "/api/groups", ""); status != http.StatusNotFound {
+		t.Errorf("groups disabled: %d", status)
+	}
+	groups, cleanup := tempGroups(t)
+	defer cleanup()
+	b.server.Groups = groups
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	go func() {
+		cmd := router.receiveType("rest")
+		router.send(map[string]interface{}{"type": "router", "wsid": cmd["wsid"], "from": cmd["from"], "data": map[string]string{"status": "ok"}})
+	}()
+
+	if status, reply := b.request("PUT", "/api/groups/routers", `{"sns":[]}`); status != http.StatusBadRequest {
+		t.Errorf("empty group: %d %v", status, reply)
+	}
+	if status, reply := b.request("PUT", "/api/groups/routers", `{"sns":["router-1"]}`); status != http.StatusOK || reply["name"] != "routers" {
+		t.Errorf("set group: %d %v", status, reply)
+	}
+	if status, list := b.request("GET", "/api/groups", ""); status != http.StatusOK || list["count"] != 1.0 {
+		t.Errorf("list groups: %d %v", status, list)
+	}
+	status, reply := b.request("POST", "/api/groups/routers/commands", `{"wsid":"h1","data":{"cmd":"status"}}`)
+	results, _ := reply["results"].([]interface{})
+	if status != http.StatusOK || len(results) != 1 || results[0].(map[string]interface{})["status"] != "ok" {
+		t.Errorf("group command: %d %v", status, reply)
+	}
+	if status, reply := b.request("POST", "/api/groups/nosuch/commands", `{"data":{}}`); status != http.StatusNotFound || reply["code"] != "unknown_group" {
+		t.Errorf("unknown group command: %d %v", status, reply)
+	}
+	if status, reply := b.request("POST", "/api/groups/routers/commands", `{"data":{},"persist":true}`); status != http.StatusBadRequest || reply["message"] != "persist is not supported for group commands" {
+		t.Errorf("persistent group command: %d %v", status, reply)
+	}
+	if status, _ := b.request("DELETE", "/api/groups/routers", ""); status != http.StatusOK {
+		t.Errorf("delete group: %d", status)
+	}
+	if status, _ := b.request("GET", "/api/groups/routers", ""); status != http.StatusNotFound {
+		t.Errorf("deleted group: %d", status)
+	}
+}
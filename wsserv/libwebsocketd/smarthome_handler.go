@@ -0,0 +1,607 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// SmarthomeBroker is the ProtocolHandler of the smarthome device broker,
+// registered as "smarthome".
+type SmarthomeBroker struct{}
+
+func init() {
+	RegisterProtocol("smarthome", SmarthomeBroker{})
+}
+
+// smarthomeSession is the state of a smarthome connection.
+type smarthomeSession struct {
+	*Session
+	BindSn     string          // sn this smarthome connection is bound to by "connect"
+	BindDevice *DeviceEntry    // registry entry created by "connect"
+	codec      smarthome.Codec // version of the protocol the client speaks
+}
+
+// Subprotocols offers the versions of the smarthome protocol in the
+// handshake. Clients not asking for one speak the legacy format.
+func (SmarthomeBroker) Subprotocols() []string {
+	return smarthome.Subprotocols
+}
+
+func (SmarthomeBroker) OnConnect(s *Session) error {
+	codec := smarthome.CodecFor(s.Subprotocol)
+	s.Endpoint.codec = codec
+	s.State = &smarthomeSession{Session: s, codec: codec}
+	return nil
+}
+
+func (SmarthomeBroker) OnDisconnect(s *Session) {
+	ss := s.State.(*smarthomeSession)
+	if ss.BindDevice != nil {
+		ss.unbindDevice(s.Log)
+	}
+}
+
+// OnMessage runs the smarthome broker protocol. It returns an error if the
+// client has been rejected.
+func (SmarthomeBroker) OnMessage(s *Session, msg string) error {
+	ss, log := s.State.(*smarthomeSession), s.Log
+	log.Debug("smarthome", "received: %s", msg)
+	if ss.BindDevice != nil {
+		ss.BindDevice.Touch(time.Now())
+	}
+
+	decoded, err := ss.codec.Decode([]byte(msg))
+	if err != nil {
+		log.Access("smarthome", "REJECTED: %s", err)
+		s.SendMessage(err)
+		return nil
+	}
+
+	switch m := decoded.(type) {
+	case *smarthome.AuthMessage:
+		if !ss.smarthomeAuth(s.Endpoint, m, log) {
+			return fmt.Errorf("auth of sn %s failed", m.Sn)
+		}
+	case *smarthome.ConnectMessage:
+		if !ss.smarthomeConnect(s.Endpoint, m, log) {
+			return fmt.Errorf("connect of sn %s failed", m.Sn)
+		}
+	default:
+		if ss.BindDevice == nil {
+			log.Access("smarthome", "REJECTED: %s before connect", decoded.MessageType())
+			s.SendMessage(smarthome.NewError(smarthome.CodeNotConnected, "", "connect first"))
+			return fmt.Errorf("%s before connect", decoded.MessageType())
+		}
+		switch m := decoded.(type) {
+		case *smarthome.RestMessage:
+			ss.smarthomeRest(m, log)
+		case *smarthome.CustomMessage:
+			ss.smarthomeRoute(m, log)
+		case *smarthome.ResponseMessage:
+			ss.smarthomeResponse(m, log)
+		case *smarthome.NotificationMessage:
+			ss.smarthomeNotification(m, log)
+		case *smarthome.SubscribeMessage:
+			ss.smarthomeSubscribe(m, log)
+		case *smarthome.UnsubscribeMessage:
+			ss.smarthomeUnsubscribe(m, log)
+		case *smarthome.OTACheckMessage:
+			ss.smarthomeOTACheck(m, log)
+		case *smarthome.OTAStartMessage:
+			ss.smarthomeOTAStart(m, log)
+		case *smarthome.OTAAckMessage:
+			ss.smarthomeOTAAck(m, log)
+		case *smarthome.OTAResultMessage:
+			ss.smarthomeOTAResult(m, log)
+		case *smarthome.ScheduleMessage:
+			ss.smarthomeSchedule(m, log)
+		}
+	}
+	return nil
+}
+
+// OnBinary passes a binary frame on to the sn in its envelope, with the
+// envelope naming the sender instead. The target must be allowed to observe
+// the sender or the sender to command the target.
+func (SmarthomeBroker) OnBinary(s *Session, data []byte) error {
+	ss, log := s.State.(*smarthomeSession), s.Log
+	if ss.BindDevice == nil {
+		log.Access("smarthome", "REJECTED: binary frame before connect")
+		s.SendMessage(smarthome.NewError(smarthome.CodeNotConnected, "", "connect first"))
+		return fmt.Errorf("binary frame before connect")
+	}
+	ss.BindDevice.Touch(time.Now())
+
+	frame, err := smarthome.DecodeBinary(data)
+	if err != nil {
+		log.Access("smarthome", "REJECTED: binary frame from sn %s: %s", ss.BindSn, err)
+		s.SendMessage(err)
+		return nil
+	}
+	target := frame.Sn
+	log.Debug("smarthome", "received %d bytes binary frame %s from %s to %s", len(frame.Payload), frame.Wsid, ss.BindSn, target)
+	if !ss.Server.canCommand(ss.BindSn, target) && !ss.Server.canObserve(target, ss.BindSn) {
+		log.Access("smarthome", "FORBIDDEN: binary frame %s from %s to sn %s", frame.Wsid, ss.BindSn, target)
+		s.SendMessage(smarthome.NewError(smarthome.CodeForbidden, frame.Wsid, "not allowed to send to sn "+target))
+		return nil
+	}
+	frame.Sn = ss.BindSn
+	forward, err := frame.Encode()
+	if err != nil {
+		s.SendMessage(smarthome.ErrorReply(smarthome.CodeBadMessage, frame.Wsid, err))
+		return nil
+	}
+	entry := ss.Server.Devices.Lookup(target)
+	if entry == nil || !entry.Endpoint.SendBinary(forward) {
+		log.Access("smarthome", "REJECTED: binary frame %s from %s to sn %s: not connected", frame.Wsid, ss.BindSn, target)
+		ss.Server.Metrics.Dropped("binary")
+		s.SendMessage(smarthome.NewError(smarthome.CodeTargetOffline, frame.Wsid, "sn "+target+" is not connected"))
+		return nil
+	}
+	ss.Server.Metrics.Routed("binary")
+	return nil
+}
+
+// smarthomeAuth checks device credentials and issues a token. It returns false
+// if the connection has to be closed.
+func (ss *smarthomeSession) smarthomeAuth(endpoint *SmarthomeWebSocketEndpoint, m *smarthome.AuthMessage, log *LogScope) bool {
+	if err := ss.Server.Credentials.Authenticate(m.Sn, m.Mac, m.Secret); err != nil {
+		log.Access("smarthome", "AUTH FAILED: sn %s: %s", m.Sn, err)
+		endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeAuthFailed, "", err))
+		return false
+	}
+
+	expiry := time.Now().Add(ss.Server.Config.TokenTTL)
+	token, err := ss.Server.Credentials.IssueToken(m.Sn, expiry)
+	if err != nil {
+		log.Error("smarthome", "Could not issue token for sn %s: %s", m.Sn, err)
+		endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeAuthFailed, "", err))
+		return false
+	}
+	return endpoint.SendMessage(&smarthome.AuthReply{Token: token, Expires: expiry.Unix()})
+}
+
+// smarthomeConnect verifies the token and binds the connection to sn. It
+// returns false if the connection has to be closed.
+func (ss *smarthomeSession) smarthomeConnect(endpoint *SmarthomeWebSocketEndpoint, m *smarthome.ConnectMessage, log *LogScope) bool {
+	if ReservedSn(m.Sn) {
+		log.Access("smarthome", "CONNECT REJECTED: sn %s is reserved", m.Sn)
+		endpoint.SendMessage(smarthome.NewError(smarthome.CodeBadMessage, "", "sn "+m.Sn+" is reserved"))
+		return false
+	}
+	if err := ss.Server.Credentials.VerifyToken(m.Sn, m.Token, time.Now()); err != nil {
+		log.Access("smarthome", "CONNECT REJECTED: sn %s: %s", m.Sn, err)
+		endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeInvalidToken, "", err))
+		return false
+	}
+
+	if ss.BindDevice != nil {
+		ss.unbindDevice(log)
+	}
+	remote := net.JoinHostPort(ss.RemoteInfo.Addr, ss.RemoteInfo.Port)
+	entry := NewDeviceEntry(m.Sn, m.CType, remote, endpoint)
+	policy := TakeoverPolicy(ss.Server.Config.DuplicateSn)
+	existing, ok := ss.Server.Devices.Bind(entry, policy)
+	if !ok {
+		log.Access("smarthome", "TAKEOVER REJECTED: sn %s is connected from %s already", m.Sn, existing[len(existing)-1].RemoteAddr)
+		endpoint.SendMessage(smarthome.NewError(smarthome.CodeSnInUse, "", "sn "+m.Sn+" is connected already"))
+		return false
+	}
+	ss.BindDevice = entry
+	ss.BindSn = m.Sn
+	for _, old := range existing {
+		if policy == TakeoverAllowMulti {
+			log.Access("smarthome", "TAKEOVER: sn %s connected from %s again, keeping connection from %s", m.Sn, remote, old.RemoteAddr)
+			continue
+		}
+		log.Access("smarthome", "TAKEOVER: sn %s connected from %s, closing connection from %s", m.Sn, remote, old.RemoteAddr)
+		old.Endpoint.Close(CloseReplaced, "sn connected from another socket")
+	}
+	log.Access("smarthome", "CONNECTED: sn %s, c_type %s, %d clients online", m.Sn, m.CType, ss.Server.Devices.Len())
+
+	endpoint.SendMessage(&smarthome.ConnectReply{Message: "connected"})
+
+	if m.CType == "rest" {
+		endpoint.SendMessage(smarthome.NewSnapshot(ss.Server.observable(m.Sn, ss.Server.States.All())))
+	} else if len(existing) == 0 {
+		ss.notifyDeviceState(m.Sn, m.CType, "online", log)
+	}
+	if ss.Server.Queue != nil {
+		ss.Server.deliverQueued(m.Sn, log)
+	}
+	return true
+}
+
+// smarthomeRest forwards a command from a rest client to the device, or to
+// each device of a list or group, and waits for the answers.
+func (ss *smarthomeSession) smarthomeRest(m *smarthome.RestMessage, log *LogScope) {
+	origin := ss.BindDevice.Endpoint
+	if m.MultiTarget() {
+		onDone := func(reply *smarthome.MultiRestReply) {
+			origin.SendMessage(reply)
+		}
+		if err := ss.Server.fanOutRest(ss.BindSn, m, onDone, log); err != nil {
+			log.Access("smarthome", "REJECTED: rest %s to group %s: %s", m.Wsid, m.Group, err)
+			origin.SendMessage(err)
+		}
+		return
+	}
+	if !ss.Server.canCommand(ss.BindSn, m.Sn) {
+		log.Access("smarthome", "FORBIDDEN: rest %s from %s to sn %s", m.Wsid, ss.BindSn, m.Sn)
+		ss.Server.audit(&AuditRecord{From: ss.BindSn, To: m.Sn, Wsid: m.Wsid, Type: m.Type, Outcome: AuditForbidden}, m.Data, time.Time{})
+		ss.Server.Metrics.Dropped(m.Type)
+		origin.SendMessage(smarthome.NewError(smarthome.CodeForbidden, m.Wsid, "not allowed to command sn "+m.Sn))
+		return
+	}
+	onReply := func(reply *smarthome.ResponseMessage) {
+		origin.SendMessage(&smarthome.RestMessage{
+			Type: smarthome.TypeRest,
+			Wsid: reply.Wsid,
+			Data: reply.Data,
+		})
+	}
+	onTimeout := func() {
+		log.Access("smarthome", "TIMEOUT: sn %s did not answer rest %s", m.Sn, m.Wsid)
+		origin.SendMessage(smarthome.NewError(smarthome.CodeTimeout, m.Wsid, "sn "+m.Sn+" did not answer"))
+	}
+	if m.Persist && ss.Server.Devices.Lookup(m.Sn) == nil {
+		if err := ss.Server.queueRest(ss.BindSn, m, log); err != nil {
+			log.Access("smarthome", "REJECTED: persistent rest %s to sn %s: %s", m.Wsid, m.Sn, err)
+			origin.SendMessage(err)
+			return
+		}
+		origin.SendMessage(smarthome.NewDelivery(m.Wsid, m.Sn, smarthome.DeliveryQueued))
+		return
+	}
+	req := NewPendingRequest(m.Wsid, ss.BindSn, m.Sn, onReply, onTimeout)
+	if err := ss.Server.forwardRest(req, m.Data); err != nil {
+		log.Access("smarthome", "REJECTED: rest %s to sn %s: %s", m.Wsid, m.Sn, err)
+		origin.SendMessage(err)
+	}
+}
+
+// forwardRest sends a command to req.Target and registers req to receive the
+// reply. The returned error is a smarthome.ErrorMessage for the sender.
+func (h *WebsocketdServer) forwardRest(req *PendingRequest, data []byte) error {
+	record := func(outcome string, err error) {
+		r := &AuditRecord{From: req.From, To: req.Target, Wsid: req.Wsid, Type: smarthome.TypeRest, Outcome: outcome}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		h.audit(r, data, req.Sent)
+	}
+	onReply, onTimeout := req.onReply, req.onTimeout
+	req.onReply = func(reply *smarthome.ResponseMessage) {
+		record(AuditAnswered, nil)
+		onReply(reply)
+	}
+	req.onTimeout = func() {
+		record(AuditTimeout, nil)
+		onTimeout()
+	}
+
+	forward := h.Devices.Lookup(req.Target)
+	if forward == nil {
+		err := smarthome.NewError(smarthome.CodeTargetOffline, req.Wsid, "sn "+req.Target+" is not connected")
+		record(AuditOffline, err)
+		h.Metrics.Dropped(smarthome.TypeRest)
+		return err
+	}
+	if !h.Pending.Add(req, h.Config.ReplyTimeout) {
+		err := smarthome.NewError(smarthome.CodeDuplicateWsid, req.Wsid, "wsid "+req.Wsid+" is already waiting for a reply")
+		record(AuditRejected, err)
+		h.Metrics.Dropped(smarthome.TypeRest)
+		return err
+	}
+	sent := forward.Endpoint.SendMessage(&smarthome.RestMessage{
+		Type: smarthome.TypeRest,
+		Wsid: req.Wsid,
+		From: req.From,
+		Data: data,
+	})
+	if !sent {
+		h.Pending.Cancel(req)
+		err := smarthome.NewError(smarthome.CodeTargetOffline, req.Wsid, "sn "+req.Target+" is not reachable")
+		record(AuditOffline, err)
+		h.Metrics.Dropped(smarthome.TypeRest)
+		return err
+	}
+	h.Metrics.Routed(smarthome.TypeRest)
+	return nil
+}
+
+// queueRest stores persistent command m from sn from until its target
+// connects. The returned error is a smarthome.ErrorMessage for the sender.
+func (h *WebsocketdServer) queueRest(from string, m *smarthome.RestMessage, log *LogScope) error {
+	if h.Queue == nil {
+		return smarthome.NewError(smarthome.CodeQueueFailed, m.Wsid, "persistent commands are disabled")
+	}
+	if !h.Credentials.Known(m.Sn) {
+		return smarthome.NewError(smarthome.CodeTargetOffline, m.Wsid, "unknown sn "+m.Sn)
+	}
+	now := time.Now()
+	err := h.Queue.Push(&QueuedCommand{
+		Wsid:    m.Wsid,
+		From:    from,
+		Target:  m.Sn,
+		Data:    m.Data,
+		Queued:  now,
+		Expires: now.Add(h.Config.QueueTTL),
+	})
+	if err == QueueFullError {
+		log.Access("smarthome", "QUEUE FULL: rest %s from %s to sn %s", m.Wsid, from, m.Sn)
+		err = smarthome.NewError(smarthome.CodeQueueFailed, m.Wsid, "too many commands queued for sn "+m.Sn)
+		h.audit(&AuditRecord{From: from, To: m.Sn, Wsid: m.Wsid, Type: smarthome.TypeRest, Outcome: AuditRejected, Error: err.Error()}, m.Data, time.Time{})
+		return err
+	}
+	if err != nil {
+		log.Error("smarthome", "Could not queue rest %s for sn %s: %s", m.Wsid, m.Sn, err)
+		err = smarthome.NewError(smarthome.CodeQueueFailed, m.Wsid, "could not store command")
+		h.audit(&AuditRecord{From: from, To: m.Sn, Wsid: m.Wsid, Type: smarthome.TypeRest, Outcome: AuditRejected, Error: err.Error()}, m.Data, time.Time{})
+		return err
+	}
+	log.Access("smarthome", "QUEUED: rest %s from %s until sn %s connects", m.Wsid, from, m.Sn)
+	h.audit(&AuditRecord{From: from, To: m.Sn, Wsid: m.Wsid, Type: smarthome.TypeRest, Outcome: AuditQueued}, m.Data, time.Time{})
+
+	// the target may have connected while the command was being stored
+	if h.Devices.Lookup(m.Sn) != nil {
+		h.deliverQueued(m.Sn, log)
+	}
+	return nil
+}
+
+// deliverQueued sends commands queued for sn in order and tells their senders.
+// Each command is removed from the queue once it was sent or given up, so
+// commands that can not be sent because sn went away again stay queued. If
+// another call is delivering the commands of sn, it sends those queued since
+// as well.
+func (h *WebsocketdServer) deliverQueued(sn string, log *LogScope) {
+	for {
+		cmds, err := h.Queue.Take(sn)
+		if err != nil {
+			log.Error("smarthome", "Could not read queued commands for sn %s: %s", sn, err)
+			return
+		}
+		if len(cmds) == 0 {
+			return
+		}
+		delivered := h.deliverCommands(sn, cmds, log)
+		h.Queue.Release(sn)
+		if !delivered {
+			return
+		}
+	}
+}
+
+// deliverCommands sends cmds taken from the queue of sn. It returns false if
+// it stopped before the last one.
+func (h *WebsocketdServer) deliverCommands(sn string, cmds []*QueuedCommand, log *LogScope) bool {
+	now := time.Now()
+	for _, cmd := range cmds {
+		if now.After(cmd.Expires) {
+			log.Access("smarthome", "EXPIRED: queued rest %s from %s to sn %s", cmd.Wsid, cmd.From, sn)
+			h.sendTo(cmd.From, smarthome.NewDelivery(cmd.Wsid, sn, smarthome.DeliveryExpired))
+			if !h.removeQueued(sn, log) {
+				return false
+			}
+			continue
+		}
+
+		from, wsid := cmd.From, cmd.Wsid
+		onReply := func(reply *smarthome.ResponseMessage) {
+			h.sendTo(from, &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: reply.Wsid, Data: reply.Data})
+		}
+		onTimeout := func() {
+			log.Access("smarthome", "TIMEOUT: sn %s did not answer queued rest %s", sn, wsid)
+			h.sendTo(from, smarthome.NewError(smarthome.CodeTimeout, wsid, "sn "+sn+" did not answer"))
+		}
+		err := h.forwardRest(NewPendingRequest(cmd.Wsid, cmd.From, sn, onReply, onTimeout), cmd.Data)
+		if err != nil && smarthome.ErrorReply("", "", err).Code == smarthome.CodeTargetOffline {
+			return false
+		}
+		if !h.removeQueued(sn, log) {
+			return false
+		}
+		if err != nil {
+			log.Access("smarthome", "REJECTED: queued rest %s to sn %s: %s", cmd.Wsid, sn, err)
+			h.sendTo(cmd.From, err)
+			continue
+		}
+		log.Access("smarthome", "DELIVERED: queued rest %s from %s to sn %s", cmd.Wsid, cmd.From, sn)
+		h.sendTo(cmd.From, smarthome.NewDelivery(cmd.Wsid, sn, smarthome.DeliveryDelivered))
+	}
+	return true
+}
+
+// removeQueued removes the oldest command queued for sn. It returns false if
+// that failed, delivery then has to stop as the queue no longer starts with
+// the next command taken.
+func (h *WebsocketdServer) removeQueued(sn string, log *LogScope) bool {
+	if err := h.Queue.Remove(sn, 1); err != nil {
+		log.Error("smarthome", "Could not remove delivered command for sn %s: %s", sn, err)
+		return false
+	}
+	return true
+}
+
+// sendTo sends msg to the client connected as sn. It returns false if sn is
+// not connected.
+func (h *WebsocketdServer) sendTo(sn string, msg interface{}) bool {
+	entry := h.Devices.Lookup(sn)
+	if entry == nil {
+		return false
+	}
+	return entry.Endpoint.SendMessage(msg)
+}
+
+// smarthomeRoute handles a message of a type that is not built in according
+// to the routing table.
+func (ss *smarthomeSession) smarthomeRoute(m *smarthome.CustomMessage, log *LogScope) {
+	device := ss.BindDevice
+	action, matched := ss.Server.Routes.Lookup(m.Type, device.CType)
+	if !matched {
+		log.Access("smarthome", "UNROUTED: %s message from sn %s, default action %s", m.Type, device.Sn, action)
+	}
+
+	switch action {
+	case RouteReplyToFrom:
+		reply, err := m.Response()
+		if err != nil {
+			log.Access("smarthome", "REJECTED: %s", err)
+			device.Endpoint.SendMessage(err)
+			return
+		}
+		ss.smarthomeResponse(reply, log)
+	case RouteBroadcastToRest:
+		m.From = device.Sn
+		ss.Server.Metrics.Routed(m.Type)
+		for _, client := range ss.Server.Subscribers.Match(device.Sn, device.CType, m.Type) {
+			if client.CType == "rest" && ss.Server.canObserve(client.Sn, device.Sn) {
+				log.Debug("smarthome", "send %s message from %s to %s", m.Type, device.Sn, client.Sn)
+				client.Endpoint.SendMessage(m)
+			}
+		}
+	case RouteForwardToSn:
+		var err error
+		outcome := AuditDelivered
+		switch {
+		case m.Sn == "":
+			err = smarthome.NewError(smarthome.CodeBadMessage, m.Wsid, "missing sn")
+			outcome = AuditRejected
+		case !ss.Server.canCommand(device.Sn, m.Sn):
+			err = smarthome.NewError(smarthome.CodeForbidden, m.Wsid, "not allowed to command sn "+m.Sn)
+			outcome = AuditForbidden
+		case !ss.Server.sendTo(m.Sn, &smarthome.CustomMessage{Type: m.Type, Wsid: m.Wsid, From: device.Sn, Data: m.Data}):
+			err = smarthome.NewError(smarthome.CodeTargetOffline, m.Wsid, "sn "+m.Sn+" is not connected")
+			outcome = AuditOffline
+		}
+		r := &AuditRecord{From: device.Sn, To: m.Sn, Wsid: m.Wsid, Type: m.Type, Outcome: outcome}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		ss.Server.audit(r, m.Data, time.Time{})
+		if err != nil {
+			log.Access("smarthome", "REJECTED: %s message from sn %s to sn %s: %s", m.Type, device.Sn, m.Sn, err)
+			ss.Server.Metrics.Dropped(m.Type)
+			device.Endpoint.SendMessage(err)
+			return
+		}
+		ss.Server.Metrics.Routed(m.Type)
+	case RouteDrop:
+		log.Debug("smarthome", "dropped %s message from sn %s", m.Type, device.Sn)
+		ss.Server.Metrics.Dropped(m.Type)
+	default:
+		device.Endpoint.SendMessage(smarthome.NewError(smarthome.CodeUnknownType, m.Wsid, fmt.Sprintf("unknown message type %q", m.Type)))
+	}
+}
+
+// smarthomeResponse passes a device's answer back to whoever sent the command.
+// Replies nobody is waiting for are dropped.
+func (ss *smarthomeSession) smarthomeResponse(m *smarthome.ResponseMessage, log *LogScope) {
+	if !ss.Server.Pending.Resolve(ss.BindSn, m) {
+		log.Access("smarthome", "DROPPED: unsolicited %s reply %s from sn %s to %s", m.Type, m.Wsid, ss.BindSn, m.From)
+		ss.Server.Metrics.Dropped(m.Type)
+		return
+	}
+	ss.Server.Metrics.Routed(m.Type)
+}
+
+// smarthomeNotification publishes a device event. Clients may only publish
+// events about themselves, so the event is sent from the sn of this
+// connection whatever "from" it names.
+func (ss *smarthomeSession) smarthomeNotification(m *smarthome.NotificationMessage, log *LogScope) {
+	m.From = ss.BindSn
+	ss.Server.recordState(m)
+	ss.Server.publishNotification(m, ss.BindDevice.CType, log)
+}
+
+// recordState records m as the latest state of m.From. The state of sns
+// missing from the registry is not recorded.
+func (h *WebsocketdServer) recordState(m *smarthome.NotificationMessage) {
+	if h.Credentials.Known(m.From) {
+		h.States.Update(m)
+	}
+}
+
+// publishNotification sends m to the clients subscribed to it. Ctype is the
+// device type of m.From.
+func (h *WebsocketdServer) publishNotification(m *smarthome.NotificationMessage, ctype string, log *LogScope) {
+	h.Metrics.Routed(smarthome.TypeNotification)
+	if h.Rules != nil {
+		h.runRules(m, ctype, log)
+	}
+	for _, client := range h.Subscribers.Match(m.From, ctype, m.MsgType) {
+		if !h.canObserve(client.Sn, m.From) {
+			continue
+		}
+		log.Debug("smarthome", "send %s notification from %s to %s", m.MsgType, m.From, client.Sn)
+		client.Endpoint.SendMessage(m)
+	}
+	if h.MQTT != nil {
+		h.MQTT.Notify(m)
+	}
+}
+
+// smarthomeSubscribe adds or replaces a subscription of this client.
+func (ss *smarthomeSession) smarthomeSubscribe(m *smarthome.SubscribeMessage, log *LogScope) {
+	endpoint := ss.BindDevice.Endpoint
+	for _, sn := range m.Sns {
+		if !ss.Server.canObserve(ss.BindSn, sn) {
+			log.Access("smarthome", "FORBIDDEN: subscription %s of sn %s to sn %s", m.Wsid, ss.BindSn, sn)
+			endpoint.SendMessage(smarthome.NewError(smarthome.CodeForbidden, m.Wsid, "not allowed to observe sn "+sn))
+			return
+		}
+	}
+	if !ss.Server.Subscribers.Add(NewSubscription(ss.BindDevice, m)) {
+		log.Access("smarthome", "REJECTED: subscription %s of sn %s, limit reached", m.Wsid, ss.BindSn)
+		endpoint.SendMessage(smarthome.NewError(smarthome.CodeTooManySubscriptions, m.Wsid, "subscription limit reached"))
+		return
+	}
+	log.Access("smarthome", "SUBSCRIBED: sn %s, subscription %s: sns %v, devicetypes %v, msgtypes %v", ss.BindSn, m.Wsid, m.Sns, m.DeviceTypes, m.MsgTypes)
+	endpoint.SendMessage(&smarthome.SubscriptionReply{Type: smarthome.TypeSubscribe, Wsid: m.Wsid, Status: "ok"})
+}
+
+// smarthomeUnsubscribe cancels one or all subscriptions of this client.
+func (ss *smarthomeSession) smarthomeUnsubscribe(m *smarthome.UnsubscribeMessage, log *LogScope) {
+	removed := ss.Server.Subscribers.Remove(ss.BindDevice, m.Wsid)
+	log.Access("smarthome", "UNSUBSCRIBED: sn %s, %d subscriptions removed", ss.BindSn, removed)
+	status := "ok"
+	if removed == 0 {
+		status = "not_subscribed"
+	}
+	ss.BindDevice.Endpoint.SendMessage(&smarthome.SubscriptionReply{Type: smarthome.TypeUnsubscribe, Wsid: m.Wsid, Status: status})
+}
+
+// unbindDevice removes this connection from the device registry, drops its
+// subscriptions and tells subscribers that the device went offline.
+func (ss *smarthomeSession) unbindDevice(log *LogScope) {
+	device := ss.BindDevice
+	ss.BindDevice = nil
+	ss.BindSn = ""
+	ss.Server.Subscribers.Remove(device, "")
+	if !ss.Server.Devices.Unregister(device) {
+		log.Access("smarthome", "sn %s is still connected by another socket", device.Sn)
+		return
+	}
+	if device.CType != "rest" {
+		ss.notifyDeviceState(device.Sn, device.CType, "offline", log)
+	}
+	if !ss.Server.Credentials.Known(device.Sn) {
+		ss.Server.States.Forget(device.Sn)
+	}
+}
+
+// notifyDeviceState publishes devicestate notification about sn.
+func (ss *smarthomeSession) notifyDeviceState(sn, ctype, state string, log *LogScope) {
+	m := smarthome.NewDeviceStateNotification(sn, ctype, state)
+	ss.Server.recordState(m)
+	ss.Server.publishNotification(m, ctype, log)
+}
@@ -0,0 +1,755 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+	"golang.org/x/net/websocket"
+)
+
+const testBrokerRegistry = `
+router-1  00:11:22:33:44:55  routersecret
+tv-1      00:11:22:33:44:66  tvsecret
+app-1     -                  appsecret
+app-2     -                  appsecret
+`
+
+// testAPIToken is the HTTP API token of test brokers.
+const testAPIToken = "apitoken"
+
+// tempDir creates a temporary directory and returns it with a function
+// removing it.
+func tempDir(t *testing.T, name string) (string, func()) {
+	dir, err := ioutil.TempDir("", "websocketd-"+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func testLogScope() *LogScope {
+	return RootLogScope(LogNone, func(*LogScope, LogLevel, string, string, string, ...interface{}) {})
+}
+
+// testBroker runs a smarthome WebsocketdServer on a local port.
+type testBroker struct {
+	t      *testing.T
+	server *WebsocketdServer
+	http   *httptest.Server
+}
+
+func newTestBroker(t *testing.T, config *Config) *testBroker {
+	credentials, err := ParseDeviceCredentials(strings.NewReader(testBrokerRegistry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Smarthome = true
+	if config.TokenTTL == 0 {
+		config.TokenTTL = time.Hour
+	}
+	if config.ReplyTimeout == 0 {
+		config.ReplyTimeout = time.Second
+	}
+	if config.QueueTTL == 0 {
+		config.QueueTTL = time.Hour
+	}
+	if config.APIToken == "" {
+		config.APIToken = testAPIToken
+	}
+	server := NewWebsocketdServer(config, testLogScope(), 0)
+	server.Credentials = credentials
+	return &testBroker{t: t, server: server, http: httptest.NewServer(server)}
+}
+
+func (b *testBroker) Close() {
+	b.http.Close()
+}
+
+// dial opens a connection offering the given subprotocols.
+func (b *testBroker) dial(subprotocols ...string) *testClient {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(b.http.URL, "http")+"/", b.http.URL)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	config.Protocol = subprotocols
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return &testClient{t: b.t, ws: ws}
+}
+
+// connect dials the broker and performs auth and connect as sn.
+func (b *testBroker) connect(sn, mac, secret, ctype string) *testClient {
+	return b.login(b.dial(), sn, mac, secret, ctype)
+}
+
+// login performs auth and connect as sn on c.
+func (b *testBroker) login(c *testClient, sn, mac, secret, ctype string) *testClient {
+	c.send(map[string]string{"type": "auth", "sn": sn, "mac": mac, "secret": secret})
+	auth := c.receive()
+	token, _ := auth["token"].(string)
+	if token == "" {
+		b.t.Fatalf("auth as %s failed: %v", sn, auth)
+	}
+	c.send(map[string]string{"type": "connect", "sn": sn, "token": token, "c_type": ctype})
+	if reply := c.receive(); reply["message"] != "connected" {
+		b.t.Fatalf("connect as %s failed: %v", sn, reply)
+	}
+	if ctype == "rest" {
+		c.snapshot = c.receiveType("snapshot")
+	}
+	return c
+}
+
+// waitFor polls until cond holds, failing the test after a second.
+func (b *testBroker) waitFor(what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			b.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type testClient struct {
+	t        *testing.T
+	ws       *websocket.Conn
+	snapshot map[string]interface{} // received by rest clients on connect
+}
+
+func (c *testClient) send(msg interface{}) {
+	data, _ := json.Marshal(msg)
+	if err := websocket.Message.Send(c.ws, string(data)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// subscribe sends subscription request and waits for its acknowledgement.
+func (c *testClient) subscribe(msg map[string]interface{}) {
+	msg["type"] = "subscribe"
+	c.send(msg)
+	if reply := c.receiveType("subscribe"); reply["status"] != "ok" {
+		c.t.Fatalf("subscribe %v failed: %v", msg, reply)
+	}
+}
+
+func (c *testClient) sendRaw(msg string) {
+	if err := websocket.Message.Send(c.ws, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) receive() map[string]interface{} {
+	c.ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var data string
+	if err := websocket.Message.Receive(c.ws, &data); err != nil {
+		c.t.Fatalf("receive: %s", err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		c.t.Fatalf("received invalid JSON %q", data)
+	}
+	return msg
+}
+
+// receiveType skips messages of other types, such as devicestate notifications.
+func (c *testClient) receiveType(msgtype string) map[string]interface{} {
+	for {
+		if msg := c.receive(); msg["type"] == msgtype {
+			return msg
+		}
+	}
+}
+
+// expectClosed checks that the broker closed the connection.
+func (c *testClient) expectClosed() {
+	c.ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var data string
+	for {
+		err := websocket.Message.Receive(c.ws, &data)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *testClient) Close() {
+	c.ws.Close()
+}
+
+func expectError(t *testing.T, msg map[string]interface{}, code, wsid string) {
+	if msg["type"] != "error" || msg["code"] != code || (wsid != "" && msg["wsid"] != wsid) {
+		t.Errorf("expected %s error for wsid %q, got %v", code, wsid, msg)
+	}
+}
+
+func TestSmarthomeRejectsBadCredentials(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	c := b.dial()
+	c.send(map[string]string{"type": "auth", "sn": "router-1", "mac": "00:11:22:33:44:55", "secret": "guess"})
+	expectError(t, c.receive(), "auth_failed", "")
+	c.expectClosed()
+
+	c = b.dial()
+	c.send(map[string]string{"type": "connect", "sn": "router-1", "token": "12345678", "c_type": "router"})
+	expectError(t, c.receive(), "invalid_token", "")
+	c.expectClosed()
+
+	// the broker's own identities are refused before the token is checked
+	for _, sn := range []string{APISn, MQTTSn, RulesSn} {
+		c = b.dial()
+		c.send(map[string]string{"type": "connect", "sn": sn, "token": "12345678", "c_type": "rest"})
+		expectError(t, c.receive(), "bad_message", "")
+		c.expectClosed()
+	}
+
+	c = b.dial()
+	c.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{}})
+	expectError(t, c.receive(), "not_connected", "")
+	c.expectClosed()
+
+	if b.server.Devices.Len() != 0 {
+		t.Error("rejected clients must not be registered")
+	}
+}
+
+func TestSmarthomeBadMessageKeepsConnection(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	app.sendRaw(`{"type":"rest","wsid":"w1","sn":"router-1","data":"oops"}`)
+	expectError(t, app.receive(), "bad_message", "w1")
+	app.sendRaw(`not json`)
+	expectError(t, app.receive(), "bad_message", "")
+
+	// still usable afterwards
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w2", "sn": "router-1", "data": map[string]string{}})
+	expectError(t, app.receive(), "target_offline", "w2")
+}
+
+func TestSmarthomeRestRoundTrip(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{"cmd": "status"}})
+	cmd := router.receiveType("rest")
+	if cmd["wsid"] != "w1" || cmd["from"] != "app-1" {
+		t.Fatalf("unexpected command %v", cmd)
+	}
+
+	// a reply that nobody asked for is dropped
+	router.send(map[string]interface{}{"type": "router", "wsid": "other", "from": "app-1", "data": map[string]string{}})
+	router.send(map[string]interface{}{"type": "router", "wsid": "w1", "from": "app-1", "data": map[string]string{"status": "ok"}})
+
+	reply := app.receiveType("rest")
+	if reply["wsid"] != "w1" || reply["data"].(map[string]interface{})["status"] != "ok" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	if b.server.Pending.Len() != 0 {
+		t.Errorf("%d requests still pending", b.server.Pending.Len())
+	}
+}
+
+func TestSmarthomeRestTimeout(t *testing.T) {
+	b := newTestBroker(t, &Config{ReplyTimeout: 50 * time.Millisecond})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{}})
+	router.receiveType("rest")
+	expectError(t, app.receiveType("error"), "timeout", "w1")
+
+	// the late reply is dropped instead of being delivered
+	router.send(map[string]interface{}{"type": "router", "wsid": "w1", "from": "app-1", "data": map[string]string{}})
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w2", "sn": "tv-1", "data": map[string]string{}})
+	expectError(t, app.receive(), "target_offline", "w2")
+}
+
+func TestSmarthomeRestDuplicateWsid(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{}})
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{}})
+	expectError(t, app.receiveType("error"), "duplicate_wsid", "w1")
+}
+
+func TestSmarthomePersistentRest(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	queue, cleanup := tempQueue(t)
+	defer cleanup()
+	b.server.Queue = queue
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "persist": true, "data": map[string]string{"cmd": "first"}})
+	if msg := app.receive(); msg["type"] != "delivery" || msg["wsid"] != "w1" || msg["status"] != "queued" {
+		t.Fatalf("expected queued delivery status, got %v", msg)
+	}
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w2", "sn": "router-1", "persist": true, "data": map[string]string{"cmd": "second"}})
+	app.receiveType("delivery")
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w3", "sn": "nobody", "persist": true, "data": map[string]string{}})
+	expectError(t, app.receive(), "target_offline", "w3")
+	queue.Limit = 2
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w4", "sn": "router-1", "persist": true, "data": map[string]string{}})
+	expectError(t, app.receive(), "queue_failed", "w4")
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	for _, wsid := range []string{"w1", "w2"} {
+		cmd := router.receiveType("rest")
+		if cmd["wsid"] != wsid || cmd["from"] != "app-1" || cmd["persist"] != nil {
+			t.Fatalf("expected queued command %s, got %v", wsid, cmd)
+		}
+		if msg := app.receiveType("delivery"); msg["wsid"] != wsid || msg["status"] != "delivered" {
+			t.Errorf("expected delivered status for %s, got %v", wsid, msg)
+		}
+	}
+
+	router.send(map[string]interface{}{"type": "router", "wsid": "w1", "from": "app-1", "data": map[string]string{"status": "ok"}})
+	if reply := app.receiveType("rest"); reply["wsid"] != "w1" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	if n, _ := queue.Len("router-1"); n != 0 {
+		t.Errorf("%d commands left in queue", n)
+	}
+}
+
+func TestSmarthomePersistentRestExpires(t *testing.T) {
+	b := newTestBroker(t, &Config{QueueTTL: time.Millisecond})
+	defer b.Close()
+	queue, cleanup := tempQueue(t)
+	defer cleanup()
+	b.server.Queue = queue
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "persist": true, "data": map[string]string{}})
+	app.receiveType("delivery")
+	time.Sleep(5 * time.Millisecond)
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	if msg := app.receiveType("delivery"); msg["wsid"] != "w1" || msg["status"] != "expired" {
+		t.Errorf("expected expired status, got %v", msg)
+	}
+}
+
+func TestSmarthomePersistentRestDisabled(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "persist": true, "data": map[string]string{}})
+	expectError(t, app.receive(), "queue_failed", "w1")
+}
+
+func TestSmarthomeStateSnapshot(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "router-1", "data": map[string]string{"msgtype": "wifi", "ssid": "old"}})
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n2", "from": "router-1", "data": map[string]string{"msgtype": "wifi", "ssid": "new"}})
+	b.waitFor("notifications", func() bool {
+		states := b.server.States.Device("router-1")
+		return len(states) == 2 && strings.Contains(string(states[1].Data), "new")
+	})
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	notifications := app.snapshot["notifications"].([]interface{})
+	if len(notifications) != 2 {
+		t.Fatalf("expected devicestate and wifi in snapshot, got %v", app.snapshot)
+	}
+	devicestate := notifications[0].(map[string]interface{})
+	wifi := notifications[1].(map[string]interface{})
+	if devicestate["from"] != "router-1" || devicestate["data"].(map[string]interface{})["state"] != "online" {
+		t.Errorf("unexpected devicestate %v", devicestate)
+	}
+	if wifi["wsid"] != "n2" || wifi["data"].(map[string]interface{})["ssid"] != "new" {
+		t.Errorf("expected latest wifi notification, got %v", wifi)
+	}
+}
+
+func TestSmarthomeStateOnlyFromOwnSn(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	defer tv.Close()
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "router-1", "data": map[string]string{"msgtype": "wifi"}})
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n2", "from": "tv-1", "data": map[string]string{"msgtype": "volume"}})
+	// devicestate, volume and the wifi notification tv-1 sent about itself
+	b.waitFor("notification", func() bool { return len(b.server.States.Device("tv-1")) == 3 })
+	if states := b.server.States.Device("router-1"); len(states) != 0 {
+		t.Errorf("tv-1 recorded state of router-1: %v", states)
+	}
+}
+
+func TestSmarthomeNotificationFromSpoofed(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	acl, err := ParseACL(strings.NewReader("app-1 observe router-1\napp-2 observe tv-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Authorizer = acl
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	defer tv.Close()
+	routerWatcher := b.connect("app-1", "-", "appsecret", "rest")
+	defer routerWatcher.Close()
+	routerWatcher.subscribe(map[string]interface{}{"wsid": "s1"})
+	tvWatcher := b.connect("app-2", "-", "appsecret", "rest")
+	defer tvWatcher.Close()
+	tvWatcher.subscribe(map[string]interface{}{"wsid": "s1"})
+
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "router-1", "data": map[string]string{"msgtype": "devicestate", "state": "offline"}})
+	if m := tvWatcher.receiveType("notification"); m["wsid"] != "n1" || m["from"] != "tv-1" {
+		t.Errorf("expected notification from tv-1, got %v", m)
+	}
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n2", "from": "router-1", "data": map[string]string{"msgtype": "wifi"}})
+	if m := routerWatcher.receiveType("notification"); m["wsid"] != "n2" {
+		t.Errorf("app-1 received spoofed notification %v", m)
+	}
+}
+
+func TestSmarthomeSubscriptions(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	all := b.connect("app-1", "-", "appsecret", "rest")
+	defer all.Close()
+	all.subscribe(map[string]interface{}{"wsid": "s1"})
+	tvOnly := b.connect("app-2", "-", "appsecret", "rest")
+	defer tvOnly.Close()
+	tvOnly.subscribe(map[string]interface{}{"wsid": "s1", "sns": []string{"tv-1"}})
+	tvOnly.subscribe(map[string]interface{}{"wsid": "s2", "devicetypes": []string{"router"}, "msgtypes": []string{"devicestate"}})
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "router-1", "data": map[string]string{"msgtype": "wifi"}})
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	defer tv.Close()
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n2", "from": "tv-1", "data": map[string]string{"msgtype": "channel"}})
+
+	expect := func(c *testClient, from, msgtype string) {
+		msg := c.receiveType("notification")
+		data := msg["data"].(map[string]interface{})
+		if msg["from"] != from || data["msgtype"] != msgtype {
+			t.Errorf("expected %s notification from %s, got %v", msgtype, from, msg)
+		}
+	}
+	expect(all, "router-1", "devicestate")
+	expect(all, "router-1", "wifi")
+	expect(all, "tv-1", "devicestate")
+	expect(all, "tv-1", "channel")
+	// no router wifi notification for app-2
+	expect(tvOnly, "router-1", "devicestate")
+	expect(tvOnly, "tv-1", "devicestate")
+	expect(tvOnly, "tv-1", "channel")
+
+	tvOnly.send(map[string]string{"type": "unsubscribe", "wsid": "s1"})
+	if reply := tvOnly.receiveType("unsubscribe"); reply["status"] != "ok" {
+		t.Errorf("unexpected unsubscribe reply %v", reply)
+	}
+	tvOnly.send(map[string]string{"type": "unsubscribe", "wsid": "s1"})
+	if reply := tvOnly.receiveType("unsubscribe"); reply["status"] != "not_subscribed" {
+		t.Errorf("unexpected second unsubscribe reply %v", reply)
+	}
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n3", "from": "tv-1", "data": map[string]string{"msgtype": "channel"}})
+	expect(all, "tv-1", "channel")
+	router.Close()
+	expect(tvOnly, "router-1", "devicestate")
+}
+
+func TestSmarthomeTakeoverReplace(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.subscribe(map[string]interface{}{"wsid": "s1", "msgtypes": []string{"devicestate"}})
+
+	old := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer old.Close()
+	app.receiveType("notification") // online
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+
+	old.expectClosed()
+	if status, reason := old.ws.CloseStatus(); status != CloseReplaced || reason == "" {
+		t.Errorf("expected close status %d with reason, got %d %q", CloseReplaced, status, reason)
+	}
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{}})
+	router.receiveType("rest")
+	router.send(map[string]interface{}{"type": "router", "wsid": "w1", "from": "app-1", "data": map[string]string{}})
+	// the evicted connection must not report the router offline
+	if msg := app.receive(); msg["type"] != "rest" || msg["wsid"] != "w1" {
+		t.Errorf("expected reply, got %v", msg)
+	}
+	if b.server.Devices.Len() != 2 || b.server.Devices.Takeovers().Replaced != 1 {
+		t.Errorf("unexpected registry state: %d connections, %+v", b.server.Devices.Len(), b.server.Devices.Takeovers())
+	}
+}
+
+func TestSmarthomeTakeoverReject(t *testing.T) {
+	b := newTestBroker(t, &Config{DuplicateSn: "reject"})
+	defer b.Close()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+
+	c := b.dial()
+	c.send(map[string]string{"type": "auth", "sn": "router-1", "mac": "00:11:22:33:44:55", "secret": "routersecret"})
+	token := c.receive()["token"].(string)
+	c.send(map[string]string{"type": "connect", "sn": "router-1", "token": token, "c_type": "router"})
+	expectError(t, c.receive(), "sn_in_use", "")
+	c.expectClosed()
+
+	if b.server.Devices.Lookup("router-1") == nil || b.server.Devices.Takeovers().Rejected != 1 {
+		t.Error("rejected takeover must keep the first connection")
+	}
+}
+
+func TestSmarthomeTakeoverAllowMulti(t *testing.T) {
+	b := newTestBroker(t, &Config{DuplicateSn: "allow-multi"})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.subscribe(map[string]interface{}{"wsid": "s1", "msgtypes": []string{"devicestate"}})
+
+	first := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer first.Close()
+	app.receiveType("notification") // online
+	second := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{}})
+	if cmd := second.receiveType("rest"); cmd["wsid"] != "w1" {
+		t.Errorf("expected command on newest connection, got %v", cmd)
+	}
+
+	second.Close()
+	b.waitFor("second to disconnect", func() bool { return b.server.Devices.Len() == 2 })
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w2", "sn": "router-1", "data": map[string]string{}})
+	if cmd := first.receiveType("rest"); cmd["wsid"] != "w2" {
+		t.Errorf("expected command on remaining connection, got %v", cmd)
+	}
+
+	first.Close()
+	msg := app.receiveType("notification")
+	if msg["data"].(map[string]interface{})["state"] != "offline" {
+		t.Errorf("expected offline after last connection closed, got %v", msg)
+	}
+}
+
+func TestSmarthomeKeepalive(t *testing.T) {
+	b := newTestBroker(t, &Config{PingInterval: 20 * time.Millisecond, PingMisses: 2})
+	defer b.Close()
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.subscribe(map[string]interface{}{"wsid": "s1", "msgtypes": []string{"devicestate"}})
+
+	// a live client answers pings while it reads
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	defer tv.Close()
+	go func() {
+		var data string
+		for websocket.Message.Receive(tv.ws, &data) == nil {
+		}
+	}()
+	app.receiveType("notification") // tv online
+
+	// a dead client does not read, so it never answers
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app.receiveType("notification") // router online
+
+	msg := app.receiveType("notification")
+	if msg["from"] != "router-1" || msg["data"].(map[string]interface{})["state"] != "offline" {
+		t.Fatalf("expected router to be reported offline, got %v", msg)
+	}
+	if b.server.Devices.Lookup("tv-1") == nil {
+		t.Error("live client was dropped")
+	}
+}
+
+func TestSmarthomeRoutingTable(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	routes := `{"routes": [
+		{"type": "curtain", "action": "reply-to-from"},
+		{"type": "alarm", "action": "broadcast-to-rest"},
+		{"type": "wake", "c_type": "rest", "action": "forward-to-sn"},
+		{"type": "debug", "action": "drop"}
+	]}`
+	table, err := ParseRoutingTable(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Routes = table
+
+	curtain := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "curtain")
+	defer curtain.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	app.subscribe(map[string]interface{}{"wsid": "s1", "sns": []string{"tv-1"}})
+
+	// reply-to-from
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "tv-1", "data": map[string]string{}})
+	curtain.receiveType("rest")
+	curtain.send(map[string]interface{}{"type": "curtain", "wsid": "w1", "from": "app-1", "data": map[string]int{"open": 50}})
+	if reply := app.receiveType("rest"); reply["wsid"] != "w1" {
+		t.Errorf("expected curtain reply, got %v", reply)
+	}
+
+	// drop, then reject by default
+	curtain.send(map[string]interface{}{"type": "debug", "wsid": "d1"})
+	curtain.send(map[string]interface{}{"type": "mystery", "wsid": "m1"})
+	expectError(t, curtain.receive(), "unknown_type", "m1")
+
+	// broadcast-to-rest, the sender can not pretend to be another sn
+	curtain.send(map[string]interface{}{"type": "alarm", "wsid": "a1", "from": "router-1", "data": map[string]string{"reason": "blocked"}})
+	if msg := app.receiveType("alarm"); msg["from"] != "tv-1" || msg["wsid"] != "a1" {
+		t.Errorf("unexpected alarm %v", msg)
+	}
+
+	// forward-to-sn
+	app.send(map[string]interface{}{"type": "wake", "wsid": "k1", "sn": "tv-1", "data": map[string]string{}})
+	if msg := curtain.receiveType("wake"); msg["from"] != "app-1" || msg["wsid"] != "k1" {
+		t.Errorf("unexpected forwarded message %v", msg)
+	}
+	app.send(map[string]interface{}{"type": "wake", "wsid": "k2", "sn": "router-1"})
+	expectError(t, app.receiveType("error"), "target_offline", "k2")
+}
+
+func TestSmarthomeBinaryFrames(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	camera := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "camera")
+	defer camera.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	// the envelope names the target on the way in and the sender on the way out
+	snapshot := []byte("\x05app-1\x04jpg1\xff\xd8\xff\x00")
+	if err := websocket.Message.Send(camera.ws, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	app.ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := websocket.Message.Receive(app.ws, &data); err != nil {
+		t.Fatal(err)
+	}
+	if want := "\x04tv-1\x04jpg1\xff\xd8\xff\x00"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+
+	// text messages keep working after binary frames
+	websocket.Message.Send(app.ws, []byte("\x08router-1\x02b1"))
+	expectError(t, app.receive(), "target_offline", "b1")
+	websocket.Message.Send(app.ws, []byte("\x08router"))
+	expectError(t, app.receive(), "bad_message", "")
+
+	acl, err := ParseACL(strings.NewReader("app-1 command router-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Authorizer = acl
+	websocket.Message.Send(camera.ws, snapshot)
+	expectError(t, camera.receive(), "forbidden", "jpg1")
+}
+
+func TestSmarthomeSubprotocols(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	router := b.dial(smarthome.SubprotocolV1, smarthome.SubprotocolV2)
+	defer router.Close()
+	if protocol := router.ws.Config().Protocol; len(protocol) != 1 || protocol[0] != smarthome.SubprotocolV2 {
+		t.Fatalf("selected %v", protocol)
+	}
+	b.login(router, "router-1", "00:11:22:33:44:55", "routersecret", "router")
+	tv := b.dial("smarthome.v9")
+	defer tv.Close()
+	b.login(tv, "tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	if _, ok := app.snapshot["ts"]; ok {
+		t.Errorf("legacy client got ts: %v", app.snapshot)
+	}
+
+	// v2 devices answer with "response" and get timestamped messages
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{"cmd": "status"}})
+	cmd := router.receiveType("rest")
+	if ts, _ := cmd["ts"].(float64); ts <= 0 || cmd["wsid"] != "w1" {
+		t.Fatalf("unexpected command %v", cmd)
+	}
+	router.send(map[string]interface{}{"type": "response", "wsid": "w1", "from": "app-1", "data": map[string]string{"status": "ok"}})
+	reply := app.receiveType("rest")
+	if reply["wsid"] != "w1" || reply["data"].(map[string]interface{})["status"] != "ok" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	router.send(map[string]interface{}{"type": "response", "wsid": "w2", "data": map[string]string{}})
+	expectError(t, router.receiveType("error"), "bad_message", "w2")
+
+	// clients offering no known subprotocol speak the legacy format
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w3", "sn": "tv-1", "data": map[string]string{"cmd": "status"}})
+	if cmd := tv.receiveType("rest"); cmd["wsid"] != "w3" || cmd["ts"] != nil {
+		t.Errorf("unexpected command %v", cmd)
+	}
+	tv.send(map[string]interface{}{"type": "tv", "wsid": "w3", "from": "app-1", "data": map[string]string{}})
+	if reply := app.receiveType("rest"); reply["wsid"] != "w3" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+
+	_, device := b.request("GET", "/api/devices/router-1", "")
+	if device["subprotocol"] != smarthome.SubprotocolV2 {
+		t.Errorf("router-1 listed as %v", device)
+	}
+	_, device = b.request("GET", "/api/devices/tv-1", "")
+	if device["subprotocol"] != "" {
+		t.Errorf("tv-1 listed as %v", device)
+	}
+}
@@ -0,0 +1,490 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// MQTTSn prefixes the identities of MQTT clients, see MQTTIdentity.
+const MQTTSn = "mqtt"
+
+// mqttConnectTimeout limits how long a new connection may take to send
+// CONNECT.
+const mqttConnectTimeout = 10 * time.Second
+
+// mqttQueueLen is the number of packets queued for a client before further
+// ones are dropped.
+const mqttQueueLen = 256
+
+var mqttWsidSeq uint64
+
+// MQTTIdentity returns the identity of the MQTT clients logged in as
+// username: the sn they send commands as and their identity in the access
+// list.
+func MQTTIdentity(username string) string {
+	return MQTTSn + ":" + username
+}
+
+// MQTTBridge is an embedded MQTT 3.1.1 server exposing the smarthome broker
+// to MQTT clients. It publishes
+//
+//	devices/{sn}/online                  "true" or "false", retained
+//	devices/{sn}/notification/{msgtype}  notifications sent by sn
+//	devices/{sn}/response/{wsid}         answers to commands
+//	devices/{sn}/response                errors of commands without usable wsid
+//
+// and sends the JSON {"wsid":...,"data":...,"persist":...} published to
+// devices/{sn}/command as rest command to sn. Messages are delivered with
+// QoS 0; clients may publish with QoS 0, 1 or 2. Sessions are not kept
+// between connections. Clients log in with a username and password of
+// MQTTUsers and only receive the topics of sns their MQTTIdentity may
+// observe, and the answers to their own commands.
+type MQTTBridge struct {
+	server *WebsocketdServer
+	users  *MQTTUsers
+	log    *LogScope
+
+	mutex    sync.Mutex
+	clients  map[*mqttClient]bool
+	retained map[string]*mqttRetained // by topic
+}
+
+// mqttRetained is a retained message about sn.
+type mqttRetained struct {
+	sn      string
+	payload []byte
+}
+
+// mqttClient is a connected MQTT client.
+type mqttClient struct {
+	id       string
+	identity string // MQTTIdentity of the user
+	conn     net.Conn
+	outgoing chan []byte
+	done     chan struct{}
+	filters  map[string]bool // subscriptions, guarded by MQTTBridge.mutex
+}
+
+// NewMQTTBridge creates a bridge accepting the clients that log in as one of
+// users.
+func NewMQTTBridge(server *WebsocketdServer, users *MQTTUsers, log *LogScope) *MQTTBridge {
+	return &MQTTBridge{
+		server:   server,
+		users:    users,
+		log:      log,
+		clients:  make(map[*mqttClient]bool),
+		retained: make(map[string]*mqttRetained),
+	}
+}
+
+// ListenAndServe accepts MQTT connections on the TCP address addr. It only
+// returns on error.
+func (b *MQTTBridge) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(l)
+}
+
+// Serve accepts MQTT connections on l until it fails.
+func (b *MQTTBridge) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go b.serveConn(conn)
+	}
+}
+
+// MQTTUsers holds the usernames and passwords MQTT clients log in with.
+type MQTTUsers struct {
+	passwords map[string]string
+}
+
+// LoadMQTTUsers reads the MQTT users from file.
+func LoadMQTTUsers(path string) (*MQTTUsers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMQTTUsers(f)
+}
+
+// ParseMQTTUsers reads MQTT users. Every non-empty line that is not a #
+// comment holds whitespace separated username and password. Usernames are
+// limited to the characters of sns.
+func ParseMQTTUsers(r io.Reader) (*MQTTUsers, error) {
+	u := &MQTTUsers{passwords: make(map[string]string)}
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected username and password", lineno)
+		}
+		if !smarthome.ValidSn(MQTTIdentity(fields[0])) {
+			return nil, fmt.Errorf("line %d: invalid username %s", lineno, fields[0])
+		}
+		if _, ok := u.passwords[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate username %s", lineno, fields[0])
+		}
+		u.passwords[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Len returns the number of users.
+func (u *MQTTUsers) Len() int {
+	return len(u.passwords)
+}
+
+// Authenticate reports whether password is the one of username. It does not
+// take less time for unknown usernames. Nil users accept nobody.
+func (u *MQTTUsers) Authenticate(username string, password []byte) bool {
+	if u == nil {
+		return false
+	}
+	expected, ok := u.passwords[username]
+	match := subtle.ConstantTimeCompare([]byte(expected), password) == 1
+	return ok && match
+}
+
+func (b *MQTTBridge) serveConn(conn net.Conn) {
+	log := b.log.NewLevel(b.log.LogFunc)
+	log.Associate("remote", conn.RemoteAddr().String())
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	p, err := readMQTTPacket(r)
+	if err != nil || p.Type != mqttConnect {
+		log.Access("mqtt", "REJECTED: expected CONNECT")
+		return
+	}
+	connect, err := parseMQTTConnect(p)
+	if err != nil {
+		log.Access("mqtt", "REJECTED: %s", err)
+		return
+	}
+	code := byte(mqttAccepted)
+	switch {
+	case connect.Level != 4:
+		code = mqttBadProtocolVersion
+	case connect.ClientId == "" && !connect.CleanSession:
+		code = mqttIdentifierRejected
+	case connect.Username == "" || connect.Password == nil:
+		code = mqttNotAuthorized
+	case !b.users.Authenticate(connect.Username, connect.Password):
+		code = mqttBadCredentials
+	}
+	if code != mqttAccepted {
+		log.Access("mqtt", "REJECTED: client %q, user %q, protocol level %d, CONNACK %d", connect.ClientId, connect.Username, connect.Level, code)
+		conn.Write((&mqttPacket{Type: mqttConnack, Body: []byte{0, code}}).Bytes())
+		return
+	}
+
+	c := &mqttClient{
+		id:       connect.ClientId,
+		identity: MQTTIdentity(connect.Username),
+		conn:     conn,
+		outgoing: make(chan []byte, mqttQueueLen),
+		done:     make(chan struct{}),
+		filters:  make(map[string]bool),
+	}
+	log.Associate("client", c.id)
+	c.send(&mqttPacket{Type: mqttConnack, Body: []byte{0, mqttAccepted}}, log)
+	go c.write(log)
+	b.mutex.Lock()
+	b.clients[c] = true
+	b.mutex.Unlock()
+	log.Access("mqtt", "CONNECTED: client %q, user %q", c.id, connect.Username)
+
+	defer func() {
+		b.mutex.Lock()
+		delete(b.clients, c)
+		b.mutex.Unlock()
+		close(c.done)
+		log.Access("mqtt", "DISCONNECTED: client %q", c.id)
+	}()
+
+	for {
+		if connect.KeepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(connect.KeepAlive) * 1500 * time.Millisecond))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			log.Debug("mqtt", "Cannot receive: %s", err)
+			return
+		}
+		if !b.handle(c, p, log) {
+			return
+		}
+	}
+}
+
+// handle runs packet p from client c and returns false if the connection
+// has to be closed.
+func (b *MQTTBridge) handle(c *mqttClient, p *mqttPacket, log *LogScope) bool {
+	switch p.Type {
+	case mqttPublish:
+		m, err := parseMQTTPublish(p)
+		if err != nil {
+			log.Access("mqtt", "REJECTED: PUBLISH: %s", err)
+			return false
+		}
+		switch m.Qos {
+		case 1:
+			c.send(&mqttPacket{Type: mqttPuback, Body: appendMQTTUint16(nil, m.PacketId)}, log)
+		case 2:
+			c.send(&mqttPacket{Type: mqttPubrec, Body: appendMQTTUint16(nil, m.PacketId)}, log)
+		}
+		b.received(c, m, log)
+	case mqttPubrel:
+		c.send(&mqttPacket{Type: mqttPubcomp, Body: p.Body}, log)
+	case mqttPuback, mqttPubrec, mqttPubcomp:
+		// the bridge publishes with QoS 0 only
+	case mqttSubscribe:
+		id, filters, err := parseMQTTSubscribe(p)
+		if err != nil {
+			log.Access("mqtt", "REJECTED: SUBSCRIBE: %s", err)
+			return false
+		}
+		b.subscribe(c, id, filters, log)
+	case mqttUnsubscribe:
+		id, filters, err := parseMQTTSubscribe(p)
+		if err != nil {
+			log.Access("mqtt", "REJECTED: UNSUBSCRIBE: %s", err)
+			return false
+		}
+		b.mutex.Lock()
+		for _, filter := range filters {
+			delete(c.filters, filter)
+		}
+		b.mutex.Unlock()
+		c.send(&mqttPacket{Type: mqttUnsuback, Body: appendMQTTUint16(nil, id)}, log)
+	case mqttPingreq:
+		c.send(&mqttPacket{Type: mqttPingresp}, log)
+	case mqttDisconnect:
+		return false
+	default:
+		log.Access("mqtt", "REJECTED: unexpected packet type %d", p.Type)
+		return false
+	}
+	return true
+}
+
+// subscribe adds filters to the subscriptions of c, acknowledges them and
+// sends the retained messages they match.
+func (b *MQTTBridge) subscribe(c *mqttClient, id uint16, filters []string, log *LogScope) {
+	codes := appendMQTTUint16(nil, id)
+	retained := []*mqttPublishPacket{}
+	b.mutex.Lock()
+	for _, filter := range filters {
+		if !validMQTTFilter(filter) {
+			codes = append(codes, 0x80)
+			continue
+		}
+		codes = append(codes, 0)
+		c.filters[filter] = true
+		for topic, r := range b.retained {
+			if mqttTopicMatches(filter, topic) && b.server.canObserve(c.identity, r.sn) {
+				retained = append(retained, &mqttPublishPacket{Topic: topic, Retain: true, Payload: r.payload})
+			}
+		}
+	}
+	b.mutex.Unlock()
+	log.Access("mqtt", "SUBSCRIBED: client %q to %v", c.id, filters)
+	c.send(&mqttPacket{Type: mqttSuback, Body: codes}, log)
+	for _, m := range retained {
+		c.send(m.Packet(), log)
+	}
+}
+
+// received handles a message published by client c. Only commands are
+// accepted, the other topics are owned by the bridge.
+func (b *MQTTBridge) received(c *mqttClient, m *mqttPublishPacket, log *LogScope) {
+	levels := strings.Split(m.Topic, "/")
+	if len(levels) != 3 || levels[0] != "devices" || levels[2] != "command" || !smarthome.ValidSn(levels[1]) {
+		log.Debug("mqtt", "ignored message published to %s", m.Topic)
+		return
+	}
+	b.command(c, levels[1], m.Payload, log)
+}
+
+// command sends the command client c published to devices/{sn}/command to sn
+// and publishes the answer on its response topic.
+func (b *MQTTBridge) command(c *mqttClient, sn string, payload []byte, log *LogScope) {
+	h := b.server
+	var body commandRequest
+	if err := json.Unmarshal(payload, &body); err != nil {
+		b.respond(c, sn, "", smarthome.NewError(smarthome.CodeBadMessage, "", "invalid JSON: "+err.Error()))
+		return
+	}
+	if body.Wsid == "" {
+		body.Wsid = newWsid(MQTTSn, &mqttWsidSeq)
+	}
+	if !validMQTTTopic(body.Wsid) || strings.Contains(body.Wsid, "/") {
+		b.respond(c, sn, "", smarthome.NewError(smarthome.CodeBadMessage, body.Wsid, "wsid may not contain /, + or #"))
+		return
+	}
+	msg := &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: body.Wsid, Sn: sn, Data: body.Data, Persist: body.Persist}
+	if err := msg.Validate(); err != nil {
+		b.respond(c, sn, msg.Wsid, err)
+		return
+	}
+	if !h.canCommand(c.identity, sn) {
+		log.Access("mqtt", "FORBIDDEN: rest %s from %s to sn %s", msg.Wsid, c.identity, sn)
+		h.audit(&AuditRecord{From: c.identity, To: sn, Wsid: msg.Wsid, Type: msg.Type, Outcome: AuditForbidden}, msg.Data, time.Time{})
+		b.respond(c, sn, msg.Wsid, smarthome.NewError(smarthome.CodeForbidden, msg.Wsid, "not allowed to command sn "+sn))
+		return
+	}
+
+	if msg.Persist && h.Devices.Lookup(sn) == nil {
+		if err := h.queueRest(c.identity, msg, log); err != nil {
+			b.respond(c, sn, msg.Wsid, err)
+			return
+		}
+		b.respond(c, sn, msg.Wsid, smarthome.NewDelivery(msg.Wsid, sn, smarthome.DeliveryQueued))
+		return
+	}
+
+	onReply := func(reply *smarthome.ResponseMessage) {
+		log.Access("mqtt", "COMMAND: rest %s answered by sn %s", reply.Wsid, sn)
+		b.respond(c, sn, msg.Wsid, &commandResponse{Type: reply.Type, Wsid: reply.Wsid, Sn: sn, Data: reply.Data})
+	}
+	onTimeout := func() {
+		log.Access("mqtt", "COMMAND TIMEOUT: sn %s did not answer rest %s", sn, msg.Wsid)
+		b.respond(c, sn, msg.Wsid, smarthome.NewError(smarthome.CodeTimeout, msg.Wsid, "sn "+sn+" did not answer"))
+	}
+	if err := h.forwardRest(NewPendingRequest(msg.Wsid, c.identity, sn, onReply, onTimeout), msg.Data); err != nil {
+		log.Access("mqtt", "COMMAND REJECTED: rest %s to sn %s: %s", msg.Wsid, sn, err)
+		b.respond(c, sn, msg.Wsid, err)
+	}
+}
+
+// respond publishes the answer to a command of client c for sn on the
+// response topic of wsid, or on devices/{sn}/response if there is no usable
+// wsid. Only c receives it, if it is still connected and subscribed.
+func (b *MQTTBridge) respond(c *mqttClient, sn, wsid string, answer interface{}) {
+	topic := "devices/" + sn + "/response"
+	if wsid != "" {
+		topic += "/" + wsid
+	}
+	data, _ := json.Marshal(answer)
+	b.mutex.Lock()
+	subscribed := b.clients[c] && c.subscribed(topic)
+	b.mutex.Unlock()
+	if subscribed {
+		c.send((&mqttPublishPacket{Topic: topic, Payload: data}).Packet(), b.log)
+	}
+}
+
+// Notify publishes notification m to the clients that may observe its
+// sender. Devicestate notifications also update the online topic, which is
+// retained for the sns of the device registry.
+func (b *MQTTBridge) Notify(m *smarthome.NotificationMessage) {
+	data, _ := json.Marshal(m)
+	b.publish(m.From, "devices/"+m.From+"/notification/"+m.MsgType, data)
+	if m.MsgType == "devicestate" {
+		var state struct {
+			State string `json:"state"`
+		}
+		json.Unmarshal(m.Data, &state)
+		topic := "devices/" + m.From + "/online"
+		payload := []byte(strconv.FormatBool(state.State == "online"))
+		if b.server.Credentials.Known(m.From) {
+			b.mutex.Lock()
+			b.retained[topic] = &mqttRetained{sn: m.From, payload: payload}
+			b.mutex.Unlock()
+		}
+		b.publish(m.From, topic, payload)
+	}
+}
+
+// publish sends payload to the clients subscribed to topic that may observe
+// sn.
+func (b *MQTTBridge) publish(sn, topic string, payload []byte) {
+	packet := (&mqttPublishPacket{Topic: topic, Payload: payload}).Packet().Bytes()
+	b.mutex.Lock()
+	clients := []*mqttClient{}
+	for c := range b.clients {
+		if c.subscribed(topic) && b.server.canObserve(c.identity, sn) {
+			clients = append(clients, c)
+		}
+	}
+	b.mutex.Unlock()
+	for _, c := range clients {
+		c.enqueue(packet, b.log)
+	}
+}
+
+// subscribed reports whether one of the filters of c matches topic. The
+// caller must hold MQTTBridge.mutex.
+func (c *mqttClient) subscribed(topic string) bool {
+	for filter := range c.filters {
+		if mqttTopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues packet p for the client.
+func (c *mqttClient) send(p *mqttPacket, log *LogScope) {
+	c.enqueue(p.Bytes(), log)
+}
+
+// enqueue queues an encoded packet, dropping it if the client does not keep
+// up.
+func (c *mqttClient) enqueue(packet []byte, log *LogScope) {
+	select {
+	case c.outgoing <- packet:
+	default:
+		log.Debug("mqtt", "client %q does not keep up, packet dropped", c.id)
+	}
+}
+
+// write sends the queued packets until the connection ends.
+func (c *mqttClient) write(log *LogScope) {
+	for {
+		select {
+		case packet := <-c.outgoing:
+			if _, err := c.conn.Write(packet); err != nil {
+				log.Debug("mqtt", "Cannot send: %s", err)
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// startMQTT runs the MQTT bridge of b on a local port.
+func startMQTT(b *testBroker) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	users, err := ParseMQTTUsers(strings.NewReader("bridge bridgesecret\nother othersecret\n"))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.server.MQTT = NewMQTTBridge(b.server, users, testLogScope())
+	go b.server.MQTT.Serve(l)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+type testMQTTClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialMQTT connects to addr as the user of startMQTT and expects CONNACK with
+// code.
+func dialMQTT(t *testing.T, addr string, level, code byte) *testMQTTClient {
+	return dialMQTTAs(t, addr, level, "bridge", "bridgesecret", code)
+}
+
+// dialMQTTAs connects to addr as username, without credentials if it is
+// empty, and expects CONNACK with code.
+func dialMQTTAs(t *testing.T, addr string, level byte, username, password string, code byte) *testMQTTClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testMQTTClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	body := appendMQTTString(nil, "MQTT")
+	flags := byte(0x02)
+	if username != "" {
+		flags |= 0x80 | 0x40
+	}
+	body = append(body, level, flags, 0, 60)
+	body = appendMQTTString(body, "test-client")
+	if username != "" {
+		body = appendMQTTString(appendMQTTString(body, username), password)
+	}
+	c.write(&mqttPacket{Type: mqttConnect, Body: body})
+	if p := c.read(); p.Type != mqttConnack || len(p.Body) != 2 || p.Body[1] != code {
+		t.Fatalf("expected CONNACK %d, got %+v", code, p)
+	}
+	return c
+}
+
+func (c *testMQTTClient) write(p *mqttPacket) {
+	if _, err := c.conn.Write(p.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testMQTTClient) read() *mqttPacket {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := readMQTTPacket(c.r)
+	if err != nil {
+		c.t.Fatalf("read: %s", err)
+	}
+	return p
+}
+
+func (c *testMQTTClient) subscribe(filters ...string) {
+	body := appendMQTTUint16(nil, 1)
+	for _, filter := range filters {
+		body = append(appendMQTTString(body, filter), 0)
+	}
+	c.write(&mqttPacket{Type: mqttSubscribe, Flags: 2, Body: body})
+	if p := c.read(); p.Type != mqttSuback || len(p.Body) != 2+len(filters) {
+		c.t.Fatalf("expected SUBACK, got %+v", p)
+	}
+}
+
+// expect skips messages until one is published to topic.
+func (c *testMQTTClient) expect(topic string) *mqttPublishPacket {
+	for {
+		p := c.read()
+		if p.Type != mqttPublish {
+			continue
+		}
+		m, err := parseMQTTPublish(p)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if m.Topic == topic {
+			return m
+		}
+	}
+}
+
+func (c *testMQTTClient) expectJSON(topic string) map[string]interface{} {
+	m := c.expect(topic)
+	var msg map[string]interface{}
+	if err := json.Unmarshal(m.Payload, &msg); err != nil {
+		c.t.Fatalf("invalid JSON %q on %s", m.Payload, topic)
+	}
+	return msg
+}
+
+func (c *testMQTTClient) Close() {
+	c.conn.Close()
+}
+
+func TestParseMQTTUsers(t *testing.T) {
+	users, err := ParseMQTTUsers(strings.NewReader("# bridges\nbridge s3cret\n\nhomeassistant other\n"))
+	if err != nil || users.Len() != 2 {
+		t.Fatalf("parsed %v, %v", users, err)
+	}
+	for _, test := range []struct {
+		username, password string
+		ok                 bool
+	}{{"bridge", "s3cret", true}, {"bridge", "other", false}, {"bridge", "", false}, {"nosuch", "s3cret", false}} {
+		if ok := users.Authenticate(test.username, []byte(test.password)); ok != test.ok {
+			t.Errorf("%s/%s authenticated: %t", test.username, test.password, ok)
+		}
+	}
+	for _, bad := range []string{"bridge", "bridge s3cret extra", "bridge a\nbridge b", "bad/name s3cret"} {
+		if _, err := ParseMQTTUsers(strings.NewReader(bad)); err == nil {
+			t.Errorf("users %q should not parse", bad)
+		}
+	}
+}
+
+func TestSmarthomeMQTT(t *testing.T) {
+	b := newTestBroker(t, &Config{ReplyTimeout: 200 * time.Millisecond})
+	defer b.Close()
+	addr, stop := startMQTT(b)
+	defer stop()
+
+	mqtt := dialMQTT(t, addr, 4, mqttAccepted)
+	defer mqtt.Close()
+	mqtt.subscribe("devices/+/online", "devices/router-1/#")
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	if m := mqtt.expect("devices/router-1/online"); string(m.Payload) != "true" {
+		t.Errorf("online payload %q", m.Payload)
+	}
+	router.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "router-1", "data": map[string]string{"msgtype": "wifi", "ssid": "home"}})
+	if msg := mqtt.expectJSON("devices/router-1/notification/wifi"); msg["from"] != "router-1" {
+		t.Errorf("notification %v", msg)
+	}
+
+	// QoS 1 command, acknowledged with PUBACK
+	command := &mqttPublishPacket{Topic: "devices/router-1/command", Qos: 1, PacketId: 9, Payload: []byte(`{"wsid":"m1","data":{"cmd":"reboot"}}`)}
+	mqtt.write(command.Packet())
+	if p := mqtt.read(); p.Type != mqttPuback {
+		t.Fatalf("expected PUBACK, got %+v", p)
+	}
+	cmd := router.receiveType("rest")
+	if cmd["wsid"] != "m1" || cmd["from"] != "mqtt:bridge" {
+		t.Errorf("command %v", cmd)
+	}
+	router.send(map[string]interface{}{"type": "router", "wsid": "m1", "from": "mqtt:bridge", "data": map[string]string{"status": "ok"}})
+	if msg := mqtt.expectJSON("devices/router-1/response/m1"); msg["sn"] != "router-1" || msg["data"].(map[string]interface{})["status"] != "ok" {
+		t.Errorf("response %v", msg)
+	}
+
+	mqtt.write((&mqttPublishPacket{Topic: "devices/router-1/command", Payload: []byte(`{"wsid":"m2","data":{}}`)}).Packet())
+	router.receiveType("rest")
+	if msg := mqtt.expectJSON("devices/router-1/response/m2"); msg["code"] != "timeout" {
+		t.Errorf("expected timeout, got %v", msg)
+	}
+	mqtt.write((&mqttPublishPacket{Topic: "devices/router-1/command", Payload: []byte(`not json`)}).Packet())
+	if msg := mqtt.expectJSON("devices/router-1/response"); msg["code"] != "bad_message" {
+		t.Errorf("expected bad_message, got %v", msg)
+	}
+
+	// late subscribers get the retained online state
+	router.Close()
+	mqtt.expect("devices/router-1/online")
+	late := dialMQTT(t, addr, 4, mqttAccepted)
+	defer late.Close()
+	late.subscribe("devices/+/online")
+	if m := late.expect("devices/router-1/online"); string(m.Payload) != "false" || !m.Retain {
+		t.Errorf("retained online %q %t", m.Payload, m.Retain)
+	}
+	// only sns of the registry get a retained online topic
+	b.server.MQTT.Notify(smarthome.NewDeviceStateNotification("ghost-1", "tv", "online"))
+	late.expect("devices/ghost-1/online")
+	b.server.MQTT.mutex.Lock()
+	_, retained := b.server.MQTT.retained["devices/ghost-1/online"]
+	b.server.MQTT.mutex.Unlock()
+	if retained {
+		t.Error("retained online topic of unknown sn")
+	}
+	late.write(&mqttPacket{Type: mqttPingreq})
+	if p := late.read(); p.Type != mqttPingresp {
+		t.Errorf("expected PINGRESP, got %+v", p)
+	}
+}
+
+func TestSmarthomeMQTTAccess(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	acl, err := ParseACL(strings.NewReader("mqtt:bridge command router-1\nmqtt:other observe tv-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Authorizer = acl
+	addr, stop := startMQTT(b)
+	defer stop()
+
+	dialMQTT(t, addr, 3, mqttBadProtocolVersion).Close()
+	dialMQTTAs(t, addr, 4, "", "", mqttNotAuthorized).Close()
+	dialMQTTAs(t, addr, 4, "bridge", "wrong", mqttBadCredentials).Close()
+	dialMQTTAs(t, addr, 4, "nosuch", "bridgesecret", mqttBadCredentials).Close()
+
+	mqtt := dialMQTT(t, addr, 4, mqttAccepted)
+	defer mqtt.Close()
+	mqtt.subscribe("devices/#")
+	other := dialMQTTAs(t, addr, 4, "other", "othersecret", mqttAccepted)
+	defer other.Close()
+	other.subscribe("#")
+	mqtt.write((&mqttPublishPacket{Topic: "devices/tv-1/command", Payload: []byte(`{"wsid":"m1","data":{}}`)}).Packet())
+	if msg := mqtt.expectJSON("devices/tv-1/response/m1"); msg["code"] != "forbidden" {
+		t.Errorf("expected forbidden, got %v", msg)
+	}
+	mqtt.write((&mqttPublishPacket{Topic: "devices/router-1/command", Payload: []byte(`{"wsid":"m2","data":{}}`)}).Packet())
+	if msg := mqtt.expectJSON("devices/router-1/response/m2"); msg["code"] != "target_offline" {
+		t.Errorf("expected target_offline, got %v", msg)
+	}
+
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "tv")
+	defer tv.Close()
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	// the tv is not observable, so the first message is about the router
+	m, err := parseMQTTPublish(mqtt.read())
+	if err != nil || !strings.HasPrefix(m.Topic, "devices/router-1/") {
+		t.Errorf("expected router message, got %+v %v", m, err)
+	}
+	// the other user sees neither the answers to bridge nor the router
+	m, err = parseMQTTPublish(other.read())
+	if err != nil || !strings.HasPrefix(m.Topic, "devices/tv-1/") {
+		t.Errorf("expected tv message, got %+v %v", m, err)
+	}
+	other.write((&mqttPublishPacket{Topic: "devices/router-1/command", Payload: []byte(`{"wsid":"m3","data":{}}`)}).Packet())
+	if msg := other.expectJSON("devices/router-1/response/m3"); msg["code"] != "forbidden" {
+		t.Errorf("expected forbidden, got %v", msg)
+	}
+}
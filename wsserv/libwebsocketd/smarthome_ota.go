@@ -0,0 +1,522 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// OTAChunkSize is the number of firmware bytes sent per ota_chunk message.
+const OTAChunkSize = 32 * 1024
+
+// FirmwareImage is a firmware version for one device type.
+type FirmwareImage struct {
+	CType   string `json:"c_type"`
+	Version string `json:"version"`
+	Size    int64  `json:"size"`
+	Sha256  string `json:"sha256"`
+
+	path    string
+	modTime time.Time
+}
+
+// Chunks returns the number of chunks the image is sent in.
+func (img *FirmwareImage) Chunks() int {
+	return int((img.Size + OTAChunkSize - 1) / OTAChunkSize)
+}
+
+// ReadChunk reads chunk n of the image.
+func (img *FirmwareImage) ReadChunk(n int) ([]byte, error) {
+	if n < 0 || n >= img.Chunks() {
+		return nil, fmt.Errorf("firmware %s/%s has no chunk %d", img.CType, img.Version, n)
+	}
+	f, err := os.Open(img.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	offset := int64(n) * OTAChunkSize
+	size := img.Size - offset
+	if size > OTAChunkSize {
+		size = OTAChunkSize
+	}
+	data := make([]byte, size)
+	read, err := f.ReadAt(data, offset)
+	if read == len(data) {
+		return data, nil
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("firmware %s/%s is shorter than %d bytes", img.CType, img.Version, img.Size)
+	}
+	return nil, err
+}
+
+// FirmwareStore serves firmware images from a directory holding one file per
+// image as C_TYPE/VERSION. Images are hashed on first use and again whenever
+// their file changes, so versions can be added while the server runs. It is
+// safe for concurrent use.
+type FirmwareStore struct {
+	dir    string
+	mutex  sync.Mutex
+	images map[string]*FirmwareImage // by C_TYPE/VERSION
+}
+
+func NewFirmwareStore(dir string) (*FirmwareStore, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &FirmwareStore{dir: dir, images: make(map[string]*FirmwareImage)}, nil
+}
+
+// Image returns firmware version for device type ctype, or nil if there is
+// none.
+func (s *FirmwareStore) Image(ctype, version string) (*FirmwareImage, error) {
+	if !validFirmwareName(ctype) || !validFirmwareName(version) {
+		return nil, nil
+	}
+	path := filepath.Join(s.dir, ctype, version)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() || info.Size() == 0 {
+		return nil, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := ctype + "/" + version
+	if img := s.images[key]; img != nil && img.Size == info.Size() && img.modTime.Equal(info.ModTime()) {
+		return img, nil
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	img := &FirmwareImage{CType: ctype, Version: version, Size: info.Size(), Sha256: sum, path: path, modTime: info.ModTime()}
+	s.images[key] = img
+	return img, nil
+}
+
+// List returns all images ordered by device type and version.
+func (s *FirmwareStore) List() ([]*FirmwareImage, error) {
+	ctypes, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	images := []*FirmwareImage{}
+	for _, ctype := range ctypes {
+		if !ctype.IsDir() {
+			continue
+		}
+		versions, err := ioutil.ReadDir(filepath.Join(s.dir, ctype.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			img, err := s.Image(ctype.Name(), version.Name())
+			if err != nil {
+				return nil, err
+			}
+			if img != nil {
+				images = append(images, img)
+			}
+		}
+	}
+	return images, nil
+}
+
+// validFirmwareName reports whether name may be used as device type or
+// version, which must not leave the firmware directory.
+func validFirmwareName(name string) bool {
+	return smarthome.ValidSn(name) && !strings.HasPrefix(name, ".")
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Rollout offers firmware Version to Percent of the devices of type CType.
+// Whether a device is included depends only on its sn, so raising Percent
+// keeps the devices included before.
+type Rollout struct {
+	CType   string    `json:"c_type"`
+	Version string    `json:"version"`
+	Percent int       `json:"percent"`
+	Started time.Time `json:"started"`
+}
+
+// Includes reports whether sn gets the update.
+func (r *Rollout) Includes(sn string) bool {
+	return int(crc32.ChecksumIEEE([]byte(sn))%100) < r.Percent
+}
+
+// OTAProgress is the firmware update state of a device.
+type OTAProgress struct {
+	Sn      string    `json:"sn"`
+	CType   string    `json:"c_type"`
+	Version string    `json:"version"`
+	State   string    `json:"state"`
+	Chunk   int       `json:"chunk"` // next chunk the device needs
+	Chunks  int       `json:"chunks"`
+	Sha256  string    `json:"sha256"` // of the image offered, chunks of another image are not sent
+	Message string    `json:"message,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+type otaProgressList []*OTAProgress
+
+func (l otaProgressList) Len() int           { return len(l) }
+func (l otaProgressList) Less(i, j int) bool { return l[i].Sn < l[j].Sn }
+func (l otaProgressList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// OTAManager keeps the rollouts and the update progress of every device. The
+// progress survives reconnects, so downloads resume where they stopped, but
+// not restarts of the server. It is safe for concurrent use.
+type OTAManager struct {
+	Firmware *FirmwareStore
+
+	mutex    sync.Mutex
+	rollouts map[string]*Rollout     // by c_type
+	progress map[string]*OTAProgress // by sn
+}
+
+func NewOTAManager(firmware *FirmwareStore) *OTAManager {
+	return &OTAManager{
+		Firmware: firmware,
+		rollouts: make(map[string]*Rollout),
+		progress: make(map[string]*OTAProgress),
+	}
+}
+
+// SetRollout starts offering version to percent of the devices of ctype,
+// replacing the rollout of ctype. Devices that failed to install version
+// before get it offered again.
+func (m *OTAManager) SetRollout(ctype, version string, percent int) (*Rollout, error) {
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("percent must be between 0 and 100")
+	}
+	img, err := m.Firmware.Image(ctype, version)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("no firmware %s for c_type %s", version, ctype)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r := &Rollout{CType: ctype, Version: version, Percent: percent, Started: time.Now()}
+	m.rollouts[ctype] = r
+	for sn, p := range m.progress {
+		if p.CType == ctype && p.Version == version && p.State == smarthome.OTAFailed {
+			delete(m.progress, sn)
+		}
+	}
+	copied := *r
+	return &copied, nil
+}
+
+// Rollouts returns the rollouts ordered by device type.
+func (m *OTAManager) Rollouts() []*Rollout {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ctypes := make([]string, 0, len(m.rollouts))
+	for ctype := range m.rollouts {
+		ctypes = append(ctypes, ctype)
+	}
+	sort.Strings(ctypes)
+	rollouts := make([]*Rollout, 0, len(ctypes))
+	for _, ctype := range ctypes {
+		copied := *m.rollouts[ctype]
+		rollouts = append(rollouts, &copied)
+	}
+	return rollouts
+}
+
+// Rollout returns the rollout for ctype, or nil.
+func (m *OTAManager) Rollout(ctype string) *Rollout {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r := m.rollouts[ctype]
+	if r == nil {
+		return nil
+	}
+	copied := *r
+	return &copied
+}
+
+// Progress returns the update progress of the devices of ctype ordered by sn.
+func (m *OTAManager) Progress(ctype string) []*OTAProgress {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := otaProgressList{}
+	for _, p := range m.progress {
+		if p.CType == ctype {
+			copied := *p
+			list = append(list, &copied)
+		}
+	}
+	sort.Sort(list)
+	return list
+}
+
+// Check returns the image to offer device sn of ctype which has version
+// installed, and the chunk to resume the download at. It returns nil if
+// there is no update for the device.
+func (m *OTAManager) Check(sn, ctype, installed string) (*FirmwareImage, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r := m.rollouts[ctype]
+	if r == nil || !r.Includes(sn) || r.Version == installed {
+		return nil, 0, nil
+	}
+	p := m.progress[sn]
+	if p != nil && p.Version == r.Version && p.State == smarthome.OTAFailed {
+		return nil, 0, nil
+	}
+	img, err := m.Firmware.Image(ctype, r.Version)
+	if err != nil || img == nil {
+		return nil, 0, err
+	}
+	if p == nil || p.Version != r.Version || p.Sha256 != img.Sha256 || p.State == smarthome.OTAInstalled {
+		p = &OTAProgress{Sn: sn, CType: ctype, Version: r.Version, Chunks: img.Chunks(), Sha256: img.Sha256}
+		m.progress[sn] = p
+	}
+	if p.State == "" || p.State == smarthome.OTAInstalled {
+		p.State = smarthome.OTAUpdate
+	}
+	p.Updated = time.Now()
+	return img, p.Chunk, nil
+}
+
+// Start records that sn downloads version from chunk on and returns the
+// image.
+func (m *OTAManager) Start(sn, version string, chunk int) (*FirmwareImage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p, img, err := m.offered(sn, version)
+	if err != nil {
+		return nil, err
+	}
+	if chunk >= p.Chunks {
+		return nil, fmt.Errorf("firmware %s has %d chunks", version, p.Chunks)
+	}
+	p.State = smarthome.OTADownloading
+	p.Chunk = chunk
+	p.Updated = time.Now()
+	return img, nil
+}
+
+// Ack records that sn received chunk of version. It returns the chunk to send
+// next, or done if the download is complete.
+func (m *OTAManager) Ack(sn, version string, chunk int) (img *FirmwareImage, next int, done bool, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p, img, err := m.offered(sn, version)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if p.State != smarthome.OTADownloading || chunk != p.Chunk {
+		return nil, 0, false, fmt.Errorf("chunk %d of firmware %s was not sent", chunk, version)
+	}
+	p.Chunk++
+	p.Updated = time.Now()
+	if p.Chunk == p.Chunks {
+		p.State = smarthome.OTADownloaded
+		return img, 0, true, nil
+	}
+	return img, p.Chunk, false, nil
+}
+
+// Result records whether sn installed version. Version can only be
+// installed once it was downloaded completely.
+func (m *OTAManager) Result(sn, version, state, message string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p := m.progress[sn]
+	if p == nil || p.Version != version {
+		return fmt.Errorf("firmware %s was not offered", version)
+	}
+	if state == smarthome.OTAInstalled && p.State != smarthome.OTADownloaded {
+		return fmt.Errorf("firmware %s was not downloaded", version)
+	}
+	p.State = state
+	p.Message = message
+	p.Updated = time.Now()
+	return nil
+}
+
+// offered returns the progress of sn and the image of version if version was
+// offered to sn.
+func (m *OTAManager) offered(sn, version string) (*OTAProgress, *FirmwareImage, error) {
+	p := m.progress[sn]
+	if p == nil || p.Version != version || p.State == smarthome.OTAInstalled || p.State == smarthome.OTAFailed {
+		return nil, nil, fmt.Errorf("firmware %s was not offered", version)
+	}
+	img, err := m.Firmware.Image(p.CType, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if img == nil || img.Sha256 != p.Sha256 {
+		return nil, nil, fmt.Errorf("firmware %s changed, check again", version)
+	}
+	return p, img, nil
+}
+
+// announceRollout tells the connected devices included in r that an update
+// is available. It returns the number of devices told.
+func (h *WebsocketdServer) announceRollout(r *Rollout, log *LogScope) int {
+	told := 0
+	for _, entry := range h.Devices.ByType(r.CType) {
+		if !r.Includes(entry.Sn) || !h.canCommand(APISn, entry.Sn) {
+			continue
+		}
+		if entry.Endpoint.SendMessage(&smarthome.OTAUpdateMessage{Type: smarthome.TypeOTAUpdate, Version: r.Version}) {
+			told++
+		}
+	}
+	log.Access("smarthome", "ROLLOUT: firmware %s to %d%% of c_type %s, %d connected devices told", r.Version, r.Percent, r.CType, told)
+	return told
+}
+
+// smarthomeOTACheck offers this device a firmware update. Devices the HTTP
+// API may not command are never updated.
+func (ss *smarthomeSession) smarthomeOTACheck(m *smarthome.OTACheckMessage, log *LogScope) {
+	endpoint := ss.BindDevice.Endpoint
+	offer := &smarthome.OTAOffer{Type: smarthome.TypeOTACheck, Wsid: m.Wsid, Status: smarthome.OTAUpToDate}
+	if ss.Server.OTA == nil || !ss.Server.canCommand(APISn, ss.BindSn) {
+		endpoint.SendMessage(offer)
+		return
+	}
+	img, next, err := ss.Server.OTA.Check(ss.BindSn, ss.BindDevice.CType, m.Version)
+	if err != nil {
+		log.Error("smarthome", "Could not read firmware for sn %s: %s", ss.BindSn, err)
+		endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeNoFirmware, m.Wsid, err))
+		return
+	}
+	if img != nil {
+		log.Access("smarthome", "OTA OFFERED: firmware %s to sn %s running %s, next chunk %d", img.Version, ss.BindSn, m.Version, next)
+		offer.Status = smarthome.OTAUpdate
+		offer.Version = img.Version
+		offer.Size = img.Size
+		offer.Sha256 = img.Sha256
+		offer.ChunkSize = OTAChunkSize
+		offer.Chunks = img.Chunks()
+		offer.NextChunk = next
+	}
+	endpoint.SendMessage(offer)
+}
+
+// smarthomeOTAStart starts or resumes a download.
+func (ss *smarthomeSession) smarthomeOTAStart(m *smarthome.OTAStartMessage, log *LogScope) {
+	if ss.Server.OTA == nil {
+		ss.otaDisabled(m.Wsid)
+		return
+	}
+	img, err := ss.Server.OTA.Start(ss.BindSn, m.Version, m.Chunk)
+	if err != nil {
+		log.Access("smarthome", "OTA REJECTED: start of firmware %s by sn %s: %s", m.Version, ss.BindSn, err)
+		ss.BindDevice.Endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeNoFirmware, m.Wsid, err))
+		return
+	}
+	log.Access("smarthome", "OTA START: firmware %s to sn %s from chunk %d of %d", m.Version, ss.BindSn, m.Chunk, img.Chunks())
+	ss.sendChunk(img, m.Wsid, m.Chunk, log)
+}
+
+// smarthomeOTAAck sends the next chunk, or the same one again if the device
+// could not verify it.
+func (ss *smarthomeSession) smarthomeOTAAck(m *smarthome.OTAAckMessage, log *LogScope) {
+	if ss.Server.OTA == nil {
+		ss.otaDisabled(m.Wsid)
+		return
+	}
+	var img *FirmwareImage
+	var next int
+	var done bool
+	var err error
+	if m.Ok {
+		img, next, done, err = ss.Server.OTA.Ack(ss.BindSn, m.Version, m.Chunk)
+	} else {
+		log.Access("smarthome", "OTA RESEND: chunk %d of firmware %s to sn %s failed its checksum", m.Chunk, m.Version, ss.BindSn)
+		img, err = ss.Server.OTA.Start(ss.BindSn, m.Version, m.Chunk)
+		next = m.Chunk
+	}
+	if err != nil {
+		log.Access("smarthome", "OTA REJECTED: ack of firmware %s by sn %s: %s", m.Version, ss.BindSn, err)
+		ss.BindDevice.Endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeNoFirmware, m.Wsid, err))
+		return
+	}
+	if done {
+		log.Access("smarthome", "OTA DOWNLOADED: firmware %s by sn %s", m.Version, ss.BindSn)
+		return
+	}
+	ss.sendChunk(img, m.Wsid, next, log)
+}
+
+// smarthomeOTAResult records the outcome of an update.
+func (ss *smarthomeSession) smarthomeOTAResult(m *smarthome.OTAResultMessage, log *LogScope) {
+	if ss.Server.OTA == nil {
+		ss.otaDisabled(m.Wsid)
+		return
+	}
+	if err := ss.Server.OTA.Result(ss.BindSn, m.Version, m.Status, m.Message); err != nil {
+		log.Access("smarthome", "OTA REJECTED: result of firmware %s by sn %s: %s", m.Version, ss.BindSn, err)
+		ss.BindDevice.Endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeNoFirmware, m.Wsid, err))
+		return
+	}
+	log.Access("smarthome", "OTA %s: firmware %s by sn %s %s", strings.ToUpper(m.Status), m.Version, ss.BindSn, m.Message)
+}
+
+func (ss *smarthomeSession) sendChunk(img *FirmwareImage, wsid string, n int, log *LogScope) {
+	data, err := img.ReadChunk(n)
+	if err != nil {
+		log.Error("smarthome", "Could not read chunk %d of firmware %s/%s: %s", n, img.CType, img.Version, err)
+		ss.BindDevice.Endpoint.SendMessage(smarthome.ErrorReply(smarthome.CodeNoFirmware, wsid, err))
+		return
+	}
+	ss.BindDevice.Endpoint.SendMessage(&smarthome.OTAChunkMessage{
+		Type:    smarthome.TypeOTAChunk,
+		Wsid:    wsid,
+		Version: img.Version,
+		Chunk:   n,
+		Data:    data,
+		CRC32:   crc32.ChecksumIEEE(data),
+	})
+}
+
+func (ss *smarthomeSession) otaDisabled(wsid string) {
+	ss.BindDevice.Endpoint.SendMessage(smarthome.NewError(smarthome.CodeNoFirmware, wsid, "firmware updates are disabled"))
+}
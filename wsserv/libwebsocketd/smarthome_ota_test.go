@@ -0,0 +1,222 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFirmware is 2.5 chunks long.
+var testFirmware = bytes.Repeat([]byte("0123456789abcdef"), OTAChunkSize*5/2/16)
+
+// tempFirmware creates a firmware store holding router/1.1.
+func tempFirmware(t *testing.T) (*FirmwareStore, func()) {
+	dir, cleanup := tempDir(t, "firmware")
+	os.Mkdir(filepath.Join(dir, "router"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "router", "1.1"), testFirmware, 0644); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	store, err := NewFirmwareStore(dir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return store, cleanup
+}
+
+func TestFirmwareStore(t *testing.T) {
+	store, cleanup := tempFirmware(t)
+	defer cleanup()
+
+	img, err := store.Image("router", "1.1")
+	if err != nil || img == nil {
+		t.Fatalf("got %v, %v", img, err)
+	}
+	sum := sha256.Sum256(testFirmware)
+	if img.Size != int64(len(testFirmware)) || img.Sha256 != hex.EncodeToString(sum[:]) || img.Chunks() != 3 {
+		t.Errorf("unexpected image %+v with %d chunks", img, img.Chunks())
+	}
+	last, err := img.ReadChunk(2)
+	if err != nil || !bytes.Equal(last, testFirmware[2*OTAChunkSize:]) {
+		t.Errorf("last chunk: %d bytes, %v", len(last), err)
+	}
+	if _, err := img.ReadChunk(3); err == nil {
+		t.Error("read chunk past the end")
+	}
+
+	for _, name := range [][2]string{{"router", "1.2"}, {"tv", "1.1"}, {"router", ".."}, {"..", "router"}} {
+		if img, err := store.Image(name[0], name[1]); img != nil || err != nil {
+			t.Errorf("%s/%s: got %v, %v", name[0], name[1], img, err)
+		}
+	}
+
+	images, err := store.List()
+	if err != nil || len(images) != 1 || images[0].Version != "1.1" {
+		t.Errorf("got %v, %v", images, err)
+	}
+}
+
+func TestOTAFirmwareReplaced(t *testing.T) {
+	store, cleanup := tempFirmware(t)
+	defer cleanup()
+	m := NewOTAManager(store)
+	if _, err := m.SetRollout("router", "1.1", 100); err != nil {
+		t.Fatal(err)
+	}
+	offered, _, err := m.Check("router-1", "router", "1.0")
+	if err != nil || offered == nil {
+		t.Fatalf("got %v, %v", offered, err)
+	}
+	if _, err := m.Start("router-1", "1.1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a build of the same size replaces the image during the download
+	path := filepath.Join(store.dir, "router", "1.1")
+	ioutil.WriteFile(path, bytes.ToUpper(testFirmware), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if _, _, _, err := m.Ack("router-1", "1.1", 0); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("chunk of replaced image acknowledged: %v", err)
+	}
+
+	// checking again restarts the download of the new image
+	img, next, err := m.Check("router-1", "router", "1.0")
+	if err != nil || img == nil || img.Sha256 == offered.Sha256 || next != 0 {
+		t.Errorf("got %v at chunk %d, %v", img, next, err)
+	}
+	if p := m.Progress("router"); len(p) != 1 || p[0].Sha256 != img.Sha256 {
+		t.Errorf("progress %v", p)
+	}
+}
+
+func TestRolloutIncludes(t *testing.T) {
+	half := &Rollout{Percent: 50}
+	all := &Rollout{Percent: 100}
+	none := &Rollout{Percent: 0}
+	included := 0
+	for i := 0; i < 1000; i++ {
+		sn := fmt.Sprintf("dev-%d", i)
+		if none.Includes(sn) || !all.Includes(sn) {
+			t.Fatalf("%s: 0%% or 100%% rollout wrong", sn)
+		}
+		if half.Includes(sn) {
+			included++
+			if !(&Rollout{Percent: 60}).Includes(sn) {
+				t.Errorf("%s dropped out when the rollout grew", sn)
+			}
+		}
+	}
+	if included < 400 || included > 600 {
+		t.Errorf("50%% rollout included %d of 1000 devices", included)
+	}
+}
+
+func TestSmarthomeOTA(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	store, cleanup := tempFirmware(t)
+	defer cleanup()
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	if status, _ := b.request("GET", "/api/rollouts", ""); status != http.StatusNotFound {
+		t.Errorf("expected 404 while updates are disabled, got %d", status)
+	}
+	b.server.OTA = NewOTAManager(store)
+
+	if status, reply := b.request("POST", "/api/rollouts", `{"c_type":"router","version":"9.9","percent":100}`); status != http.StatusBadRequest {
+		t.Errorf("rollout of missing firmware: %d %v", status, reply)
+	}
+	status, reply := b.request("POST", "/api/rollouts", `{"c_type":"router","version":"1.1","percent":100}`)
+	if status != http.StatusOK || reply["notified"] != 1.0 {
+		t.Fatalf("rollout: %d %v", status, reply)
+	}
+	if msg := router.receiveType("ota_update"); msg["version"] != "1.1" {
+		t.Errorf("unexpected announcement %v", msg)
+	}
+
+	router.send(map[string]interface{}{"type": "ota_check", "wsid": "o1", "version": "1.1"})
+	if offer := router.receiveType("ota_check"); offer["status"] != "up_to_date" {
+		t.Errorf("device running the rollout version got %v", offer)
+	}
+	router.send(map[string]interface{}{"type": "ota_check", "wsid": "o1", "version": "1.0"})
+	offer := router.receiveType("ota_check")
+	if offer["status"] != "update" || offer["chunks"] != 3.0 || offer["next_chunk"] != 0.0 || offer["size"] != float64(len(testFirmware)) {
+		t.Fatalf("unexpected offer %v", offer)
+	}
+
+	chunk := func(c *testClient, n int) {
+		msg := c.receiveType("ota_chunk")
+		data, _ := base64.StdEncoding.DecodeString(msg["data"].(string))
+		end := (n + 1) * OTAChunkSize
+		if end > len(testFirmware) {
+			end = len(testFirmware)
+		}
+		if msg["chunk"] != float64(n) || !bytes.Equal(data, testFirmware[n*OTAChunkSize:end]) || msg["crc32"] != float64(crc32.ChecksumIEEE(data)) {
+			t.Fatalf("chunk %d: got chunk %v of %d bytes", n, msg["chunk"], len(data))
+		}
+	}
+	router.send(map[string]interface{}{"type": "ota_start", "wsid": "o1", "version": "1.1", "chunk": 0})
+	chunk(router, 0)
+	router.send(map[string]interface{}{"type": "ota_ack", "wsid": "o1", "version": "1.1", "chunk": 0, "ok": true})
+	chunk(router, 1)
+	router.send(map[string]interface{}{"type": "ota_ack", "wsid": "o1", "version": "1.1", "chunk": 1, "ok": false})
+	chunk(router, 1)
+	router.send(map[string]interface{}{"type": "ota_ack", "wsid": "o1", "version": "1.1", "chunk": 0, "ok": true})
+	expectError(t, router.receiveType("error"), "no_firmware", "o1")
+	router.send(map[string]interface{}{"type": "ota_result", "wsid": "o1", "version": "1.1", "status": "installed"})
+	expectError(t, router.receiveType("error"), "no_firmware", "o1")
+
+	// resume after reconnect
+	router.Close()
+	router = b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	router.send(map[string]interface{}{"type": "ota_check", "wsid": "o2", "version": "1.0"})
+	if offer := router.receiveType("ota_check"); offer["next_chunk"] != 1.0 {
+		t.Fatalf("expected to resume at chunk 1, got %v", offer)
+	}
+	router.send(map[string]interface{}{"type": "ota_start", "wsid": "o2", "version": "1.1", "chunk": 1})
+	chunk(router, 1)
+	router.send(map[string]interface{}{"type": "ota_ack", "wsid": "o2", "version": "1.1", "chunk": 1, "ok": true})
+	chunk(router, 2)
+	router.send(map[string]interface{}{"type": "ota_ack", "wsid": "o2", "version": "1.1", "chunk": 2, "ok": true})
+
+	state := func(want string) {
+		b.waitFor("state "+want, func() bool {
+			_, reply := b.request("GET", "/api/rollouts/router", "")
+			devices, _ := reply["devices"].([]interface{})
+			return len(devices) == 1 && devices[0].(map[string]interface{})["state"] == want
+		})
+	}
+	state("downloaded")
+	router.send(map[string]interface{}{"type": "ota_result", "wsid": "o2", "version": "1.1", "status": "installed"})
+	state("installed")
+
+	status, reply = b.request("GET", "/api/rollouts", "")
+	rollouts, _ := reply["rollouts"].([]interface{})
+	if status != http.StatusOK || len(rollouts) != 1 || rollouts[0].(map[string]interface{})["states"].(map[string]interface{})["installed"] != 1.0 {
+		t.Errorf("unexpected rollouts %d %v", status, reply)
+	}
+	if status, reply := b.request("GET", "/api/rollouts/tv", ""); status != http.StatusNotFound {
+		t.Errorf("rollout of tv: %d %v", status, reply)
+	}
+	if status, reply := b.request("GET", "/api/firmware", ""); status != http.StatusOK || reply["count"] != 1.0 {
+		t.Errorf("firmware: %d %v", status, reply)
+	}
+}
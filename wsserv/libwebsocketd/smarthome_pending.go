@@ -0,0 +1,119 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// PendingRequest is a rest command that was forwarded to a device and is
+// waiting for the device's reply.
+type PendingRequest struct {
+	Wsid   string    // wsid chosen by the client that sent the command
+	From   string    // sn of the client that sent the command
+	Target string    // sn of the device the command was sent to
+	Sent   time.Time // when the command was forwarded
+
+	onReply   func(*smarthome.ResponseMessage)
+	onTimeout func()
+	timer     *time.Timer
+}
+
+// NewPendingRequest creates a request that calls onReply with the device's
+// answer, or onTimeout if the device does not answer in time.
+func NewPendingRequest(wsid, from, target string, onReply func(*smarthome.ResponseMessage), onTimeout func()) *PendingRequest {
+	return &PendingRequest{
+		Wsid:      wsid,
+		From:      from,
+		Target:    target,
+		Sent:      time.Now(),
+		onReply:   onReply,
+		onTimeout: onTimeout,
+	}
+}
+
+type pendingKey struct {
+	from, wsid, target string
+}
+
+// PendingRequests correlates device replies with the rest commands they
+// answer. Requests are keyed by the sending client, its wsid and the target,
+// so a command sent to several devices waits for each of them.
+// It is safe for concurrent use.
+type PendingRequests struct {
+	mutex    sync.Mutex
+	requests map[pendingKey]*PendingRequest
+}
+
+func NewPendingRequests() *PendingRequests {
+	return &PendingRequests{requests: make(map[pendingKey]*PendingRequest)}
+}
+
+// Add starts waiting for the reply to req. If no reply is resolved within
+// timeout, the request is dropped and its timeout callback is run. Add
+// returns false if the client already has a request with the same wsid
+// waiting for the same target.
+func (p *PendingRequests) Add(req *PendingRequest, timeout time.Duration) bool {
+	key := pendingKey{req.From, req.Wsid, req.Target}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.requests[key]; ok {
+		return false
+	}
+	p.requests[key] = req
+	req.timer = time.AfterFunc(timeout, func() {
+		if p.remove(key, req) {
+			req.onTimeout()
+		}
+	})
+	return true
+}
+
+// Resolve hands reply from device sn to the request it answers. It returns
+// false if nobody is waiting for such a reply, either because the request
+// timed out already or because it was never sent to sn.
+func (p *PendingRequests) Resolve(sn string, reply *smarthome.ResponseMessage) bool {
+	key := pendingKey{reply.From, reply.Wsid, sn}
+	p.mutex.Lock()
+	req, ok := p.requests[key]
+	if !ok {
+		p.mutex.Unlock()
+		return false
+	}
+	delete(p.requests, key)
+	p.mutex.Unlock()
+
+	req.timer.Stop()
+	req.onReply(reply)
+	return true
+}
+
+// Cancel forgets req without running any of its callbacks.
+func (p *PendingRequests) Cancel(req *PendingRequest) {
+	if p.remove(pendingKey{req.From, req.Wsid, req.Target}, req) {
+		req.timer.Stop()
+	}
+}
+
+// Len returns number of requests waiting for a reply.
+func (p *PendingRequests) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.requests)
+}
+
+func (p *PendingRequests) remove(key pendingKey, req *PendingRequest) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.requests[key] != req {
+		return false
+	}
+	delete(p.requests, key)
+	return true
+}
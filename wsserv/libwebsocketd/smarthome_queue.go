@@ -0,0 +1,185 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// QueuedCommand is a persistent rest command stored until its target connects.
+type QueuedCommand struct {
+	Wsid    string          `json:"wsid"`
+	From    string          `json:"from"`
+	Target  string          `json:"target"`
+	Data    json.RawMessage `json:"data"`
+	Queued  time.Time       `json:"queued"`
+	Expires time.Time       `json:"expires"`
+}
+
+// QueueFullError is returned by Push when the queue of the target holds
+// Limit commands.
+var QueueFullError = errors.New("queue is full")
+
+// CommandQueue stores persistent rest commands for offline devices in a
+// directory, one file per sn with one JSON encoded QueuedCommand per line.
+// Commands are kept in the order they were pushed and stay on disk until
+// they are removed after delivery. It is safe for concurrent use, but only
+// one CommandQueue may use a directory at a time.
+type CommandQueue struct {
+	Limit int // Most commands queued per sn, 0 for no limit.
+
+	dir      string
+	mutex    sync.Mutex
+	reserved map[string]bool // sns whose commands are being delivered
+}
+
+// NewCommandQueue opens queue in dir, creating the directory if needed.
+// Commands queued by a previous run are kept.
+func NewCommandQueue(dir string) (*CommandQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &CommandQueue{dir: dir, reserved: make(map[string]bool)}, nil
+}
+
+// Push appends cmd to the queue of cmd.Target and syncs it to disk. It
+// returns QueueFullError if the queue already holds Limit commands.
+func (q *CommandQueue) Push(cmd *QueuedCommand) error {
+	line, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.Limit > 0 {
+		cmds, err := q.read(cmd.Target)
+		if err != nil {
+			return err
+		}
+		if len(cmds) >= q.Limit {
+			return QueueFullError
+		}
+	}
+	file, err := os.OpenFile(q.path(cmd.Target), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Take returns all commands queued for sn, oldest first, and reserves them
+// for delivery until Release. The commands stay queued until Remove drops
+// them, so those not yet removed are delivered again after a crash. Take
+// returns no commands while those of sn are reserved.
+func (q *CommandQueue) Take(sn string) ([]*QueuedCommand, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.reserved[sn] {
+		return nil, nil
+	}
+	cmds, err := q.read(sn)
+	if err != nil || len(cmds) == 0 {
+		return nil, err
+	}
+	q.reserved[sn] = true
+	return cmds, nil
+}
+
+// Remove drops the oldest n commands queued for sn, once they were delivered
+// or given up. Commands pushed since they were taken are kept.
+func (q *CommandQueue) Remove(sn string, n int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	cmds, err := q.read(sn)
+	if err != nil {
+		return err
+	}
+	if n >= len(cmds) {
+		if err := os.Remove(q.path(sn)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, cmd := range cmds[n:] {
+		line, err := json.Marshal(cmd)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(q.path(sn), buf.Bytes())
+}
+
+// Release ends the reservation of the commands of sn made by Take.
+func (q *CommandQueue) Release(sn string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.reserved, sn)
+}
+
+// Len returns number of commands queued for sn.
+func (q *CommandQueue) Len(sn string) (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	cmds, err := q.read(sn)
+	return len(cmds), err
+}
+
+func (q *CommandQueue) read(sn string) ([]*QueuedCommand, error) {
+	file, err := os.Open(q.path(sn))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cmds []*QueuedCommand
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			cmd := &QueuedCommand{}
+			if jsonErr := json.Unmarshal(line, cmd); jsonErr != nil {
+				if err == io.EOF {
+					// last line cut short by a crash while pushing
+					return cmds, nil
+				}
+				return nil, jsonErr
+			}
+			cmds = append(cmds, cmd)
+		}
+		if err == io.EOF {
+			return cmds, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// path returns queue file of sn. Sn is escaped because it may contain ":".
+func (q *CommandQueue) path(sn string) string {
+	return filepath.Join(q.dir, url.QueryEscape(sn)+".queue")
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func tempQueue(t *testing.T) (*CommandQueue, func()) {
+	dir, cleanup := tempDir(t, "queue")
+	q, err := NewCommandQueue(dir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return q, cleanup
+}
+
+func queued(wsid, target string) *QueuedCommand {
+	now := time.Now()
+	return &QueuedCommand{Wsid: wsid, From: "app-1", Target: target, Data: []byte(`{}`), Queued: now, Expires: now.Add(time.Hour)}
+}
+
+func wsids(cmds []*QueuedCommand) string {
+	result := ""
+	for _, cmd := range cmds {
+		result += cmd.Wsid + " "
+	}
+	return result
+}
+
+func TestCommandQueueOrder(t *testing.T) {
+	q, cleanup := tempQueue(t)
+	defer cleanup()
+
+	for _, cmd := range []*QueuedCommand{queued("w1", "a:b"), queued("w2", "a:b"), queued("x1", "other"), queued("w3", "a:b")} {
+		if err := q.Push(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := q.Len("a:b"); n != 3 {
+		t.Errorf("expected 3 queued commands, got %d", n)
+	}
+
+	cmds, err := q.Take("a:b")
+	if err != nil || wsids(cmds) != "w1 w2 w3 " {
+		t.Fatalf("unexpected commands %q, %v", wsids(cmds), err)
+	}
+	if again, _ := q.Take("a:b"); len(again) != 0 {
+		t.Errorf("commands taken twice: %q", wsids(again))
+	}
+
+	// commands stay queued until removed, newer ones after them
+	q.Push(queued("w4", "a:b"))
+	if err := q.Remove("a:b", 1); err != nil {
+		t.Fatal(err)
+	}
+	q.Release("a:b")
+	cmds, _ = q.Take("a:b")
+	if wsids(cmds) != "w2 w3 w4 " {
+		t.Errorf("unexpected commands after remove %q", wsids(cmds))
+	}
+
+	// queues survive reopening, taken or not
+	reopened, _ := NewCommandQueue(q.dir)
+	if cmds, _ := reopened.Take("a:b"); wsids(cmds) != "w2 w3 w4 " {
+		t.Errorf("unexpected commands after reopen %q", wsids(cmds))
+	}
+	if cmds, _ := reopened.Take("other"); wsids(cmds) != "x1 " {
+		t.Errorf("unexpected commands after reopen %q", wsids(cmds))
+	}
+	if err := reopened.Remove("other", 1); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := reopened.Len("other"); n != 0 {
+		t.Errorf("%d commands left after removing all", n)
+	}
+}
+
+func TestCommandQueueLimit(t *testing.T) {
+	q, cleanup := tempQueue(t)
+	defer cleanup()
+	q.Limit = 2
+
+	for i, wsid := range []string{"w1", "w2", "w3"} {
+		err := q.Push(queued(wsid, "sn"))
+		if (i < 2 && err != nil) || (i == 2 && err != QueueFullError) {
+			t.Errorf("push %s: %v", wsid, err)
+		}
+	}
+	if err := q.Push(queued("x1", "other")); err != nil {
+		t.Errorf("limit applies per sn: %v", err)
+	}
+}
+
+func TestCommandQueueTruncatedLine(t *testing.T) {
+	q, cleanup := tempQueue(t)
+	defer cleanup()
+
+	q.Push(queued("w1", "sn"))
+	file, _ := os.OpenFile(q.path("sn"), os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"wsid":"w2","fr`)
+	file.Close()
+
+	cmds, err := q.Take("sn")
+	if err != nil || wsids(cmds) != "w1 " {
+		t.Errorf("expected truncated command to be skipped, got %q, %v", wsids(cmds), err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// RouteAction says what the broker does with a message of a custom type.
+type RouteAction string
+
+const (
+	RouteReplyToFrom     RouteAction = "reply-to-from"     // answer to the rest command wsid sent by sn "from"
+	RouteBroadcastToRest RouteAction = "broadcast-to-rest" // send to the rest clients subscribed to the sender
+	RouteForwardToSn     RouteAction = "forward-to-sn"     // send to the client connected as "sn"
+	RouteDrop            RouteAction = "drop"              // ignore
+	RouteReject          RouteAction = "reject"            // answer with an unknown_type error
+)
+
+var routeActions = map[RouteAction]bool{
+	RouteReplyToFrom:     true,
+	RouteBroadcastToRest: true,
+	RouteForwardToSn:     true,
+	RouteDrop:            true,
+	RouteReject:          true,
+}
+
+// Route selects action for messages of Type sent by clients of CType. An
+// empty Type or CType matches any.
+type Route struct {
+	Type   string      `json:"type"`
+	CType  string      `json:"c_type"`
+	Action RouteAction `json:"action"`
+}
+
+// RoutingTable decides what happens with messages whose type is not built
+// into the broker. The first matching route wins, messages no route matches
+// get the Default action. It is read-only once loaded, so it is safe for
+// concurrent use.
+type RoutingTable struct {
+	Default RouteAction `json:"default"`
+	Routes  []Route     `json:"routes"`
+}
+
+// DefaultRoutingTable routes the answers of routers, TVs and air conditioners
+// back to the rest client and rejects anything else.
+func DefaultRoutingTable() *RoutingTable {
+	return &RoutingTable{
+		Default: RouteReject,
+		Routes: []Route{
+			{Type: "router", Action: RouteReplyToFrom},
+			{Type: "tv", Action: RouteReplyToFrom},
+			{Type: "cond", Action: RouteReplyToFrom},
+		},
+	}
+}
+
+// LoadRoutingTable reads routing table from file.
+func LoadRoutingTable(path string) (*RoutingTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRoutingTable(f)
+}
+
+// ParseRoutingTable reads a JSON routing table such as
+//
+//	{"default": "drop", "routes": [
+//	    {"type": "curtain", "action": "reply-to-from"},
+//	    {"type": "alarm", "c_type": "lock", "action": "broadcast-to-rest"}]}
+//
+// Default is "reject" if not given. Built-in message types can not be routed.
+func ParseRoutingTable(r io.Reader) (*RoutingTable, error) {
+	table := &RoutingTable{}
+	if err := json.NewDecoder(r).Decode(table); err != nil {
+		return nil, err
+	}
+	if table.Default == "" {
+		table.Default = RouteReject
+	}
+	if !routeActions[table.Default] {
+		return nil, fmt.Errorf("unknown default action %q", table.Default)
+	}
+	for i, route := range table.Routes {
+		switch {
+		case route.Type == "" && route.CType == "":
+			return nil, fmt.Errorf("route %d: type or c_type required", i+1)
+		case smarthome.IsBuiltinType(route.Type):
+			return nil, fmt.Errorf("route %d: %s messages are handled by the broker", i+1, route.Type)
+		case !routeActions[route.Action]:
+			return nil, fmt.Errorf("route %d: unknown action %q", i+1, route.Action)
+		}
+	}
+	return table, nil
+}
+
+// Lookup returns action for message of msgtype sent by a client of ctype.
+// Matched is false if the default action applies.
+func (t *RoutingTable) Lookup(msgtype, ctype string) (action RouteAction, matched bool) {
+	for _, route := range t.Routes {
+		if (route.Type == "" || route.Type == msgtype) && (route.CType == "" || route.CType == ctype) {
+			return route.Action, true
+		}
+	}
+	return t.Default, false
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"strings"
+	"testing"
+)
+
+const testRoutes = `{
+	"default": "drop",
+	"routes": [
+		{"type": "curtain", "action": "reply-to-from"},
+		{"type": "alarm", "c_type": "lock", "action": "broadcast-to-rest"},
+		{"type": "alarm", "action": "reject"},
+		{"c_type": "rest", "action": "forward-to-sn"}
+	]
+}`
+
+func TestRoutingTableLookup(t *testing.T) {
+	table, err := ParseRoutingTable(strings.NewReader(testRoutes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		msgtype, ctype string
+		action         RouteAction
+		matched        bool
+	}{
+		{"curtain", "curtain", RouteReplyToFrom, true},
+		{"alarm", "lock", RouteBroadcastToRest, true},
+		{"alarm", "tv", RouteReject, true},
+		{"anything", "rest", RouteForwardToSn, true},
+		{"router", "router", RouteDrop, false},
+	}
+	for _, test := range tests {
+		action, matched := table.Lookup(test.msgtype, test.ctype)
+		if action != test.action || matched != test.matched {
+			t.Errorf("%s from %s: got %s %v, expected %s %v", test.msgtype, test.ctype, action, matched, test.action, test.matched)
+		}
+	}
+
+	if action, matched := DefaultRoutingTable().Lookup("tv", "tv"); action != RouteReplyToFrom || !matched {
+		t.Errorf("default table should route tv replies, got %s", action)
+	}
+}
+
+func TestParseRoutingTableErrors(t *testing.T) {
+	for _, bad := range []string{
+		`not json`,
+		`{"default": "explode"}`,
+		`{"routes": [{"action": "drop"}]}`,
+		`{"routes": [{"type": "rest", "action": "drop"}]}`,
+		`{"routes": [{"type": "curtain", "action": "bounce"}]}`,
+	} {
+		if _, err := ParseRoutingTable(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+	table, err := ParseRoutingTable(strings.NewReader(`{"routes": []}`))
+	if err != nil || table.Default != RouteReject {
+		t.Errorf("expected reject as default action, got %v %v", table, err)
+	}
+}
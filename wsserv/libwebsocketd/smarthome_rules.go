@@ -0,0 +1,355 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// RulesSn is the sn automation rules use as "from" when they send commands
+// to devices, and their identity in the access list.
+const RulesSn = "rules"
+
+// Condition compares field Field of a notification's data with Value. Field
+// is a dot separated path into nested objects, e.g. "sensor.temperature".
+type Condition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// conditionOps are the operators a Condition may use. Numbers and strings
+// can be ordered, booleans and null only compared for equality. "exists"
+// ignores Value.
+var conditionOps = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "exists": true}
+
+// Matches reports whether data fulfills c.
+func (c *Condition) Matches(data map[string]interface{}) bool {
+	got, ok := lookupField(data, c.Field)
+	if c.Op == "exists" || !ok {
+		return ok
+	}
+	var cmp int
+	switch want := c.Value.(type) {
+	case float64:
+		n, ok := got.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case n < want:
+			cmp = -1
+		case n > want:
+			cmp = 1
+		}
+	case string:
+		s, ok := got.(string)
+		if !ok {
+			return false
+		}
+		switch {
+		case s < want:
+			cmp = -1
+		case s > want:
+			cmp = 1
+		}
+	default:
+		if got == c.Value {
+			cmp = 0
+		} else {
+			cmp = 1
+		}
+	}
+	switch c.Op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func lookupField(data map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// RuleTrigger selects the notifications a rule fires on. Empty Sn, CType or
+// MsgType match any, all Conditions must hold.
+type RuleTrigger struct {
+	Sn         string      `json:"sn"`
+	CType      string      `json:"c_type"`
+	MsgType    string      `json:"msgtype"`
+	Conditions []Condition `json:"conditions"`
+}
+
+// RuleAction is a rest command a rule sends to device Sn. If Persist is set
+// and Sn is offline, the command is queued like a persistent rest command.
+type RuleAction struct {
+	Sn      string          `json:"sn"`
+	Data    json.RawMessage `json:"data"`
+	Persist bool            `json:"persist"`
+}
+
+// Rule sends commands when a device reports a matching notification. After
+// firing for an sn it ignores notifications from that sn for Debounce. A
+// DryRun rule only logs what it would send.
+type Rule struct {
+	Name     string       `json:"name"`
+	Disabled bool         `json:"disabled"`
+	DryRun   bool         `json:"dry_run"`
+	Debounce string       `json:"debounce"`
+	When     RuleTrigger  `json:"when"`
+	Then     []RuleAction `json:"then"`
+
+	debounce time.Duration
+}
+
+// RuleStatus describes a rule in GET /api/rules responses.
+type RuleStatus struct {
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	DryRun    bool      `json:"dry_run"`
+	Fired     uint64    `json:"fired"`
+	LastFired time.Time `json:"last_fired"`
+}
+
+// RuleEngine matches notifications against automation rules. Rules can be
+// enabled and disabled while the server runs, everything else is read-only
+// once loaded. It is safe for concurrent use.
+type RuleEngine struct {
+	DryRun bool // only log what any rule would send
+
+	rules     []*Rule
+	mutex     sync.Mutex
+	enabled   map[string]bool
+	fired     map[string]uint64
+	last      map[string]time.Time // by rule name
+	lastFired map[string]time.Time // by rule name and sn, for debouncing
+}
+
+// LoadRules reads automation rules from file.
+func LoadRules(path string) (*RuleEngine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+// ParseRules reads JSON automation rules such as
+//
+//	{"rules": [{"name": "porch-light", "debounce": "5m",
+//	    "when": {"sn": "door-1", "msgtype": "door",
+//	             "conditions": [{"field": "state", "op": "==", "value": "open"}]},
+//	    "then": [{"sn": "light-1", "data": {"cmd": "on"}}]}]}
+//
+// Rule names must be unique.
+func ParseRules(r io.Reader) (*RuleEngine, error) {
+	var file struct {
+		Rules []*Rule `json:"rules"`
+	}
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+	e := &RuleEngine{
+		rules:     file.Rules,
+		enabled:   make(map[string]bool),
+		fired:     make(map[string]uint64),
+		last:      make(map[string]time.Time),
+		lastFired: make(map[string]time.Time),
+	}
+	for i, rule := range file.Rules {
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		if _, dup := e.enabled[rule.Name]; dup {
+			return nil, fmt.Errorf("rule %d: name %q is used twice", i+1, rule.Name)
+		}
+		e.enabled[rule.Name] = !rule.Disabled
+	}
+	return e, nil
+}
+
+func (rule *Rule) check() error {
+	if rule.Name == "" {
+		return fmt.Errorf("name required")
+	}
+	if rule.Debounce != "" {
+		d, err := time.ParseDuration(rule.Debounce)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid debounce %q", rule.Debounce)
+		}
+		rule.debounce = d
+	}
+	for _, c := range rule.When.Conditions {
+		if c.Field == "" {
+			return fmt.Errorf("condition field required")
+		}
+		if !conditionOps[c.Op] {
+			return fmt.Errorf("unknown operator %q", c.Op)
+		}
+		switch c.Value.(type) {
+		case float64, string:
+		case bool, nil:
+			if c.Op != "==" && c.Op != "!=" && c.Op != "exists" {
+				return fmt.Errorf("operator %s needs a number or a string", c.Op)
+			}
+		default:
+			return fmt.Errorf("condition value must be a number, string, boolean or null")
+		}
+	}
+	if len(rule.Then) == 0 {
+		return fmt.Errorf("no actions")
+	}
+	for _, action := range rule.Then {
+		msg := &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: rule.Name, Sn: action.Sn, Data: action.Data}
+		if err := msg.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns number of rules.
+func (e *RuleEngine) Len() int {
+	return len(e.rules)
+}
+
+// Fire returns the enabled rules matching notification m from a device of
+// ctype that are not debounced at now, and records that they fired.
+func (e *RuleEngine) Fire(m *smarthome.NotificationMessage, ctype string, now time.Time) []*Rule {
+	var data map[string]interface{}
+	json.Unmarshal(m.Data, &data)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var fired []*Rule
+	for _, rule := range e.rules {
+		if !e.enabled[rule.Name] || !rule.When.matches(m, ctype, data) {
+			continue
+		}
+		key := rule.Name + "\x00" + m.From
+		if last, ok := e.lastFired[key]; ok && now.Sub(last) < rule.debounce {
+			continue
+		}
+		e.lastFired[key] = now
+		e.last[rule.Name] = now
+		e.fired[rule.Name]++
+		fired = append(fired, rule)
+	}
+	return fired
+}
+
+func (t *RuleTrigger) matches(m *smarthome.NotificationMessage, ctype string, data map[string]interface{}) bool {
+	if (t.Sn != "" && t.Sn != m.From) || (t.CType != "" && t.CType != ctype) || (t.MsgType != "" && t.MsgType != m.MsgType) {
+		return false
+	}
+	for i := range t.Conditions {
+		if !t.Conditions[i].Matches(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetEnabled enables or disables rule name. It returns false if there is no
+// such rule.
+func (e *RuleEngine) SetEnabled(name string, enabled bool) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.enabled[name]; !ok {
+		return false
+	}
+	e.enabled[name] = enabled
+	return true
+}
+
+// Status describes the rules in file order.
+func (e *RuleEngine) Status() []*RuleStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	status := make([]*RuleStatus, 0, len(e.rules))
+	for _, rule := range e.rules {
+		status = append(status, &RuleStatus{
+			Name:      rule.Name,
+			Enabled:   e.enabled[rule.Name],
+			DryRun:    e.DryRun || rule.DryRun,
+			Fired:     e.fired[rule.Name],
+			LastFired: e.last[rule.Name],
+		})
+	}
+	return status
+}
+
+// ruleWsidSeq keeps wsids of rule commands unique.
+var ruleWsidSeq uint64
+
+// runRules sends the commands of the rules notification m from a device of
+// ctype fires.
+func (h *WebsocketdServer) runRules(m *smarthome.NotificationMessage, ctype string, log *LogScope) {
+	for _, rule := range h.Rules.Fire(m, ctype, time.Now()) {
+		for _, action := range rule.Then {
+			wsid := newWsid("rule-"+rule.Name, &ruleWsidSeq)
+			if h.Rules.DryRun || rule.DryRun {
+				log.Access("rules", "DRY RUN: rule %s fired by %s notification from sn %s would send %s to sn %s", rule.Name, m.MsgType, m.From, action.Data, action.Sn)
+				continue
+			}
+			log.Access("rules", "FIRED: rule %s by %s notification from sn %s, sending rest %s to sn %s", rule.Name, m.MsgType, m.From, wsid, action.Sn)
+			h.runRuleAction(rule, action, wsid, log)
+		}
+	}
+}
+
+func (h *WebsocketdServer) runRuleAction(rule *Rule, action RuleAction, wsid string, log *LogScope) {
+	if !h.canCommand(RulesSn, action.Sn) {
+		log.Access("rules", "FORBIDDEN: rule %s may not command sn %s", rule.Name, action.Sn)
+		h.audit(&AuditRecord{From: RulesSn, To: action.Sn, Wsid: wsid, Type: smarthome.TypeRest, Outcome: AuditForbidden}, action.Data, time.Time{})
+		return
+	}
+	if action.Persist && h.Devices.Lookup(action.Sn) == nil {
+		msg := &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: wsid, Sn: action.Sn, Data: action.Data, Persist: true}
+		if err := h.queueRest(RulesSn, msg, log); err != nil {
+			log.Access("rules", "REJECTED: rest %s of rule %s to sn %s: %s", wsid, rule.Name, action.Sn, err)
+		}
+		return
+	}
+	onReply := func(reply *smarthome.ResponseMessage) {
+		log.Debug("rules", "sn %s answered rest %s of rule %s: %s", action.Sn, wsid, rule.Name, reply.Data)
+	}
+	onTimeout := func() {
+		log.Access("rules", "TIMEOUT: sn %s did not answer rest %s of rule %s", action.Sn, wsid, rule.Name)
+	}
+	if err := h.forwardRest(NewPendingRequest(wsid, RulesSn, action.Sn, onReply, onTimeout), action.Data); err != nil {
+		log.Access("rules", "REJECTED: rest %s of rule %s to sn %s: %s", wsid, rule.Name, action.Sn, err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+const testRules = `{"rules": [
+	{"name": "tv-on", "debounce": "1m",
+	 "when": {"sn": "tv-1", "msgtype": "power", "conditions": [{"field": "state", "op": "==", "value": "on"}]},
+	 "then": [{"sn": "router-1", "data": {"cmd": "qos", "profile": "video"}}]},
+	{"name": "hot", "dry_run": true,
+	 "when": {"c_type": "cond", "conditions": [{"field": "sensor.temperature", "op": ">=", "value": 30}]},
+	 "then": [{"sn": "router-1", "data": {"cmd": "alert"}}]},
+	{"name": "off", "disabled": true,
+	 "when": {"msgtype": "power"},
+	 "then": [{"sn": "router-1", "data": {"cmd": "noop"}}]}
+]}`
+
+var conditionTests = []struct {
+	field, op string
+	value     interface{}
+	want      bool
+}{
+	{"state", "==", "on", true},
+	{"state", "!=", "on", false},
+	{"state", "<", "pn", true},
+	{"level", ">", 2.0, true},
+	{"level", "<=", 2.0, false},
+	{"level", "==", "3", false},
+	{"a.b", ">=", 1.5, true},
+	{"a.c", "exists", nil, false},
+	{"a", "exists", nil, true},
+	{"a.b.c", "==", 1.5, false},
+	{"flag", "==", true, true},
+	{"flag", "!=", false, true},
+	{"none", "==", nil, true},
+	{"missing", "!=", "x", false},
+}
+
+func TestConditionMatches(t *testing.T) {
+	var data map[string]interface{}
+	json.Unmarshal([]byte(`{"state":"on","level":3,"a":{"b":1.5},"flag":true,"none":null}`), &data)
+	for _, test := range conditionTests {
+		c := &Condition{Field: test.field, Op: test.op, Value: test.value}
+		if got := c.Matches(data); got != test.want {
+			t.Errorf("%s %s %v: got %t", test.field, test.op, test.value, got)
+		}
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, rules := range []string{
+		`{"rules": [{"then": [{"sn": "tv-1", "data": {}}]}]}`,
+		`{"rules": [{"name": "a"}]}`,
+		`{"rules": [{"name": "a", "then": [{"sn": "tv-1"}]}]}`,
+		`{"rules": [{"name": "a", "debounce": "soon", "then": [{"sn": "tv-1", "data": {}}]}]}`,
+		`{"rules": [{"name": "a", "when": {"conditions": [{"field": "x", "op": "~"}]}, "then": [{"sn": "tv-1", "data": {}}]}]}`,
+		`{"rules": [{"name": "a", "when": {"conditions": [{"field": "x", "op": "<", "value": true}]}, "then": [{"sn": "tv-1", "data": {}}]}]}`,
+		`{"rules": [{"name": "a", "when": {"conditions": [{"field": "x", "op": "==", "value": {}}]}, "then": [{"sn": "tv-1", "data": {}}]}]}`,
+		`{"rules": [{"name": "a", "then": [{"sn": "tv-1", "data": {}}]}, {"name": "a", "then": [{"sn": "tv-1", "data": {}}]}]}`,
+	} {
+		if _, err := ParseRules(strings.NewReader(rules)); err == nil {
+			t.Errorf("accepted %s", rules)
+		}
+	}
+}
+
+func TestRuleEngineFire(t *testing.T) {
+	e, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	on := &smarthome.NotificationMessage{From: "tv-1", MsgType: "power", Data: json.RawMessage(`{"msgtype":"power","state":"on"}`)}
+	off := &smarthome.NotificationMessage{From: "tv-1", MsgType: "power", Data: json.RawMessage(`{"msgtype":"power","state":"off"}`)}
+	now := time.Now()
+
+	if fired := e.Fire(off, "tv", now); len(fired) != 0 {
+		t.Errorf("fired %d rules", len(fired))
+	}
+	if fired := e.Fire(on, "tv", now); len(fired) != 1 || fired[0].Name != "tv-on" {
+		t.Errorf("fired %v", fired)
+	}
+	if fired := e.Fire(on, "tv", now.Add(30*time.Second)); len(fired) != 0 {
+		t.Error("debounced rule fired")
+	}
+	if fired := e.Fire(on, "tv", now.Add(2*time.Minute)); len(fired) != 1 {
+		t.Error("rule did not fire after debounce")
+	}
+
+	if !e.SetEnabled("off", true) || !e.SetEnabled("tv-on", false) || e.SetEnabled("nosuch", true) {
+		t.Fatal("SetEnabled failed")
+	}
+	if fired := e.Fire(on, "tv", now.Add(time.Hour)); len(fired) != 1 || fired[0].Name != "off" {
+		t.Errorf("fired %v", fired)
+	}
+	status := e.Status()
+	if len(status) != 3 || status[0].Fired != 2 || status[0].Enabled || status[2].Fired != 1 || !status[1].DryRun {
+		t.Errorf("unexpected status %+v %+v %+v", status[0], status[1], status[2])
+	}
+}
+
+func TestSmarthomeRules(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	rules, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Rules = rules
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	tv := b.connect("tv-1", "00:11:22:33:44:66", "tvsecret", "cond")
+	defer tv.Close()
+
+	// the dry run rule matches first, then tv-on sends its command
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "tv-1", "data": map[string]interface{}{"msgtype": "climate", "sensor": map[string]int{"temperature": 31}}})
+	tv.send(map[string]interface{}{"type": "notification", "wsid": "n2", "from": "tv-1", "data": map[string]string{"msgtype": "power", "state": "on"}})
+	cmd := router.receiveType("rest")
+	if cmd["from"] != RulesSn || cmd["data"].(map[string]interface{})["profile"] != "video" {
+		t.Fatalf("unexpected command %v", cmd)
+	}
+	router.send(map[string]interface{}{"type": "router", "wsid": cmd["wsid"], "from": RulesSn, "data": map[string]string{"status": "ok"}})
+
+	if status, reply := b.request("POST", "/api/rules/tv-on/disable", ""); status != http.StatusOK || reply["enabled"] != false {
+		t.Errorf("disable: %d %v", status, reply)
+	}
+	if status, _ := b.request("POST", "/api/rules/nosuch/enable", ""); status != http.StatusNotFound {
+		t.Errorf("enable of missing rule: %d", status)
+	}
+	status, reply := b.request("GET", "/api/rules", "")
+	if status != http.StatusOK || reply["count"] != 3.0 {
+		t.Errorf("rules: %d %v", status, reply)
+	}
+}
+
+func TestSmarthomeRulesForgedSender(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	rules, err := ParseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.server.Rules = rules
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+
+	// claiming to be tv-1 must not fire tv-on
+	app.send(map[string]interface{}{"type": "notification", "wsid": "n1", "from": "tv-1", "data": map[string]string{"msgtype": "power", "state": "on"}})
+	app.send(map[string]interface{}{"type": "rest", "wsid": "w1", "sn": "router-1", "data": map[string]string{}})
+	if cmd := router.receiveType("rest"); cmd["wsid"] != "w1" || cmd["from"] != "app-1" {
+		t.Errorf("forged notification fired %v", cmd)
+	}
+}
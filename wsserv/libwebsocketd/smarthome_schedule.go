@@ -0,0 +1,345 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// MaxScheduleRuns is the number of runs kept per schedule.
+const MaxScheduleRuns = 20
+
+// Results of a scheduled command in ScheduleRun.
+const (
+	RunAnswered  = "answered"  // device answered the command
+	RunTimeout   = "timeout"   // device did not answer in time
+	RunOffline   = "offline"   // device was not connected
+	RunForbidden = "forbidden" // owner may no longer command the device
+	RunRejected  = "rejected"  // command could not be sent
+)
+
+// ScheduleRun records one time a schedule fired.
+type ScheduleRun struct {
+	Time    time.Time `json:"time"`
+	Wsid    string    `json:"wsid"`
+	Status  string    `json:"status"`
+	Message string    `json:"message,omitempty"`
+}
+
+// Schedule sends Data to Sn as a rest command from Owner whenever Cron
+// matches, in the server's time zone.
+type Schedule struct {
+	Id      string          `json:"id"`
+	Name    string          `json:"name,omitempty"`
+	Cron    string          `json:"cron"`
+	Sn      string          `json:"sn"`
+	Data    json.RawMessage `json:"data"`
+	Owner   string          `json:"owner"`
+	Created time.Time       `json:"created"`
+	NextRun time.Time       `json:"next_run"`
+	Runs    []*ScheduleRun  `json:"runs"`
+
+	spec *CronSpec
+}
+
+// copy returns a copy of s with NextRun computed from now.
+func (s *Schedule) copy(now time.Time) *Schedule {
+	copied := *s
+	copied.Runs = append([]*ScheduleRun{}, s.Runs...)
+	copied.NextRun = s.spec.Next(now)
+	return &copied
+}
+
+type scheduleList []*Schedule
+
+func (l scheduleList) Len() int { return len(l) }
+func (l scheduleList) Less(i, j int) bool {
+	a, _ := strconv.ParseInt(l[i].Id, 10, 64)
+	b, _ := strconv.ParseInt(l[j].Id, 10, 64)
+	return a < b
+}
+func (l scheduleList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+// ScheduleStore keeps schedules and their recent runs in a JSON file, which
+// is rewritten on every change. It is safe for concurrent use.
+type ScheduleStore struct {
+	path      string
+	mutex     sync.Mutex
+	nextId    int64
+	schedules map[string]*Schedule
+}
+
+// scheduleFile is the content of the schedule file.
+type scheduleFile struct {
+	NextId    int64       `json:"next_id"`
+	Schedules []*Schedule `json:"schedules"`
+}
+
+// OpenScheduleStore reads the schedules stored in path. A missing file is
+// created with the first schedule.
+func OpenScheduleStore(path string) (*ScheduleStore, error) {
+	s := &ScheduleStore{path: path, nextId: 1, schedules: make(map[string]*Schedule)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file scheduleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for _, sched := range file.Schedules {
+		if sched.spec, err = ParseCron(sched.Cron); err != nil {
+			return nil, fmt.Errorf("schedule %s: %s", sched.Id, err)
+		}
+		s.schedules[sched.Id] = sched
+	}
+	if file.NextId > s.nextId {
+		s.nextId = file.NextId
+	}
+	return s, nil
+}
+
+// Add validates sched, assigns its Id and stores it. Invalid schedules are
+// rejected with a smarthome.ErrorMessage.
+func (s *ScheduleStore) Add(sched *Schedule) (*Schedule, error) {
+	spec, err := ParseCron(sched.Cron)
+	if err != nil {
+		return nil, smarthome.NewError(smarthome.CodeBadMessage, "", err.Error())
+	}
+	msg := &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: "schedule", Sn: sched.Sn, Data: sched.Data}
+	if err := msg.Validate(); err != nil {
+		reply := smarthome.ErrorReply(smarthome.CodeBadMessage, "", err)
+		return nil, smarthome.NewError(reply.Code, "", reply.Message)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	stored := &Schedule{
+		Id:      strconv.FormatInt(s.nextId, 10),
+		Name:    sched.Name,
+		Cron:    sched.Cron,
+		Sn:      sched.Sn,
+		Data:    sched.Data,
+		Owner:   sched.Owner,
+		Created: now,
+		Runs:    []*ScheduleRun{},
+		spec:    spec,
+	}
+	s.nextId++
+	s.schedules[stored.Id] = stored
+	if err := s.save(); err != nil {
+		delete(s.schedules, stored.Id)
+		return nil, err
+	}
+	return stored.copy(now), nil
+}
+
+// Get returns schedule id, or nil.
+func (s *ScheduleStore) Get(id string) *Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sched := s.schedules[id]
+	if sched == nil {
+		return nil
+	}
+	return sched.copy(time.Now())
+}
+
+// List returns the schedules of owner, or all if owner is empty, in the order
+// they were created.
+func (s *ScheduleStore) List(owner string) []*Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	list := scheduleList{}
+	for _, sched := range s.schedules {
+		if owner == "" || sched.Owner == owner {
+			list = append(list, sched.copy(now))
+		}
+	}
+	sort.Sort(list)
+	return list
+}
+
+// Delete removes schedule id. It returns false if there is no such schedule.
+func (s *ScheduleStore) Delete(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sched := s.schedules[id]
+	if sched == nil {
+		return false, nil
+	}
+	delete(s.schedules, id)
+	if err := s.save(); err != nil {
+		s.schedules[id] = sched
+		return false, err
+	}
+	return true, nil
+}
+
+// Due returns the schedules firing in the minute of t.
+func (s *ScheduleStore) Due(t time.Time) []*Schedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	due := scheduleList{}
+	for _, sched := range s.schedules {
+		if sched.spec.Matches(t) {
+			due = append(due, sched.copy(t))
+		}
+	}
+	sort.Sort(due)
+	return due
+}
+
+// Record adds run to the runs of schedule id, dropping the oldest beyond
+// MaxScheduleRuns. Runs of deleted schedules are ignored.
+func (s *ScheduleStore) Record(id string, run *ScheduleRun) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sched := s.schedules[id]
+	if sched == nil {
+		return nil
+	}
+	sched.Runs = append(sched.Runs, run)
+	if len(sched.Runs) > MaxScheduleRuns {
+		sched.Runs = sched.Runs[len(sched.Runs)-MaxScheduleRuns:]
+	}
+	return s.save()
+}
+
+func (s *ScheduleStore) save() error {
+	file := scheduleFile{NextId: s.nextId, Schedules: scheduleList{}}
+	for _, sched := range s.schedules {
+		file.Schedules = append(file.Schedules, sched)
+	}
+	sort.Sort(scheduleList(file.Schedules))
+	data, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// RunSchedules fires the stored schedules at the start of every minute until
+// stop is closed.
+func (h *WebsocketdServer) RunSchedules(stop <-chan struct{}) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			h.runSchedules(next, h.Log)
+		}
+	}
+}
+
+// runSchedules fires the schedules due in the minute of now.
+func (h *WebsocketdServer) runSchedules(now time.Time, log *LogScope) {
+	for _, sched := range h.Schedules.Due(now) {
+		h.runSchedule(sched, now, log)
+	}
+}
+
+// runSchedule sends the command of sched and records the result.
+func (h *WebsocketdServer) runSchedule(sched *Schedule, now time.Time, log *LogScope) {
+	wsid := "schedule-" + sched.Id + "-" + strconv.FormatInt(now.Unix(), 10)
+	record := func(status, message string) {
+		log.Access("schedule", "RUN %s: schedule %s of %s, rest %s to sn %s %s", status, sched.Id, sched.Owner, wsid, sched.Sn, message)
+		run := &ScheduleRun{Time: now, Wsid: wsid, Status: status, Message: message}
+		if err := h.Schedules.Record(sched.Id, run); err != nil {
+			log.Error("schedule", "Could not record run of schedule %s: %s", sched.Id, err)
+		}
+	}
+	if !h.canCommand(sched.Owner, sched.Sn) {
+		h.audit(&AuditRecord{From: sched.Owner, To: sched.Sn, Wsid: wsid, Type: smarthome.TypeRest, Outcome: AuditForbidden}, sched.Data, time.Time{})
+		record(RunForbidden, "not allowed to command sn "+sched.Sn)
+		return
+	}
+	onReply := func(reply *smarthome.ResponseMessage) {
+		record(RunAnswered, "")
+	}
+	onTimeout := func() {
+		record(RunTimeout, "sn "+sched.Sn+" did not answer")
+	}
+	err := h.forwardRest(NewPendingRequest(wsid, sched.Owner, sched.Sn, onReply, onTimeout), sched.Data)
+	if err != nil {
+		reply := smarthome.ErrorReply(codeInternal, wsid, err)
+		if reply.Code == smarthome.CodeTargetOffline {
+			record(RunOffline, reply.Message)
+		} else {
+			record(RunRejected, reply.Message)
+		}
+	}
+}
+
+// scheduleReply answers ScheduleMessage.
+type scheduleReply struct {
+	Type      string      `json:"type"`
+	Wsid      string      `json:"wsid"`
+	Status    string      `json:"status"`
+	Schedule  *Schedule   `json:"schedule,omitempty"`
+	Schedules []*Schedule `json:"schedules,omitempty"`
+}
+
+// smarthomeSchedule manages the schedules owned by this client.
+func (ss *smarthomeSession) smarthomeSchedule(m *smarthome.ScheduleMessage, log *LogScope) {
+	endpoint := ss.BindDevice.Endpoint
+	store := ss.Server.Schedules
+	if store == nil {
+		endpoint.SendMessage(smarthome.NewError(smarthome.CodeNoSchedule, m.Wsid, "schedules are disabled"))
+		return
+	}
+	reply := &scheduleReply{Type: smarthome.TypeSchedule, Wsid: m.Wsid, Status: "ok"}
+	switch m.Action {
+	case smarthome.ScheduleCreate:
+		if !ss.Server.canCommand(ss.BindSn, m.Sn) {
+			log.Access("smarthome", "FORBIDDEN: schedule %s of %s to sn %s", m.Wsid, ss.BindSn, m.Sn)
+			endpoint.SendMessage(smarthome.NewError(smarthome.CodeForbidden, m.Wsid, "not allowed to command sn "+m.Sn))
+			return
+		}
+		sched, err := store.Add(&Schedule{Name: m.Name, Cron: m.Cron, Sn: m.Sn, Data: m.Data, Owner: ss.BindSn})
+		if err != nil {
+			log.Access("smarthome", "REJECTED: schedule %s of %s: %s", m.Wsid, ss.BindSn, err)
+			reply := smarthome.ErrorReply(codeInternal, m.Wsid, err)
+			endpoint.SendMessage(smarthome.NewError(reply.Code, m.Wsid, reply.Message))
+			return
+		}
+		log.Access("smarthome", "SCHEDULED: schedule %s of %s, %q to sn %s", sched.Id, ss.BindSn, sched.Cron, sched.Sn)
+		reply.Schedule = sched
+	case smarthome.ScheduleList:
+		reply.Schedules = store.List(ss.BindSn)
+	case smarthome.ScheduleDelete:
+		sched := store.Get(m.Id)
+		if sched == nil || sched.Owner != ss.BindSn {
+			endpoint.SendMessage(smarthome.NewError(smarthome.CodeNoSchedule, m.Wsid, "no schedule "+m.Id))
+			return
+		}
+		if _, err := store.Delete(m.Id); err != nil {
+			log.Error("smarthome", "Could not delete schedule %s: %s", m.Id, err)
+			endpoint.SendMessage(smarthome.NewError(codeInternal, m.Wsid, "could not delete schedule"))
+			return
+		}
+		log.Access("smarthome", "UNSCHEDULED: schedule %s of %s", m.Id, ss.BindSn)
+	}
+	endpoint.SendMessage(reply)
+}
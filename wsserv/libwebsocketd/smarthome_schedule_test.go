@@ -0,0 +1,171 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempSchedules opens an empty schedule store in a temporary directory.
+func tempSchedules(t *testing.T) (*ScheduleStore, func()) {
+	dir, cleanup := tempDir(t, "schedules")
+	store, err := OpenScheduleStore(filepath.Join(dir, "schedules.json"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return store, cleanup
+}
+
+func TestScheduleStore(t *testing.T) {
+	store, cleanup := tempSchedules(t)
+	defer cleanup()
+
+	if _, err := store.Add(&Schedule{Cron: "0 25 * * *", Sn: "tv-1", Data: json.RawMessage(`{}`), Owner: "app-1"}); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("invalid cron: %v", err)
+	}
+	if _, err := store.Add(&Schedule{Cron: "* * * * *", Sn: "tv-1", Data: json.RawMessage(`[]`), Owner: "app-1"}); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("invalid data: %v", err)
+	}
+	first, err := store.Add(&Schedule{Name: "off", Cron: "0 23 * * *", Sn: "tv-1", Data: json.RawMessage(`{"cmd":"off"}`), Owner: "app-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := store.Add(&Schedule{Cron: "30 7 * * 1-5", Sn: "router-1", Data: json.RawMessage(`{"cmd":"on"}`), Owner: "app-2"})
+	if first.Id != "1" || second.Id != "2" || first.NextRun.Hour() != 23 {
+		t.Errorf("unexpected schedules %+v %+v", first, second)
+	}
+
+	at := time.Date(2016, 3, 1, 23, 0, 0, 0, time.Local)
+	if due := store.Due(at); len(due) != 1 || due[0].Id != "1" {
+		t.Errorf("due %v", due)
+	}
+	for i := 0; i < MaxScheduleRuns+5; i++ {
+		store.Record("1", &ScheduleRun{Time: at.Add(time.Duration(i) * time.Minute), Status: RunOffline})
+	}
+	store.Delete("2")
+
+	reopened, err := OpenScheduleStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := reopened.List("")
+	if len(list) != 1 || list[0].Name != "off" || len(list[0].Runs) != MaxScheduleRuns || !list[0].Runs[0].Time.Equal(at.Add(5*time.Minute)) {
+		t.Fatalf("reopened %v", list)
+	}
+	third, _ := reopened.Add(&Schedule{Cron: "* * * * *", Sn: "tv-1", Data: json.RawMessage(`{}`), Owner: "app-1"})
+	if third.Id != "3" {
+		t.Errorf("id %s reused", third.Id)
+	}
+	if len(reopened.List("app-2")) != 0 || len(reopened.List("app-1")) != 2 {
+		t.Error("List does not filter by owner")
+	}
+}
+
+func TestSmarthomeScheduleMessages(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	store, cleanup := tempSchedules(t)
+	defer cleanup()
+	b.server.Schedules = store
+
+	app := b.connect("app-1", "-", "appsecret", "rest")
+	defer app.Close()
+	other := b.connect("app-2", "-", "appsecret", "rest")
+	defer other.Close()
+
+	app.send(map[string]interface{}{"type": "schedule", "wsid": "s1", "action": "create", "name": "off", "cron": "0 23 * * *", "sn": "tv-1", "data": map[string]string{"cmd": "off"}})
+	created := app.receiveType("schedule")
+	sched, _ := created["schedule"].(map[string]interface{})
+	if created["wsid"] != "s1" || sched["id"] != "1" || sched["owner"] != "app-1" {
+		t.Fatalf("create: %v", created)
+	}
+	app.send(map[string]interface{}{"type": "schedule", "wsid": "s2", "action": "create", "cron": "0 99 * * *", "sn": "tv-1", "data": map[string]string{}})
+	expectError(t, app.receive(), "bad_message", "s2")
+
+	other.send(map[string]interface{}{"type": "schedule", "wsid": "s3", "action": "delete", "id": "1"})
+	expectError(t, other.receive(), "no_schedule", "s3")
+	other.send(map[string]interface{}{"type": "schedule", "wsid": "s4", "action": "list"})
+	if list := other.receiveType("schedule"); list["schedules"] != nil {
+		t.Errorf("app-2 sees %v", list)
+	}
+
+	app.send(map[string]interface{}{"type": "schedule", "wsid": "s5", "action": "delete", "id": "1"})
+	if reply := app.receiveType("schedule"); reply["status"] != "ok" {
+		t.Errorf("delete: %v", reply)
+	}
+	if len(store.List("")) != 0 {
+		t.Error("schedule not deleted")
+	}
+}
+
+func TestSmarthomeScheduleRuns(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	store, cleanup := tempSchedules(t)
+	defer cleanup()
+	b.server.Schedules = store
+
+	sched, err := store.Add(&Schedule{Cron: "0 23 * * *", Sn: "router-1", Data: json.RawMessage(`{"cmd":"off"}`), Owner: "app-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2016, 3, 1, 23, 0, 0, 0, time.Local)
+	b.server.runSchedules(at.Add(time.Minute), testLogScope())
+	b.server.runSchedules(at, testLogScope())
+	if runs := store.Get(sched.Id).Runs; len(runs) != 1 || runs[0].Status != RunOffline {
+		t.Fatalf("runs while offline %v", runs)
+	}
+
+	router := b.connect("router-1", "00:11:22:33:44:55", "routersecret", "router")
+	defer router.Close()
+	b.server.runSchedules(at.AddDate(0, 0, 1), testLogScope())
+	cmd := router.receiveType("rest")
+	if cmd["from"] != "app-1" || cmd["data"].(map[string]interface{})["cmd"] != "off" {
+		t.Fatalf("unexpected command %v", cmd)
+	}
+	router.send(map[string]interface{}{"type": "router", "wsid": cmd["wsid"], "from": "app-1", "data": map[string]string{"status": "ok"}})
+	b.waitFor("answered run", func() bool {
+		runs := store.Get(sched.Id).Runs
+		return len(runs) == 2 && runs[1].Status == RunAnswered && runs[1].Wsid == cmd["wsid"]
+	})
+}
+
+func TestSmarthomeScheduleAPI(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+
+	if status, _ := b.request("GET", "/api/schedules", ""); status != http.StatusNotFound {
+		t.Errorf("schedules while disabled: %d", status)
+	}
+	store, cleanup := tempSchedules(t)
+	defer cleanup()
+	b.server.Schedules = store
+
+	status, created := b.request("POST", "/api/schedules", `{"cron":"*/5 * * * *","sn":"tv-1","data":{"cmd":"poll"}}`)
+	if status != http.StatusCreated || created["owner"] != APISn || created["id"] != "1" {
+		t.Fatalf("create: %d %v", status, created)
+	}
+	if status, _ := b.request("POST", "/api/schedules", `{"cron":"often","sn":"tv-1","data":{}}`); status != http.StatusBadRequest {
+		t.Errorf("invalid cron: %d", status)
+	}
+	if status, reply := b.request("GET", "/api/schedules", ""); status != http.StatusOK || reply["count"] != 1.0 {
+		t.Errorf("list: %d %v", status, reply)
+	}
+	if status, reply := b.request("GET", "/api/schedules/1", ""); status != http.StatusOK || reply["cron"] != "*/5 * * * *" {
+		t.Errorf("get: %d %v", status, reply)
+	}
+	if status, _ := b.request("DELETE", "/api/schedules/1", ""); status != http.StatusOK {
+		t.Errorf("delete: %d", status)
+	}
+	if status, _ := b.request("DELETE", "/api/schedules/1", ""); status != http.StatusNotFound {
+		t.Errorf("second delete: %d", status)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+	"golang.org/x/net/websocket"
+)
+
+// SimulatorConfig describes the fake smarthome clients a Simulator opens.
+type SimulatorConfig struct {
+	URL         string                     // ws:// or wss:// URL of the smarthome broker
+	Origin      string                     // Origin header, derived from URL if empty
+	Devices     []*DeviceCredential        // Simulated devices
+	CTypes      []string                   // c_types assigned to the devices in turn
+	Responses   map[string]json.RawMessage // Response data by "cmd" of the command, echo if not listed
+	NotifyEvery time.Duration              // Interval between notifications of each device, 0 for none
+	MsgType     string                     // msgtype of the notifications
+	Clients     []*DeviceCredential        // Rest clients sending commands to the devices in turn
+	Rate        float64                    // Commands per second sent by each client
+	Command     json.RawMessage            // Data of the commands
+}
+
+// SimulatorStats summarizes what the simulated clients did. Latencies are
+// round trips of commands answered by the devices.
+type SimulatorStats struct {
+	Devices       int // devices connected
+	Sent          uint64
+	Answered      uint64
+	Errors        uint64 // commands answered with an error other than timeout
+	Timeouts      uint64
+	Notifications uint64
+	P50, P90, P99 time.Duration
+	Max           time.Duration
+}
+
+func (s SimulatorStats) String() string {
+	return fmt.Sprintf("devices %d, commands sent %d, answered %d, errors %d, timeouts %d, notifications %d, latency p50 %s p90 %s p99 %s max %s",
+		s.Devices, s.Sent, s.Answered, s.Errors, s.Timeouts, s.Notifications, s.P50, s.P90, s.P99, s.Max)
+}
+
+// LatencyRecorder collects durations for percentiles. It is safe for
+// concurrent use.
+type LatencyRecorder struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+}
+
+func (r *LatencyRecorder) Add(d time.Duration) {
+	r.mutex.Lock()
+	r.samples = append(r.samples, d)
+	r.mutex.Unlock()
+}
+
+// Percentile returns the duration below or at which p percent of the
+// samples are, 0 if there are none.
+func (r *LatencyRecorder) Percentile(p float64) time.Duration {
+	r.mutex.Lock()
+	sorted := make([]time.Duration, len(r.samples))
+	copy(sorted, r.samples)
+	r.mutex.Unlock()
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Sort(durations(sorted))
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+type durations []time.Duration
+
+func (l durations) Len() int           { return len(l) }
+func (l durations) Less(i, j int) bool { return l[i] < l[j] }
+func (l durations) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// Simulator runs fake devices and rest clients against a smarthome broker,
+// for development and load testing. Devices authenticate and connect with
+// the credentials of the registry, answer rest commands and send periodic
+// notifications. Rest clients send commands to the devices at a fixed rate
+// and measure how long the answers take.
+type Simulator struct {
+	config   *SimulatorConfig
+	log      *LogScope
+	latency  LatencyRecorder
+	devices  int64
+	sent     uint64
+	answered uint64
+	errors   uint64
+	timeouts uint64
+	notified uint64
+}
+
+func NewSimulator(config *SimulatorConfig, log *LogScope) *Simulator {
+	return &Simulator{config: config, log: log}
+}
+
+// Stats returns what the simulated clients did so far.
+func (s *Simulator) Stats() SimulatorStats {
+	return SimulatorStats{
+		Devices:       int(atomic.LoadInt64(&s.devices)),
+		Sent:          atomic.LoadUint64(&s.sent),
+		Answered:      atomic.LoadUint64(&s.answered),
+		Errors:        atomic.LoadUint64(&s.errors),
+		Timeouts:      atomic.LoadUint64(&s.timeouts),
+		Notifications: atomic.LoadUint64(&s.notified),
+		P50:           s.latency.Percentile(50),
+		P90:           s.latency.Percentile(90),
+		P99:           s.latency.Percentile(99),
+		Max:           s.latency.Percentile(100),
+	}
+}
+
+// Run connects the devices and clients and runs them until stop is closed.
+// It returns an error if one of them could not connect.
+func (s *Simulator) Run(stop <-chan struct{}) error {
+	origin := s.config.Origin
+	if origin == "" {
+		u, err := url.Parse(s.config.URL)
+		if err != nil {
+			return err
+		}
+		origin = "http://" + u.Host
+	}
+
+	conns := make([]*websocket.Conn, len(s.config.Devices)+len(s.config.Clients))
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i := range conns {
+		cred, ctype := s.client(i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], errs[i] = simulatorConnect(s.config.URL, origin, cred, ctype)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("sn %s: %s", cred.Sn, errs[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+	defer func() {
+		for _, ws := range conns {
+			if ws != nil {
+				ws.Close()
+			}
+		}
+	}()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, ws := range conns {
+		cred, ctype := s.client(i)
+		if i < len(s.config.Devices) {
+			atomic.AddInt64(&s.devices, 1)
+			go s.runDevice(ws, cred.Sn, ctype, stop)
+		} else {
+			go s.runClient(ws, cred.Sn, i-len(s.config.Devices), stop)
+		}
+	}
+	<-stop
+	return nil
+}
+
+// client returns the credential and c_type of the i-th connection, the
+// devices followed by the rest clients.
+func (s *Simulator) client(i int) (*DeviceCredential, string) {
+	if i >= len(s.config.Devices) {
+		return s.config.Clients[i-len(s.config.Devices)], smarthome.TypeRest
+	}
+	if len(s.config.CTypes) == 0 {
+		return s.config.Devices[i], "device"
+	}
+	return s.config.Devices[i], s.config.CTypes[i%len(s.config.CTypes)]
+}
+
+// simulatorConnect opens a connection and performs auth and connect as cred.
+func simulatorConnect(url, origin string, cred *DeviceCredential, ctype string) (*websocket.Conn, error) {
+	ws, err := websocket.Dial(url, "", origin)
+	if err != nil {
+		return nil, err
+	}
+	ws.SetDeadline(time.Now().Add(10 * time.Second))
+	var token smarthome.AuthReply
+	err = websocket.JSON.Send(ws, &smarthome.AuthMessage{Type: smarthome.TypeAuth, Sn: cred.Sn, Mac: cred.Mac, Secret: cred.Secret})
+	if err == nil {
+		err = receiveSimulatorReply(ws, &token)
+	}
+	if err == nil {
+		var reply smarthome.ConnectReply
+		err = websocket.JSON.Send(ws, &smarthome.ConnectMessage{Type: smarthome.TypeConnect, Sn: cred.Sn, Token: token.Token, CType: ctype})
+		if err == nil {
+			err = receiveSimulatorReply(ws, &reply)
+		}
+	}
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	ws.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// receiveSimulatorReply reads the reply to auth or connect into v.
+func receiveSimulatorReply(ws *websocket.Conn, v interface{}) error {
+	var raw json.RawMessage
+	if err := websocket.JSON.Receive(ws, &raw); err != nil {
+		return err
+	}
+	var failed smarthome.ErrorMessage
+	if json.Unmarshal(raw, &failed) == nil && failed.Type == smarthome.TypeError {
+		return &failed
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// runDevice answers the commands sent to a simulated device and sends its
+// notifications.
+func (s *Simulator) runDevice(ws *websocket.Conn, sn, ctype string, stop <-chan struct{}) {
+	if s.config.NotifyEvery > 0 {
+		go s.notify(ws, sn, stop)
+	}
+	for {
+		var cmd smarthome.RestMessage
+		if err := websocket.JSON.Receive(ws, &cmd); err != nil {
+			s.log.Debug("simulate", "sn %s: Cannot receive: %s", sn, err)
+			return
+		}
+		if cmd.Type != smarthome.TypeRest {
+			continue
+		}
+		reply := &smarthome.ResponseMessage{Type: ctype, Wsid: cmd.Wsid, From: cmd.From, Data: s.response(cmd.Data)}
+		if err := websocket.JSON.Send(ws, reply); err != nil {
+			s.log.Debug("simulate", "sn %s: Cannot send: %s", sn, err)
+			return
+		}
+	}
+}
+
+// response returns the scripted response to a command with data, or data.
+func (s *Simulator) response(data json.RawMessage) json.RawMessage {
+	var cmd struct {
+		Cmd string `json:"cmd"`
+	}
+	if json.Unmarshal(data, &cmd) == nil {
+		if response, ok := s.config.Responses[cmd.Cmd]; ok {
+			return response
+		}
+	}
+	return data
+}
+
+// notify sends a notification of a simulated device every NotifyEvery.
+func (s *Simulator) notify(ws *websocket.Conn, sn string, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.config.NotifyEvery)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			data, _ := json.Marshal(map[string]interface{}{"msgtype": s.config.MsgType, "seq": seq, "sent": now.UnixNano()})
+			n := &smarthome.NotificationMessage{Type: smarthome.TypeNotification, Wsid: "sim-" + strconv.Itoa(seq), From: sn, Data: data}
+			if err := websocket.JSON.Send(ws, n); err != nil {
+				return
+			}
+			atomic.AddUint64(&s.notified, 1)
+		}
+	}
+}
+
+// runClient sends commands to the devices in turn, starting with the
+// client's index, and records the round trips.
+func (s *Simulator) runClient(ws *websocket.Conn, sn string, index int, stop <-chan struct{}) {
+	var mutex sync.Mutex
+	sent := make(map[string]time.Time)
+	go func() {
+		for {
+			var reply smarthome.ErrorMessage
+			var raw json.RawMessage
+			if err := websocket.JSON.Receive(ws, &raw); err != nil {
+				return
+			}
+			if json.Unmarshal(raw, &reply) != nil {
+				continue
+			}
+			mutex.Lock()
+			start, ok := sent[reply.Wsid]
+			delete(sent, reply.Wsid)
+			mutex.Unlock()
+			switch {
+			case !ok:
+			case reply.Type == smarthome.TypeRest:
+				s.latency.Add(time.Since(start))
+				atomic.AddUint64(&s.answered, 1)
+			case reply.Type == smarthome.TypeError && reply.Code == smarthome.CodeTimeout:
+				atomic.AddUint64(&s.timeouts, 1)
+			case reply.Type == smarthome.TypeError:
+				s.log.Debug("simulate", "sn %s: command %s failed: %s", sn, reply.Wsid, reply.Message)
+				atomic.AddUint64(&s.errors, 1)
+			}
+		}
+	}()
+
+	if s.config.Rate <= 0 || len(s.config.Devices) == 0 {
+		<-stop
+		return
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / s.config.Rate))
+	defer ticker.Stop()
+	for seq := index; ; seq++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		target := s.config.Devices[seq%len(s.config.Devices)].Sn
+		wsid := sn + "-" + strconv.Itoa(seq)
+		mutex.Lock()
+		sent[wsid] = time.Now()
+		mutex.Unlock()
+		cmd := &smarthome.RestMessage{Type: smarthome.TypeRest, Wsid: wsid, Sn: target, Data: s.config.Command}
+		if err := websocket.JSON.Send(ws, cmd); err != nil {
+			s.log.Debug("simulate", "sn %s: Cannot send: %s", sn, err)
+			return
+		}
+		atomic.AddUint64(&s.sent, 1)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyRecorder(t *testing.T) {
+	var r LatencyRecorder
+	if r.Percentile(50) != 0 {
+		t.Error("percentile without samples")
+	}
+	for i := 100; i >= 1; i-- {
+		r.Add(time.Duration(i) * time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{50: 50 * time.Millisecond, 99: 99 * time.Millisecond, 100: 100 * time.Millisecond, 0: time.Millisecond} {
+		if got := r.Percentile(p); got != want {
+			t.Errorf("p%g = %s, want %s", p, got, want)
+		}
+	}
+}
+
+func TestSimulator(t *testing.T) {
+	b := newTestBroker(t, &Config{})
+	defer b.Close()
+	app := b.connect("app-2", "-", "appsecret", "rest")
+	defer app.Close()
+	app.subscribe(map[string]interface{}{"wsid": "s1", "msgtypes": []string{"simulated"}})
+
+	credentials := b.server.Credentials.List()
+	if len(credentials) != 4 || credentials[0].Sn != "app-1" || credentials[3].Sn != "tv-1" {
+		t.Fatalf("credentials %v", credentials)
+	}
+	sim := NewSimulator(&SimulatorConfig{
+		URL:         "ws" + strings.TrimPrefix(b.http.URL, "http") + "/",
+		Devices:     credentials[2:],
+		CTypes:      []string{"router", "tv"},
+		Responses:   map[string]json.RawMessage{"status": json.RawMessage(`{"power":"on"}`)},
+		NotifyEvery: 20 * time.Millisecond,
+		MsgType:     "simulated",
+		Clients:     credentials[:1],
+		Rate:        100,
+		Command:     json.RawMessage(`{"cmd":"status"}`),
+	}, testLogScope())
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- sim.Run(stop) }()
+
+	b.waitFor("answered commands", func() bool { return sim.Stats().Answered >= 10 })
+	msg := app.receiveType("notification")
+	if data, _ := msg["data"].(map[string]interface{}); data["msgtype"] != "simulated" {
+		t.Errorf("notification %v", msg)
+	}
+	if entry := b.server.Devices.Lookup("tv-1"); entry == nil || entry.CType != "tv" {
+		t.Errorf("tv-1 connected as %v", entry)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	stats := sim.Stats()
+	if stats.Devices != 2 || stats.Errors != 0 || stats.Timeouts != 0 || stats.P50 <= 0 || stats.Max < stats.P99 {
+		t.Errorf("stats %s", stats)
+	}
+
+	failing := NewSimulator(&SimulatorConfig{
+		URL:     "ws" + strings.TrimPrefix(b.http.URL, "http") + "/",
+		Devices: []*DeviceCredential{&DeviceCredential{Sn: "tv-1", Mac: "00:11:22:33:44:66", Secret: "wrong"}},
+	}, testLogScope())
+	if err := failing.Run(stop); err == nil || !strings.Contains(err.Error(), "auth_failed") {
+		t.Errorf("expected auth failure, got %v", err)
+	}
+}
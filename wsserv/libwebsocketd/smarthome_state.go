@@ -0,0 +1,103 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// MaxStatesPerDevice is the number of msgtypes kept per sn. Devices choose
+// msgtypes freely, so the cache evicts the least recently updated ones.
+const MaxStatesPerDevice = 32
+
+// StateCache keeps the latest notification of each msgtype per sn, so rest
+// clients that connect later learn the current device state.
+// It is safe for concurrent use.
+type StateCache struct {
+	mutex  sync.RWMutex
+	seq    uint64
+	states map[string]map[string]*cachedState
+}
+
+type cachedState struct {
+	msg     *smarthome.NotificationMessage
+	updated uint64 // value of StateCache.seq when msg was stored
+}
+
+func NewStateCache() *StateCache {
+	return &StateCache{states: make(map[string]map[string]*cachedState)}
+}
+
+// Update stores m as the latest notification of its msgtype from m.From,
+// evicting the least recently updated msgtype of m.From beyond
+// MaxStatesPerDevice.
+func (c *StateCache) Update(m *smarthome.NotificationMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.seq++
+	device, ok := c.states[m.From]
+	if !ok {
+		device = make(map[string]*cachedState)
+		c.states[m.From] = device
+	}
+	device[m.MsgType] = &cachedState{msg: m, updated: c.seq}
+	if len(device) > MaxStatesPerDevice {
+		oldest := m.MsgType
+		for msgtype, state := range device {
+			if state.updated < device[oldest].updated {
+				oldest = msgtype
+			}
+		}
+		delete(device, oldest)
+	}
+}
+
+// Forget drops the notifications from sn.
+func (c *StateCache) Forget(sn string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.states, sn)
+}
+
+// Device returns the latest notifications from sn ordered by msgtype.
+func (c *StateCache) Device(sn string) []*smarthome.NotificationMessage {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return sortedStates(c.states[sn])
+}
+
+// All returns the latest notifications from all devices ordered by sn and
+// msgtype.
+func (c *StateCache) All() []*smarthome.NotificationMessage {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	sns := make([]string, 0, len(c.states))
+	for sn := range c.states {
+		sns = append(sns, sn)
+	}
+	sort.Strings(sns)
+	result := []*smarthome.NotificationMessage{}
+	for _, sn := range sns {
+		result = append(result, sortedStates(c.states[sn])...)
+	}
+	return result
+}
+
+func sortedStates(device map[string]*cachedState) []*smarthome.NotificationMessage {
+	msgtypes := make([]string, 0, len(device))
+	for msgtype := range device {
+		msgtypes = append(msgtypes, msgtype)
+	}
+	sort.Strings(msgtypes)
+	result := make([]*smarthome.NotificationMessage, 0, len(device))
+	for _, msgtype := range msgtypes {
+		result = append(result, device[msgtype].msg)
+	}
+	return result
+}
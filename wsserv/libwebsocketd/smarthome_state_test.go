@@ -0,0 +1,40 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+func TestStateCacheLimit(t *testing.T) {
+	c := NewStateCache()
+	c.Update(&smarthome.NotificationMessage{From: "tv-1", MsgType: "power"})
+	for i := 0; i < MaxStatesPerDevice+10; i++ {
+		c.Update(&smarthome.NotificationMessage{From: "tv-1", MsgType: fmt.Sprintf("random-%03d", i)})
+		// power keeps being updated, so it is never the oldest
+		c.Update(&smarthome.NotificationMessage{From: "tv-1", MsgType: "power", Wsid: fmt.Sprint(i)})
+	}
+	c.Update(&smarthome.NotificationMessage{From: "router-1", MsgType: "wifi"})
+
+	states := c.Device("tv-1")
+	if len(states) != MaxStatesPerDevice {
+		t.Fatalf("kept %d msgtypes", len(states))
+	}
+	if states[0].MsgType != "power" || states[1].MsgType != "random-011" || states[len(states)-1].MsgType != "random-041" {
+		t.Errorf("kept %s, %s ... %s", states[0].MsgType, states[1].MsgType, states[len(states)-1].MsgType)
+	}
+	if len(c.Device("router-1")) != 1 {
+		t.Error("limit applies across devices")
+	}
+
+	c.Forget("tv-1")
+	if all := c.All(); len(all) != 1 || all[0].From != "router-1" {
+		t.Errorf("after forgetting tv-1: %v", all)
+	}
+}
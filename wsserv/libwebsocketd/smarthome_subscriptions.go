@@ -0,0 +1,186 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"sync"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+// MaxSubscriptions limits number of subscriptions per client.
+const MaxSubscriptions = 100
+
+// Subscription selects notifications a client wants to receive. A notification
+// matches if each non-empty set contains its sn, device type and msgtype.
+type Subscription struct {
+	Client      *DeviceEntry
+	Wsid        string
+	Sns         map[string]bool
+	DeviceTypes map[string]bool
+	MsgTypes    map[string]bool
+}
+
+// NewSubscription creates subscription of client from m.
+func NewSubscription(client *DeviceEntry, m *smarthome.SubscribeMessage) *Subscription {
+	return &Subscription{
+		Client:      client,
+		Wsid:        m.Wsid,
+		Sns:         stringSet(m.Sns),
+		DeviceTypes: stringSet(m.DeviceTypes),
+		MsgTypes:    stringSet(m.MsgTypes),
+	}
+}
+
+// Matches reports whether notification of msgtype from sn of device type
+// ctype is selected by s.
+func (s *Subscription) Matches(sn, ctype, msgtype string) bool {
+	return matchSet(s.Sns, sn) && matchSet(s.DeviceTypes, ctype) && matchSet(s.MsgTypes, msgtype)
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+func matchSet(set map[string]bool, value string) bool {
+	return len(set) == 0 || set[value]
+}
+
+type subscriptionSet map[*Subscription]bool
+
+// SubscriptionIndex finds the clients subscribed to a notification without
+// looking at every subscription. Subscriptions naming sns are indexed by sn,
+// those naming only device types by type, the rest are checked for every
+// notification. It is safe for concurrent use.
+type SubscriptionIndex struct {
+	mutex    sync.RWMutex
+	bySn     map[string]subscriptionSet
+	byType   map[string]subscriptionSet
+	wildcard subscriptionSet
+	byClient map[*DeviceEntry]map[string]*Subscription
+}
+
+func NewSubscriptionIndex() *SubscriptionIndex {
+	return &SubscriptionIndex{
+		bySn:     make(map[string]subscriptionSet),
+		byType:   make(map[string]subscriptionSet),
+		wildcard: make(subscriptionSet),
+		byClient: make(map[*DeviceEntry]map[string]*Subscription),
+	}
+}
+
+// Add indexes s, replacing subscription of the same client with the same
+// wsid. It returns false if the client has too many subscriptions already.
+func (x *SubscriptionIndex) Add(s *Subscription) bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	client := x.byClient[s.Client]
+	if client == nil {
+		client = make(map[string]*Subscription)
+		x.byClient[s.Client] = client
+	}
+	if previous, ok := client[s.Wsid]; ok {
+		x.unindex(previous)
+	} else if len(client) >= MaxSubscriptions {
+		return false
+	}
+	client[s.Wsid] = s
+
+	switch {
+	case len(s.Sns) > 0:
+		for sn := range s.Sns {
+			addToSet(x.bySn, sn, s)
+		}
+	case len(s.DeviceTypes) > 0:
+		for ctype := range s.DeviceTypes {
+			addToSet(x.byType, ctype, s)
+		}
+	default:
+		x.wildcard[s] = true
+	}
+	return true
+}
+
+// Remove drops subscription wsid of client, or all its subscriptions if wsid
+// is empty. It returns number of subscriptions removed.
+func (x *SubscriptionIndex) Remove(client *DeviceEntry, wsid string) int {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	subscriptions := x.byClient[client]
+	if wsid != "" {
+		s, ok := subscriptions[wsid]
+		if !ok {
+			return 0
+		}
+		subscriptions = map[string]*Subscription{wsid: s}
+	}
+	removed := len(subscriptions)
+	for wsid, s := range subscriptions {
+		x.unindex(s)
+		delete(x.byClient[client], wsid)
+	}
+	if len(x.byClient[client]) == 0 {
+		delete(x.byClient, client)
+	}
+	return removed
+}
+
+// Match returns clients subscribed to notification of msgtype from sn of
+// device type ctype. Each client is returned once.
+func (x *SubscriptionIndex) Match(sn, ctype, msgtype string) []*DeviceEntry {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	seen := make(map[*DeviceEntry]bool)
+	var result []*DeviceEntry
+	for _, set := range []subscriptionSet{x.bySn[sn], x.byType[ctype], x.wildcard} {
+		for s := range set {
+			if !seen[s.Client] && s.Matches(sn, ctype, msgtype) {
+				seen[s.Client] = true
+				result = append(result, s.Client)
+			}
+		}
+	}
+	return result
+}
+
+// Len returns number of subscriptions of client.
+func (x *SubscriptionIndex) Len(client *DeviceEntry) int {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return len(x.byClient[client])
+}
+
+func (x *SubscriptionIndex) unindex(s *Subscription) {
+	for sn := range s.Sns {
+		removeFromSet(x.bySn, sn, s)
+	}
+	for ctype := range s.DeviceTypes {
+		removeFromSet(x.byType, ctype, s)
+	}
+	delete(x.wildcard, s)
+}
+
+func addToSet(index map[string]subscriptionSet, key string, s *Subscription) {
+	set := index[key]
+	if set == nil {
+		set = make(subscriptionSet)
+		index[key] = set
+	}
+	set[s] = true
+}
+
+func removeFromSet(index map[string]subscriptionSet, key string, s *Subscription) {
+	if set := index[key]; set != nil {
+		delete(set, s)
+		if len(set) == 0 {
+			delete(index, key)
+		}
+	}
+}
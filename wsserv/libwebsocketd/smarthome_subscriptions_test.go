@@ -0,0 +1,84 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package libwebsocketd
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
+)
+
+func matchedSns(clients []*DeviceEntry) string {
+	sns := make([]string, 0, len(clients))
+	for _, client := range clients {
+		sns = append(sns, client.Sn)
+	}
+	sort.Strings(sns)
+	return strings.Join(sns, " ")
+}
+
+func TestSubscriptionIndex(t *testing.T) {
+	x := NewSubscriptionIndex()
+	a := NewDeviceEntry("a", "rest", "", nil)
+	b := NewDeviceEntry("b", "rest", "", nil)
+	c := NewDeviceEntry("c", "rest", "", nil)
+
+	x.Add(NewSubscription(a, &smarthome.SubscribeMessage{Wsid: "1"}))
+	x.Add(NewSubscription(a, &smarthome.SubscribeMessage{Wsid: "2", Sns: []string{"tv-1"}}))
+	x.Add(NewSubscription(b, &smarthome.SubscribeMessage{Wsid: "1", Sns: []string{"tv-1", "tv-2"}, MsgTypes: []string{"channel"}}))
+	x.Add(NewSubscription(c, &smarthome.SubscribeMessage{Wsid: "1", DeviceTypes: []string{"router"}}))
+
+	tests := []struct {
+		sn, ctype, msgtype string
+		want               string
+	}{
+		{"tv-1", "tv", "channel", "a b"},
+		{"tv-2", "tv", "volume", "a"},
+		{"router-1", "router", "wifi", "a c"},
+	}
+	for _, test := range tests {
+		if got := matchedSns(x.Match(test.sn, test.ctype, test.msgtype)); got != test.want {
+			t.Errorf("%s %s %s: matched %q, expected %q", test.sn, test.ctype, test.msgtype, got, test.want)
+		}
+	}
+
+	// replacing a subscription drops its old index entries
+	x.Add(NewSubscription(b, &smarthome.SubscribeMessage{Wsid: "1", Sns: []string{"tv-2"}}))
+	if got := matchedSns(x.Match("tv-1", "tv", "channel")); got != "a" {
+		t.Errorf("matched %q after replace", got)
+	}
+
+	if n := x.Remove(a, "1"); n != 1 || x.Len(a) != 1 {
+		t.Errorf("removed %d, %d left", n, x.Len(a))
+	}
+	if n := x.Remove(a, ""); n != 1 || x.Len(a) != 0 {
+		t.Errorf("removed %d, %d left", n, x.Len(a))
+	}
+	if got := matchedSns(x.Match("router-1", "router", "wifi")); got != "c" {
+		t.Errorf("matched %q after remove", got)
+	}
+	if len(x.bySn["tv-1"]) != 0 || len(x.wildcard) != 0 {
+		t.Error("removed subscriptions left in index")
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	x := NewSubscriptionIndex()
+	a := NewDeviceEntry("a", "rest", "", nil)
+	for i := 0; i < MaxSubscriptions; i++ {
+		if !x.Add(NewSubscription(a, &smarthome.SubscribeMessage{Wsid: strings.Repeat("x", i+1)})) {
+			t.Fatalf("subscription %d rejected", i)
+		}
+	}
+	if x.Add(NewSubscription(a, &smarthome.SubscribeMessage{Wsid: "over"})) {
+		t.Error("subscription over limit accepted")
+	}
+	if !x.Add(NewSubscription(a, &smarthome.SubscribeMessage{Wsid: "x"})) {
+		t.Error("replacing subscription at limit rejected")
+	}
+}
@@ -6,57 +6,217 @@
 package libwebsocketd
 
 import (
+	"encoding/json"
 	"io"
+	"net"
+	"sync/atomic"
+	"time"
 
+	"github.com/xiangstudio/smarthome-websocketd/smarthome"
 	"golang.org/x/net/websocket"
 )
 
+// Close codes the broker sends when it drops a smarthome connection.
+const (
+	CloseUnsupportedData = 1003 // client sent a frame type the protocol does not accept
+	CloseReplaced        = 4000 // another connection took over the sn
+)
+
+// frameCodec receives text frames as string and binary frames as []byte.
+var frameCodec = websocket.Codec{
+	Marshal: websocket.Message.Marshal,
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		if payloadType == websocket.BinaryFrame {
+			*v.(*interface{}) = data
+		} else {
+			*v.(*interface{}) = string(data)
+		}
+		return nil
+	},
+}
+
 type SmarthomeWebSocketEndpoint struct {
-	ws     *websocket.Conn
-	output chan string
-	log    *LogScope
-	c_type string
+	received uint64 // message counters, accessed atomically
+	sent     uint64
+
+	ws          *websocket.Conn
+	output      chan string
+	binary      chan []byte
+	done        chan struct{} // closed when reading ends
+	idleTimeout time.Duration // set by StartKeepalive
+	log         *LogScope
+	metrics     *Metrics
+	limits      *ConnLimiter
+	codec       smarthome.Codec // encodes SendMessage, legacy format if nil
 }
 
 func NewSmarthomeWebSocketEndpoint(ws *websocket.Conn, log *LogScope) *SmarthomeWebSocketEndpoint {
 	return &SmarthomeWebSocketEndpoint{
 		ws:     ws,
 		output: make(chan string),
+		binary: make(chan []byte),
+		done:   make(chan struct{}),
 		log:    log}
 }
 
 func (we *SmarthomeWebSocketEndpoint) Terminate() {
 }
 
+// Close sends a close frame with status and reason to the client and closes
+// the connection. The reading goroutine then ends the client's session.
+func (we *SmarthomeWebSocketEndpoint) Close(status int, reason string) {
+	if err := we.ws.CloseWithStatus(status, reason); err != nil {
+		we.log.Debug("websocket", "Cannot close: %s", err)
+	}
+}
+
 func (we *SmarthomeWebSocketEndpoint) Output() chan string {
 	return we.output
 }
 
+// Binary returns the channel the binary frames received from the client are
+// delivered on. Text and binary frames are delivered in the order received.
+func (we *SmarthomeWebSocketEndpoint) Binary() chan []byte {
+	return we.binary
+}
+
 func (we *SmarthomeWebSocketEndpoint) Send(msg string) bool {
+	return we.send(msg)
+}
+
+// SendBinary sends data to the client in a binary frame.
+func (we *SmarthomeWebSocketEndpoint) SendBinary(data []byte) bool {
+	return we.send(data)
+}
+
+func (we *SmarthomeWebSocketEndpoint) send(msg interface{}) bool {
 	err := websocket.Message.Send(we.ws, msg)
 	if err != nil {
 		we.log.Trace("websocket", "Cannot send: %s", err)
 		return false
 	}
+	atomic.AddUint64(&we.sent, 1)
+	we.metrics.Message(DirectionOut, frameSize(msg))
 	return true
 }
 
+// frameSize returns the payload size of a string or []byte frame.
+func frameSize(msg interface{}) int {
+	switch msg := msg.(type) {
+	case string:
+		return len(msg)
+	case []byte:
+		return len(msg)
+	}
+	return 0
+}
+
+// Counters returns number of messages received from and sent to the client.
+func (we *SmarthomeWebSocketEndpoint) Counters() (received, sent uint64) {
+	return atomic.LoadUint64(&we.received), atomic.LoadUint64(&we.sent)
+}
+
+// Subprotocol returns the version of the smarthome protocol the client
+// speaks, "" for the legacy format.
+func (we *SmarthomeWebSocketEndpoint) Subprotocol() string {
+	if we.codec == nil {
+		return ""
+	}
+	return we.codec.Subprotocol()
+}
+
+// SendMessage encodes a smarthome protocol message in the client's version of
+// the protocol and sends it to the client.
+func (we *SmarthomeWebSocketEndpoint) SendMessage(msg interface{}) bool {
+	encode := json.Marshal
+	if we.codec != nil {
+		encode = we.codec.Encode
+	}
+	data, err := encode(msg)
+	if err != nil {
+		we.log.Error("websocket", "Cannot encode %T: %s", msg, err)
+		return false
+	}
+	we.log.Debug("websocket", "send: %s", data)
+	return we.Send(string(data))
+}
+
+// StartKeepalive pings the client every interval and drops the connection if
+// nothing, not even a pong, is received from it for misses intervals. It has
+// to be called before StartReading.
+func (we *SmarthomeWebSocketEndpoint) StartKeepalive(interval time.Duration, misses int) {
+	we.idleTimeout = interval * time.Duration(misses)
+	we.ws.SetPongHandler(func([]byte) {
+		we.extendDeadline()
+	})
+	go we.ping(interval)
+}
+
+func (we *SmarthomeWebSocketEndpoint) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-we.done:
+			return
+		case <-ticker.C:
+			if err := we.ws.Ping(nil); err != nil {
+				we.log.Trace("websocket", "Cannot ping: %s", err)
+				return
+			}
+		}
+	}
+}
+
+func (we *SmarthomeWebSocketEndpoint) extendDeadline() {
+	if we.idleTimeout > 0 {
+		we.ws.SetReadDeadline(time.Now().Add(we.idleTimeout))
+	}
+}
+
 func (we *SmarthomeWebSocketEndpoint) StartReading() {
+	we.limits.Prepare(we.ws, false)
 	go we.read_client()
 }
 
 func (we *SmarthomeWebSocketEndpoint) read_client() {
 	for {
-		var msg string
-		err := websocket.Message.Receive(we.ws, &msg)
+		var msg interface{}
+		we.extendDeadline()
+		err := frameCodec.Receive(we.ws, &msg)
+		if err == websocket.ErrFrameTooLarge {
+			if code := we.limits.Oversized(); code != 0 {
+				we.Close(code, "frame too large")
+				break
+			}
+			continue
+		}
 		if err != nil {
-			we.log.Debug("limx debug", "smarthome ws receive error: %s", err)
-			if err != io.EOF {
-				we.log.Debug("websocket", "Cannot receive: %s", err)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				we.log.Access("websocket", "TIMEOUT: nothing received for %s, dropping connection", we.idleTimeout)
+			} else if err != io.EOF {
+				we.log.Debug("smarthome", "Cannot receive: %s", err)
 			}
 			break
 		}
-		we.output <- msg
+		atomic.AddUint64(&we.received, 1)
+		we.metrics.Message(DirectionIn, frameSize(msg))
+		pass, code := we.limits.Allow(frameSize(msg), time.Now())
+		if code != 0 {
+			we.Close(code, "limit exceeded")
+			break
+		}
+		if !pass {
+			continue
+		}
+		switch msg := msg.(type) {
+		case string:
+			we.output <- msg
+		case []byte:
+			we.binary <- msg
+		}
 	}
+	close(we.done)
 	close(we.output)
+	close(we.binary)
 }
@@ -7,14 +7,17 @@ package libwebsocketd
 
 import (
 	"io"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
 type WebSocketEndpoint struct {
-	ws     *websocket.Conn
-	output chan string
-	log    *LogScope
+	ws      *websocket.Conn
+	output  chan string
+	log     *LogScope
+	metrics *Metrics
+	limits  *ConnLimiter
 }
 
 func NewWebSocketEndpoint(ws *websocket.Conn, log *LogScope) *WebSocketEndpoint {
@@ -37,10 +40,12 @@ func (we *WebSocketEndpoint) Send(msg string) bool {
 		we.log.Trace("websocket", "Cannot send: %s", err)
 		return false
 	}
+	we.metrics.Message(DirectionOut, len(msg))
 	return true
 }
 
 func (we *WebSocketEndpoint) StartReading() {
+	we.limits.Prepare(we.ws, true)
 	go we.read_client()
 }
 
@@ -48,13 +53,28 @@ func (we *WebSocketEndpoint) read_client() {
 	for {
 		var msg string
 		err := websocket.Message.Receive(we.ws, &msg)
+		if err == websocket.ErrFrameTooLarge {
+			if code := we.limits.Oversized(); code != 0 {
+				we.ws.CloseWithStatus(code, "frame too large")
+				break
+			}
+			continue
+		}
 		if err != nil {
 			if err != io.EOF {
 				we.log.Debug("websocket", "Cannot receive: %s", err)
 			}
 			break
 		}
-		we.output <- msg
+		we.metrics.Message(DirectionIn, len(msg))
+		pass, code := we.limits.Allow(len(msg), time.Now())
+		if code != 0 {
+			we.ws.CloseWithStatus(code, "limit exceeded")
+			break
+		}
+		if pass {
+			we.output <- msg
+		}
 	}
 	close(we.output)
 }
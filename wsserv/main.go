@@ -65,8 +65,13 @@ func log(l *libwebsocketd.LogScope, level libwebsocketd.LogLevel, levelName stri
 	}
 }
 
-// limx debug test
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(auditCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(simulateCommand(os.Args[2:]))
+	}
 	config := parseCommandLine()
 
 	logfile = config.LogFile
@@ -87,6 +92,115 @@ func main() {
 	handler := libwebsocketd.NewWebsocketdServer(config.Config, log, config.MaxForks)
 	http.Handle("/", handler)
 
+	if config.Smarthome {
+		credentials, err := libwebsocketd.LoadDeviceCredentials(config.DeviceFile)
+		if err != nil {
+			log.Fatal("server", "Could not load device registry %s: %s", config.DeviceFile, err)
+			os.Exit(4)
+		}
+		handler.Credentials = credentials
+		log.Info("server", "Smarthome devices registered: %d", credentials.Len())
+		if config.APIToken == "" {
+			log.Info("server", "Smarthome HTTP API disabled, enable it with --apitoken")
+		}
+
+		if config.QueueDir != "" {
+			queue, err := libwebsocketd.NewCommandQueue(config.QueueDir)
+			if err != nil {
+				log.Fatal("server", "Could not open command queue %s: %s", config.QueueDir, err)
+				os.Exit(4)
+			}
+			queue.Limit = config.QueueLimit
+			handler.Queue = queue
+			log.Info("server", "Persistent commands stored in: %s", config.QueueDir)
+		}
+
+		if config.ACLFile != "" {
+			acl, err := libwebsocketd.LoadACL(config.ACLFile)
+			if err != nil {
+				log.Fatal("server", "Could not load access list %s: %s", config.ACLFile, err)
+				os.Exit(4)
+			}
+			handler.Authorizer = acl
+			log.Info("server", "Access list identities: %d", acl.Len())
+		}
+
+		if config.RoutesFile != "" {
+			routes, err := libwebsocketd.LoadRoutingTable(config.RoutesFile)
+			if err != nil {
+				log.Fatal("server", "Could not load routing table %s: %s", config.RoutesFile, err)
+				os.Exit(4)
+			}
+			handler.Routes = routes
+			log.Info("server", "Message routes: %d, default action %s", len(routes.Routes), routes.Default)
+		}
+
+		if config.FirmwareDir != "" {
+			firmware, err := libwebsocketd.NewFirmwareStore(config.FirmwareDir)
+			if err != nil {
+				log.Fatal("server", "Could not open firmware directory %s: %s", config.FirmwareDir, err)
+				os.Exit(4)
+			}
+			handler.OTA = libwebsocketd.NewOTAManager(firmware)
+			log.Info("server", "Firmware updates served from: %s", config.FirmwareDir)
+		}
+
+		if config.RulesFile != "" {
+			rules, err := libwebsocketd.LoadRules(config.RulesFile)
+			if err != nil {
+				log.Fatal("server", "Could not load automation rules %s: %s", config.RulesFile, err)
+				os.Exit(4)
+			}
+			rules.DryRun = config.RulesDryRun
+			handler.Rules = rules
+			log.Info("server", "Automation rules: %d, dry run %t", rules.Len(), rules.DryRun)
+		}
+
+		if config.ScheduleFile != "" {
+			schedules, err := libwebsocketd.OpenScheduleStore(config.ScheduleFile)
+			if err != nil {
+				log.Fatal("server", "Could not open schedules %s: %s", config.ScheduleFile, err)
+				os.Exit(4)
+			}
+			handler.Schedules = schedules
+			go handler.RunSchedules(nil)
+			log.Info("server", "Scheduled commands: %d, stored in %s", len(schedules.List("")), config.ScheduleFile)
+		}
+
+		if config.GroupFile != "" {
+			groups, err := libwebsocketd.OpenGroupStore(config.GroupFile)
+			if err != nil {
+				log.Fatal("server", "Could not open device groups %s: %s", config.GroupFile, err)
+				os.Exit(4)
+			}
+			handler.Groups = groups
+			log.Info("server", "Device groups: %d, stored in %s", groups.Len(), config.GroupFile)
+		}
+
+		if config.AuditFile != "" {
+			audit, err := libwebsocketd.OpenAuditLog(config.AuditFile)
+			if err != nil {
+				log.Fatal("server", "Could not open audit log %s: %s", config.AuditFile, err)
+				os.Exit(4)
+			}
+			audit.MaxSize = config.AuditMaxSize
+			audit.MaxAge = config.AuditRotate
+			audit.Retain = config.AuditRetain
+			handler.Audit = audit
+			log.Info("server", "Audit log: %s", config.AuditFile)
+		}
+
+		if config.MQTTAddr != "" {
+			users, err := libwebsocketd.LoadMQTTUsers(config.MQTTUsersFile)
+			if err != nil {
+				log.Fatal("server", "Could not load MQTT users %s: %s", config.MQTTUsersFile, err)
+				os.Exit(4)
+			}
+			handler.MQTT = libwebsocketd.NewMQTTBridge(handler, users, log)
+			log.Info("server", "MQTT users: %d", users.Len())
+		}
+	}
+
 	if config.UsingScriptDir {
 		log.Info("server", "Serving from directory      : %s", config.ScriptDir)
 	} else if config.CommandName != "" {
@@ -118,6 +232,20 @@ func main() {
 			}
 		}(addrSingle)
 	}
+	if config.MetricsAddr != "" {
+		log.Info("server", "Serving metrics             : http://%s/metrics", config.MetricsAddr)
+		metrics := http.NewServeMux()
+		metrics.HandleFunc("/metrics", handler.ServeMetrics)
+		go func() {
+			rejects <- http.ListenAndServe(config.MetricsAddr, metrics)
+		}()
+	}
+	if config.MQTTAddr != "" {
+		log.Info("server", "Starting MQTT bridge        : mqtt://%s", config.MQTTAddr)
+		go func() {
+			rejects <- handler.MQTT.ListenAndServe(config.MQTTAddr)
+		}()
+	}
 	select {
 	case err := <-rejects:
 		log.Fatal("server", "Can't start server: %s", err)
@@ -0,0 +1,136 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/xiangstudio/smarthome-websocketd/libwebsocketd"
+)
+
+// simulateCommand runs "websocketd simulate", connecting fake devices and
+// rest clients to a smarthome broker and reporting command latencies. It
+// returns the exit status.
+func simulateCommand(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.Usage = func() {}
+	devicesFlag := flags.String("devices", "", "Device registry with the credentials of the simulated clients")
+	countFlag := flags.Int("count", 0, "Number of simulated devices, 0 for all in the registry")
+	ctypesFlag := flags.String("ctypes", "router", "c_types assigned to the devices in turn")
+	responsesFlag := flags.String("responses", "", "JSON object of response data by command cmd, echo if not listed")
+	notifyFlag := flags.Duration("notify", 0, "Interval between notifications of each device, 0 for none")
+	msgTypeFlag := flags.String("msgtype", "simulated", "msgtype of the notifications")
+	clientsFlag := flags.String("clients", "", "sns of the rest clients sending commands")
+	rateFlag := flags.Float64("rate", 1, "Commands per second sent by each rest client")
+	commandFlag := flags.String("command", `{"cmd":"simulate"}`, "Data of the commands")
+	durationFlag := flags.Duration("duration", 0, "How long to run, 0 until interrupted")
+	reportFlag := flags.Duration("report", 10*time.Second, "Interval between progress reports, 0 for none")
+	originFlag := flags.String("origin", "", "Origin header, derived from URL if empty")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *devicesFlag == "" {
+		fmt.Fprintf(os.Stderr, "Please specify --devices and the WebSocket URL of the broker to simulate against.\n")
+		ShortHelp()
+		return 1
+	}
+	var command interface{}
+	if json.Unmarshal([]byte(*commandFlag), &command) != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --command: not JSON.\n")
+		return 1
+	}
+
+	credentials, err := libwebsocketd.LoadDeviceCredentials(*devicesFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load device registry %s: %s\n", *devicesFlag, err)
+		return 4
+	}
+	config := &libwebsocketd.SimulatorConfig{
+		URL:         flags.Arg(0),
+		Origin:      *originFlag,
+		CTypes:      strings.Split(*ctypesFlag, ","),
+		NotifyEvery: *notifyFlag,
+		MsgType:     *msgTypeFlag,
+		Rate:        *rateFlag,
+		Command:     json.RawMessage(*commandFlag),
+	}
+	clients := map[string]bool{}
+	if *clientsFlag != "" {
+		for _, sn := range strings.Split(*clientsFlag, ",") {
+			clients[sn] = true
+		}
+	}
+	for _, cred := range credentials.List() {
+		if clients[cred.Sn] {
+			config.Clients = append(config.Clients, cred)
+		} else if *countFlag <= 0 || len(config.Devices) < *countFlag {
+			config.Devices = append(config.Devices, cred)
+		}
+	}
+	if len(config.Clients) != len(clients) {
+		fmt.Fprintf(os.Stderr, "Invalid --clients: sns must be in the device registry.\n")
+		return 1
+	}
+	// The interval between commands must be at least a nanosecond for
+	// time.NewTicker; rates of 0 or less only make sense without clients.
+	if math.IsNaN(*rateFlag) || math.IsInf(*rateFlag, 0) ||
+		*rateFlag > float64(time.Second) ||
+		(len(config.Clients) > 0 && *rateFlag <= 0) {
+		fmt.Fprintf(os.Stderr, "Invalid --rate: must be above 0 and at most %d commands per second.\n", time.Second)
+		return 1
+	}
+	if *responsesFlag != "" {
+		data, err := ioutil.ReadFile(*responsesFlag)
+		if err == nil {
+			err = json.Unmarshal(data, &config.Responses)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not load responses %s: %s\n", *responsesFlag, err)
+			return 4
+		}
+	}
+
+	sim := libwebsocketd.NewSimulator(config, libwebsocketd.RootLogScope(libwebsocketd.LogError, log))
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- sim.Run(stop) }()
+	fmt.Printf("Simulating %d devices and %d rest clients against %s\n", len(config.Devices), len(config.Clients), config.URL)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	var deadline, report <-chan time.Time
+	if *durationFlag > 0 {
+		deadline = time.After(*durationFlag)
+	}
+	if *reportFlag > 0 {
+		ticker := time.NewTicker(*reportFlag)
+		defer ticker.Stop()
+		report = ticker.C
+	}
+run:
+	for {
+		select {
+		case err := <-done:
+			fmt.Fprintf(os.Stderr, "Simulation failed: %s\n", err)
+			return 4
+		case <-report:
+			fmt.Println(sim.Stats())
+		case <-deadline:
+			break run
+		case <-interrupts:
+			break run
+		}
+	}
+	close(stop)
+	<-done
+	fmt.Println(sim.Stats())
+	return 0
+}
@@ -0,0 +1,68 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smarthome
+
+import (
+	"fmt"
+)
+
+// BinaryFrame is a binary WebSocket frame routed by the broker. On the wire it
+// is an envelope followed by the payload as is:
+//
+//	[1 byte sn length][sn][1 byte wsid length][wsid][payload]
+//
+// Clients put the target sn into the envelope, the broker replaces it with
+// the sender's sn before passing the frame on.
+type BinaryFrame struct {
+	Sn      string
+	Wsid    string
+	Payload []byte
+}
+
+// MaxWsidLength is the longest wsid that fits into a BinaryFrame envelope.
+const MaxWsidLength = 255
+
+// DecodeBinary parses a binary frame received from a smarthome client. The
+// returned error is always an *ErrorMessage suitable as a reply.
+func DecodeBinary(raw []byte) (*BinaryFrame, error) {
+	sn, rest, ok := readShortString(raw)
+	if !ok {
+		return nil, NewError(CodeBadMessage, "", "truncated binary frame envelope")
+	}
+	wsid, payload, ok := readShortString(rest)
+	if !ok {
+		return nil, NewError(CodeBadMessage, "", "truncated binary frame envelope")
+	}
+	if err := checkSn("sn", sn, wsid); err != nil {
+		return nil, err
+	}
+	if wsid == "" {
+		return nil, missing("wsid", wsid)
+	}
+	return &BinaryFrame{Sn: sn, Wsid: wsid, Payload: payload}, nil
+}
+
+// Encode returns f in wire format.
+func (f *BinaryFrame) Encode() ([]byte, error) {
+	if len(f.Sn) > 255 || len(f.Wsid) > MaxWsidLength {
+		return nil, fmt.Errorf("binary frame envelope fields exceed 255 bytes")
+	}
+	raw := make([]byte, 0, 2+len(f.Sn)+len(f.Wsid)+len(f.Payload))
+	raw = append(raw, byte(len(f.Sn)))
+	raw = append(raw, f.Sn...)
+	raw = append(raw, byte(len(f.Wsid)))
+	raw = append(raw, f.Wsid...)
+	return append(raw, f.Payload...), nil
+}
+
+// readShortString splits a length prefixed string off raw.
+func readShortString(raw []byte) (s string, rest []byte, ok bool) {
+	if len(raw) < 1 || len(raw) < 1+int(raw[0]) {
+		return "", nil, false
+	}
+	n := 1 + int(raw[0])
+	return string(raw[1:n]), raw[n:], true
+}
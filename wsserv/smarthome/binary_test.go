@@ -0,0 +1,66 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smarthome
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var decodeBinaryTests = []struct {
+	name string
+	raw  string
+	want *BinaryFrame
+	code string // expected error code, empty if the frame is valid
+}{
+	{"frame", "\x04tv-1\x02w1\x00\xffpayload", &BinaryFrame{Sn: "tv-1", Wsid: "w1", Payload: []byte("\x00\xffpayload")}, ""},
+	{"empty payload", "\x04tv-1\x02w1", &BinaryFrame{Sn: "tv-1", Wsid: "w1", Payload: []byte{}}, ""},
+	{"empty", "", nil, CodeBadMessage},
+	{"truncated sn", "\x04tv", nil, CodeBadMessage},
+	{"missing wsid length", "\x04tv-1", nil, CodeBadMessage},
+	{"truncated wsid", "\x04tv-1\x05w1", nil, CodeBadMessage},
+	{"missing sn", "\x00\x02w1data", nil, CodeBadMessage},
+	{"invalid sn", "\x03a b\x02w1data", nil, CodeBadMessage},
+	{"missing wsid", "\x04tv-1\x00data", nil, CodeBadMessage},
+}
+
+func TestDecodeBinary(t *testing.T) {
+	for _, test := range decodeBinaryTests {
+		got, err := DecodeBinary([]byte(test.raw))
+		if test.code != "" {
+			if reply, ok := err.(*ErrorMessage); !ok || reply.Code != test.code {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBinaryFrameEncode(t *testing.T) {
+	f := &BinaryFrame{Sn: "cam-1", Wsid: "snap-7", Payload: []byte{0, 1, 2}}
+	raw, err := f.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("\x05cam-1\x06snap-7\x00\x01\x02"); !bytes.Equal(raw, want) {
+		t.Errorf("got %q, want %q", raw, want)
+	}
+	if decoded, err := DecodeBinary(raw); err != nil || !reflect.DeepEqual(decoded, f) {
+		t.Errorf("round trip got %+v, %v", decoded, err)
+	}
+
+	f.Wsid = strings.Repeat("w", MaxWsidLength+1)
+	if _, err := f.Encode(); err == nil {
+		t.Error("long wsid accepted")
+	}
+}
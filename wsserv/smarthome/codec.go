@@ -0,0 +1,95 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smarthome
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// WebSocket subprotocols naming the versions of the message format. Clients
+// offer them in Sec-WebSocket-Protocol, the broker picks the newest it
+// supports. Clients offering none speak the legacy format, which is v1.
+const (
+	SubprotocolV1 = "smarthome.v1"
+	SubprotocolV2 = "smarthome.v2"
+)
+
+// Subprotocols lists the supported subprotocols, newest first.
+var Subprotocols = []string{SubprotocolV2, SubprotocolV1}
+
+// TypeResponse is the type of the answers to rest commands in v2. In v1
+// devices answer with a message typed after their c_type, such as "router".
+const TypeResponse = "response"
+
+// Codec reads and writes the messages of one version of the protocol.
+type Codec interface {
+	// Subprotocol returns the name of the version, "" for legacy clients.
+	Subprotocol() string
+	// Decode parses and validates a message received from a client. The
+	// returned error is always an *ErrorMessage suitable as a reply.
+	Decode(raw []byte) (Message, error)
+	// Encode serializes a message sent to a client.
+	Encode(msg interface{}) ([]byte, error)
+}
+
+// CodecFor returns the codec of subprotocol, the legacy one for "".
+func CodecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolV1:
+		return v1Codec{SubprotocolV1}
+	case SubprotocolV2:
+		return v2Codec{}
+	}
+	return v1Codec{}
+}
+
+// v1Codec is the original format, spoken by legacy clients too.
+type v1Codec struct {
+	subprotocol string
+}
+
+func (c v1Codec) Subprotocol() string                    { return c.subprotocol }
+func (c v1Codec) Decode(raw []byte) (Message, error)     { return Decode(raw) }
+func (c v1Codec) Encode(msg interface{}) ([]byte, error) { return json.Marshal(msg) }
+
+// v2Codec differs from v1 in that devices answer rest commands with a
+// "response" message whatever their c_type, and every message sent by the
+// broker carries "ts", the broker's time in Unix milliseconds.
+type v2Codec struct{}
+
+func (v2Codec) Subprotocol() string { return SubprotocolV2 }
+
+func (v2Codec) Decode(raw []byte) (Message, error) {
+	var envelope struct {
+		Type string `json:"type"`
+		Wsid string `json:"wsid"`
+	}
+	if json.Unmarshal(raw, &envelope) != nil || envelope.Type != TypeResponse {
+		return Decode(raw)
+	}
+	reply := &ResponseMessage{}
+	if err := json.Unmarshal(raw, reply); err != nil {
+		return nil, NewError(CodeBadMessage, envelope.Wsid, "invalid response message: "+err.Error())
+	}
+	if err := reply.Validate(); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (v2Codec) Encode(msg interface{}) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil || len(data) < 2 || data[0] != '{' {
+		return data, err
+	}
+	ts := `{"ts":` + strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	if len(data) > 2 {
+		ts += ","
+	}
+	return append([]byte(ts), data[1:]...), nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smarthome
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCodecFor(t *testing.T) {
+	for subprotocol, want := range map[string]string{"": "", SubprotocolV1: SubprotocolV1, SubprotocolV2: SubprotocolV2, "smarthome.v9": ""} {
+		if got := CodecFor(subprotocol).Subprotocol(); got != want {
+			t.Errorf("codec for %q speaks %q", subprotocol, got)
+		}
+	}
+}
+
+func TestCodecResponse(t *testing.T) {
+	raw := []byte(`{"type":"response","wsid":"w1","from":"app-1","data":{"ok":true}}`)
+	msg, err := CodecFor(SubprotocolV2).Decode(raw)
+	want := &ResponseMessage{Type: TypeResponse, Wsid: "w1", From: "app-1", Data: json.RawMessage(`{"ok":true}`)}
+	if err != nil || !reflect.DeepEqual(msg, want) {
+		t.Errorf("v2 decoded %#v, %v", msg, err)
+	}
+	if _, err := CodecFor(SubprotocolV2).Decode([]byte(`{"type":"response","wsid":"w1","data":{}}`)); err == nil {
+		t.Error("v2 response without from accepted")
+	}
+	if msg, err := CodecFor(SubprotocolV2).Decode([]byte(`{"type":"rest","wsid":"w1","sn":"tv-1","data":{}}`)); err != nil || msg.MessageType() != TypeRest {
+		t.Errorf("v2 decoded rest as %#v, %v", msg, err)
+	}
+	// legacy clients route "response" like any custom type
+	if msg, err := CodecFor("").Decode(raw); err != nil || msg.MessageType() != TypeResponse {
+		t.Errorf("legacy decoded %#v, %v", msg, err)
+	} else if _, ok := msg.(*CustomMessage); !ok {
+		t.Errorf("legacy decoded %T", msg)
+	}
+}
+
+func TestCodecEncode(t *testing.T) {
+	msg := &ConnectReply{Message: "connected"}
+	if data, _ := CodecFor("").Encode(msg); string(data) != `{"message":"connected"}` {
+		t.Errorf("legacy encoded %s", data)
+	}
+	data, err := CodecFor(SubprotocolV2).Encode(msg)
+	var decoded map[string]interface{}
+	if err != nil || json.Unmarshal(data, &decoded) != nil {
+		t.Fatalf("v2 encoded %s, %v", data, err)
+	}
+	if ts, _ := decoded["ts"].(float64); ts <= 0 || decoded["message"] != "connected" {
+		t.Errorf("v2 encoded %s", data)
+	}
+	if data, _ := CodecFor(SubprotocolV2).Encode(struct{}{}); json.Unmarshal(data, &decoded) != nil {
+		t.Errorf("v2 encoded empty object as %s", data)
+	}
+}
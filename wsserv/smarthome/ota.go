@@ -0,0 +1,158 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smarthome
+
+// Firmware updates over the air run on the device's connection:
+//
+//	device: {"type":"ota_check","wsid":"o1","version":"1.0.0"}
+//	broker: {"type":"ota_check","wsid":"o1","status":"update","version":"1.1.0",
+//	         "size":70000,"sha256":"...","chunk_size":32768,"chunks":3,"next_chunk":0}
+//	device: {"type":"ota_start","wsid":"o1","version":"1.1.0","chunk":0}
+//	broker: {"type":"ota_chunk","wsid":"o1","version":"1.1.0","chunk":0,"data":"<base64>","crc32":...}
+//	device: {"type":"ota_ack","wsid":"o1","version":"1.1.0","chunk":0,"ok":true}
+//	...     one chunk at a time until the last one is acknowledged
+//	device: {"type":"ota_result","wsid":"o1","version":"1.1.0","status":"installed"}
+//
+// A device that reconnects during a download resumes at "next_chunk". A
+// device whose chunk fails its checksum acknowledges it with "ok":false and
+// gets it again. When a rollout starts the broker sends connected devices
+// {"type":"ota_update","version":...} to make them check.
+
+// Message types of firmware updates.
+const (
+	TypeOTACheck  = "ota_check"
+	TypeOTAStart  = "ota_start"
+	TypeOTAChunk  = "ota_chunk"
+	TypeOTAAck    = "ota_ack"
+	TypeOTAResult = "ota_result"
+	TypeOTAUpdate = "ota_update"
+)
+
+// Firmware update states of a device, as reported in ota_result and tracked
+// by the broker.
+const (
+	OTAUpToDate    = "up_to_date"  // no update for the device
+	OTAUpdate      = "update"      // update offered by ota_check
+	OTADownloading = "downloading" // chunks are being sent
+	OTADownloaded  = "downloaded"  // all chunks acknowledged, waiting for ota_result
+	OTAInstalled   = "installed"   // device installed the update
+	OTAFailed      = "failed"      // device could not install the update
+)
+
+// CodeNoFirmware rejects firmware update messages for versions not offered.
+const CodeNoFirmware = "no_firmware"
+
+// OTACheckMessage asks for a firmware update. Version is the one installed.
+type OTACheckMessage struct {
+	Type    string `json:"type"`
+	Wsid    string `json:"wsid"`
+	Version string `json:"version"`
+}
+
+// OTAOffer answers OTACheckMessage. Status is OTAUpdate or OTAUpToDate, the
+// other fields describe the update.
+type OTAOffer struct {
+	Type      string `json:"type"`
+	Wsid      string `json:"wsid"`
+	Status    string `json:"status"`
+	Version   string `json:"version,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Sha256    string `json:"sha256,omitempty"`
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	Chunks    int    `json:"chunks,omitempty"`
+	NextChunk int    `json:"next_chunk"`
+}
+
+// OTAStartMessage asks for the chunks of Version from Chunk on.
+type OTAStartMessage struct {
+	Type    string `json:"type"`
+	Wsid    string `json:"wsid"`
+	Version string `json:"version"`
+	Chunk   int    `json:"chunk"`
+}
+
+// OTAChunkMessage carries chunk number Chunk of a firmware image. Data is
+// base64 encoded in JSON, CRC32 is its IEEE checksum.
+type OTAChunkMessage struct {
+	Type    string `json:"type"`
+	Wsid    string `json:"wsid"`
+	Version string `json:"version"`
+	Chunk   int    `json:"chunk"`
+	Data    []byte `json:"data"`
+	CRC32   uint32 `json:"crc32"`
+}
+
+// OTAAckMessage acknowledges a chunk. Ok is false if the chunk failed its
+// checksum and has to be sent again.
+type OTAAckMessage struct {
+	Type    string `json:"type"`
+	Wsid    string `json:"wsid"`
+	Version string `json:"version"`
+	Chunk   int    `json:"chunk"`
+	Ok      bool   `json:"ok"`
+}
+
+// OTAResultMessage reports whether the device installed Version. Status is
+// OTAInstalled or OTAFailed.
+type OTAResultMessage struct {
+	Type    string `json:"type"`
+	Wsid    string `json:"wsid"`
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTAUpdateMessage tells a device that an update is available.
+type OTAUpdateMessage struct {
+	Type    string `json:"type"`
+	Version string `json:"version"`
+}
+
+func (m *OTACheckMessage) MessageType() string  { return TypeOTACheck }
+func (m *OTAStartMessage) MessageType() string  { return TypeOTAStart }
+func (m *OTAAckMessage) MessageType() string    { return TypeOTAAck }
+func (m *OTAResultMessage) MessageType() string { return TypeOTAResult }
+
+func (m *OTACheckMessage) Validate() error {
+	if m.Wsid == "" {
+		return missing("wsid", "")
+	}
+	return nil
+}
+
+func (m *OTAStartMessage) Validate() error {
+	return checkChunk(m.Wsid, m.Version, m.Chunk)
+}
+
+func (m *OTAAckMessage) Validate() error {
+	return checkChunk(m.Wsid, m.Version, m.Chunk)
+}
+
+func (m *OTAResultMessage) Validate() error {
+	if m.Wsid == "" {
+		return missing("wsid", "")
+	}
+	if m.Version == "" {
+		return missing("version", m.Wsid)
+	}
+	if m.Status != OTAInstalled && m.Status != OTAFailed {
+		return NewError(CodeBadMessage, m.Wsid, "status must be "+OTAInstalled+" or "+OTAFailed)
+	}
+	return nil
+}
+
+func checkChunk(wsid, version string, chunk int) error {
+	if wsid == "" {
+		return missing("wsid", "")
+	}
+	if version == "" {
+		return missing("version", wsid)
+	}
+	if chunk < 0 {
+		return NewError(CodeBadMessage, wsid, "chunk must not be negative")
+	}
+	return nil
+}
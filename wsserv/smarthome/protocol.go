@@ -0,0 +1,538 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package smarthome defines the JSON messages exchanged between smarthome
+// devices, rest clients and the websocketd smarthome broker.
+package smarthome
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Message types understood by the broker.
+const (
+	TypeAuth         = "auth"
+	TypeConnect      = "connect"
+	TypeRest         = "rest"
+	TypeNotification = "notification"
+	TypeDelivery     = "delivery"
+	TypeSnapshot     = "snapshot"
+	TypeSubscribe    = "subscribe"
+	TypeUnsubscribe  = "unsubscribe"
+	TypeError        = "error"
+)
+
+// Error codes sent back in ErrorMessage.
+const (
+	CodeBadMessage    = "bad_message"    // frame is not JSON or misses required fields
+	CodeUnknownType   = "unknown_type"   // message type is not supported
+	CodeAuthFailed    = "auth_failed"    // sn, mac and secret do not match the device registry
+	CodeInvalidToken  = "invalid_token"  // token is forged, expired or issued for another sn
+	CodeNotConnected  = "not_connected"  // message needs "connect" first
+	CodeTargetOffline = "target_offline" // addressed sn is not connected
+	CodeTimeout       = "timeout"        // device did not answer a rest command in time
+	CodeDuplicateWsid = "duplicate_wsid" // a rest command with the same wsid is still waiting for its reply
+	CodeQueueFailed   = "queue_failed"   // persistent command could not be queued for the offline device
+	CodeForbidden     = "forbidden"      // access list does not allow the client to use the addressed sn
+	CodeSnInUse       = "sn_in_use"      // sn is connected already and the takeover policy is reject
+
+	CodeTooManySubscriptions = "too_many_subscriptions" // client reached the limit of subscriptions
+	CodeUnknownGroup         = "unknown_group"          // addressed device group is not defined
+)
+
+// StatusOK is the status of a target in MultiRestReply that answered.
+const StatusOK = "ok"
+
+// Delivery states reported in DeliveryMessage for persistent rest commands.
+const (
+	DeliveryQueued    = "queued"    // target was offline, command is stored until it connects
+	DeliveryDelivered = "delivered" // stored command was sent to the target after it connected
+	DeliveryExpired   = "expired"   // target did not connect before the command expired
+)
+
+// builtinTypes are the message types decoded into their own structs. Any
+// other type is decoded into CustomMessage.
+var builtinTypes = map[string]bool{
+	TypeAuth:         true,
+	TypeConnect:      true,
+	TypeRest:         true,
+	TypeNotification: true,
+	TypeDelivery:     true,
+	TypeSnapshot:     true,
+	TypeSubscribe:    true,
+	TypeUnsubscribe:  true,
+	TypeError:        true,
+	TypeOTACheck:     true,
+	TypeOTAStart:     true,
+	TypeOTAChunk:     true,
+	TypeOTAAck:       true,
+	TypeOTAResult:    true,
+	TypeOTAUpdate:    true,
+	TypeSchedule:     true,
+}
+
+// IsBuiltinType reports whether msgtype is handled by the broker itself
+// rather than routed.
+func IsBuiltinType(msgtype string) bool {
+	return builtinTypes[msgtype]
+}
+
+// Message is implemented by every decoded smarthome message.
+type Message interface {
+	MessageType() string
+	Validate() error
+}
+
+// AuthMessage asks for a token: {"type":"auth","sn":...,"mac":...,"secret":...}
+type AuthMessage struct {
+	Type   string `json:"type"`
+	Sn     string `json:"sn"`
+	Mac    string `json:"mac"`
+	Secret string `json:"secret"`
+}
+
+// AuthReply carries the token issued in answer to AuthMessage.
+type AuthReply struct {
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+// ConnectMessage binds the connection to sn: {"type":"connect","sn":...,"token":...,"c_type":...}
+type ConnectMessage struct {
+	Type  string `json:"type"`
+	Sn    string `json:"sn"`
+	Token string `json:"token"`
+	CType string `json:"c_type"`
+}
+
+// ConnectReply acknowledges ConnectMessage.
+type ConnectReply struct {
+	Message string `json:"message"`
+}
+
+// RestMessage is a command. Rest clients address it to Sn, the broker
+// forwards it to the device with From set to the sender. The device answers
+// with a ResponseMessage which is passed back to the rest client as a
+// RestMessage with the same Wsid.
+//
+// If Persist is set and the device is offline, the broker stores the command
+// and sends it once the device connects, reporting progress to the rest
+// client with DeliveryMessage.
+//
+// Instead of Sn a command may address a list of Sns or a device Group. The
+// broker then sends it to each device under the same Wsid and answers with a
+// single MultiRestReply once all devices answered or timed out.
+type RestMessage struct {
+	Type    string          `json:"type"`
+	Wsid    string          `json:"wsid"`
+	Sn      string          `json:"sn,omitempty"`
+	Sns     []string        `json:"sns,omitempty"`
+	Group   string          `json:"group,omitempty"`
+	From    string          `json:"from,omitempty"`
+	Data    json.RawMessage `json:"data"`
+	Persist bool            `json:"persist,omitempty"`
+}
+
+// MultiTarget reports whether m addresses a list of sns or a group.
+func (m *RestMessage) MultiTarget() bool {
+	return m.Sns != nil || m.Group != ""
+}
+
+// MultiRestReply answers a RestMessage addressed to Sns or a Group with the
+// outcome for each device, in the order of the list or group.
+type MultiRestReply struct {
+	Type    string          `json:"type"`
+	Wsid    string          `json:"wsid"`
+	Group   string          `json:"group,omitempty"`
+	Results []*TargetResult `json:"results"`
+}
+
+// TargetResult is the outcome of a multi-target command for one device.
+// Status is StatusOK with the device's answer in Data, or an error code such
+// as CodeTimeout with Message explaining it.
+type TargetResult struct {
+	Sn      string          `json:"sn"`
+	Status  string          `json:"status"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+// ResponseMessage is a device's answer to a rest command, such as a "router",
+// "tv" or "cond" message. From is the sn the command came from.
+type ResponseMessage struct {
+	Type string          `json:"type"`
+	Wsid string          `json:"wsid"`
+	From string          `json:"from"`
+	Data json.RawMessage `json:"data"`
+}
+
+// CustomMessage is a message of a type that is not built in, for example a
+// device's answer to a rest command. The broker's routing table decides what
+// happens with it. Only the fields below are passed on.
+type CustomMessage struct {
+	Type string          `json:"type"`
+	Wsid string          `json:"wsid,omitempty"`
+	Sn   string          `json:"sn,omitempty"`
+	From string          `json:"from,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Response interprets m as answer to a rest command.
+func (m *CustomMessage) Response() (*ResponseMessage, error) {
+	reply := &ResponseMessage{Type: m.Type, Wsid: m.Wsid, From: m.From, Data: m.Data}
+	if err := reply.Validate(); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// NotificationMessage is an event pushed by a device to rest clients. Data is
+// a JSON object whose "msgtype" field is decoded into MsgType.
+type NotificationMessage struct {
+	Type    string          `json:"type"`
+	Wsid    string          `json:"wsid"`
+	From    string          `json:"from"`
+	Data    json.RawMessage `json:"data"`
+	MsgType string          `json:"-"`
+}
+
+// SubscribeMessage asks for notifications matching all of the given lists,
+// an empty list matches everything: {"type":"subscribe","wsid":...,
+// "sns":[...],"devicetypes":[...],"msgtypes":[...]}. Wsid names the
+// subscription so it can be cancelled with UnsubscribeMessage.
+type SubscribeMessage struct {
+	Type        string   `json:"type"`
+	Wsid        string   `json:"wsid"`
+	Sns         []string `json:"sns,omitempty"`
+	DeviceTypes []string `json:"devicetypes,omitempty"`
+	MsgTypes    []string `json:"msgtypes,omitempty"`
+}
+
+// UnsubscribeMessage cancels subscription Wsid, or all subscriptions of the
+// client if Wsid is empty.
+type UnsubscribeMessage struct {
+	Type string `json:"type"`
+	Wsid string `json:"wsid,omitempty"`
+}
+
+// SubscriptionReply acknowledges SubscribeMessage and UnsubscribeMessage.
+// Type is the type of the acknowledged message.
+type SubscriptionReply struct {
+	Type   string `json:"type"`
+	Wsid   string `json:"wsid,omitempty"`
+	Status string `json:"status"`
+}
+
+// DeliveryMessage tells a rest client what happened to its persistent
+// command with Wsid addressed to Sn. Status is one of the Delivery* states.
+type DeliveryMessage struct {
+	Type   string `json:"type"`
+	Wsid   string `json:"wsid"`
+	Sn     string `json:"sn"`
+	Status string `json:"status"`
+}
+
+// NewDelivery creates a DeliveryMessage.
+func NewDelivery(wsid, sn, status string) *DeliveryMessage {
+	return &DeliveryMessage{Type: TypeDelivery, Wsid: wsid, Sn: sn, Status: status}
+}
+
+// SnapshotMessage is sent to rest clients after "connect". It holds the latest
+// notification of each msgtype the broker has seen from each device.
+type SnapshotMessage struct {
+	Type          string                 `json:"type"`
+	Notifications []*NotificationMessage `json:"notifications"`
+}
+
+// NewSnapshot creates a SnapshotMessage.
+func NewSnapshot(notifications []*NotificationMessage) *SnapshotMessage {
+	return &SnapshotMessage{Type: TypeSnapshot, Notifications: notifications}
+}
+
+// ErrorMessage is sent back when a message is rejected. It is also used as
+// the error value returned by Decode and Validate.
+type ErrorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Wsid    string `json:"wsid,omitempty"`
+	Message string `json:"message"`
+}
+
+func (m *AuthMessage) MessageType() string         { return TypeAuth }
+func (m *ConnectMessage) MessageType() string      { return TypeConnect }
+func (m *RestMessage) MessageType() string         { return TypeRest }
+func (m *ResponseMessage) MessageType() string     { return m.Type }
+func (m *CustomMessage) MessageType() string       { return m.Type }
+func (m *NotificationMessage) MessageType() string { return TypeNotification }
+func (m *SubscribeMessage) MessageType() string    { return TypeSubscribe }
+func (m *UnsubscribeMessage) MessageType() string  { return TypeUnsubscribe }
+
+func (m *AuthMessage) Validate() error {
+	if err := checkSn("sn", m.Sn, ""); err != nil {
+		return err
+	}
+	if m.Mac == "" {
+		return missing("mac", "")
+	}
+	if m.Secret == "" {
+		return missing("secret", "")
+	}
+	return nil
+}
+
+func (m *ConnectMessage) Validate() error {
+	if err := checkSn("sn", m.Sn, ""); err != nil {
+		return err
+	}
+	if m.Token == "" {
+		return missing("token", "")
+	}
+	if m.CType == "" {
+		return missing("c_type", "")
+	}
+	return nil
+}
+
+func (m *RestMessage) Validate() error {
+	if m.Wsid == "" {
+		return missing("wsid", "")
+	}
+	if err := m.validateTarget(); err != nil {
+		return err
+	}
+	if !isObject(m.Data) {
+		return NewError(CodeBadMessage, m.Wsid, "data must be an object")
+	}
+	return nil
+}
+
+// validateTarget checks that m addresses exactly one of sn, sns and group.
+func (m *RestMessage) validateTarget() error {
+	if !m.MultiTarget() {
+		return checkSn("sn", m.Sn, m.Wsid)
+	}
+	if m.Sn != "" || m.Sns != nil && m.Group != "" {
+		return NewError(CodeBadMessage, m.Wsid, "only one of sn, sns and group may be given")
+	}
+	if m.Persist {
+		return NewError(CodeBadMessage, m.Wsid, "persist needs a single sn")
+	}
+	if m.Group != "" {
+		return checkSn("group", m.Group, m.Wsid)
+	}
+	if len(m.Sns) == 0 {
+		return missing("sns", m.Wsid)
+	}
+	seen := make(map[string]bool, len(m.Sns))
+	for _, sn := range m.Sns {
+		if err := checkSn("sns", sn, m.Wsid); err != nil {
+			return err
+		}
+		if seen[sn] {
+			return NewError(CodeBadMessage, m.Wsid, fmt.Sprintf("duplicate sn %q in sns", sn))
+		}
+		seen[sn] = true
+	}
+	return nil
+}
+
+func (m *ResponseMessage) Validate() error {
+	if m.Wsid == "" {
+		return missing("wsid", "")
+	}
+	if err := checkSn("from", m.From, m.Wsid); err != nil {
+		return err
+	}
+	if !isObject(m.Data) && !isArray(m.Data) {
+		return NewError(CodeBadMessage, m.Wsid, "data must be an object or an array")
+	}
+	return nil
+}
+
+func (m *CustomMessage) Validate() error {
+	if m.Sn != "" {
+		if err := checkSn("sn", m.Sn, m.Wsid); err != nil {
+			return err
+		}
+	}
+	if m.From != "" {
+		if err := checkSn("from", m.From, m.Wsid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *NotificationMessage) Validate() error {
+	if err := checkSn("from", m.From, m.Wsid); err != nil {
+		return err
+	}
+	var header struct {
+		MsgType string `json:"msgtype"`
+	}
+	if !isObject(m.Data) || json.Unmarshal(m.Data, &header) != nil {
+		return NewError(CodeBadMessage, m.Wsid, "data must be an object")
+	}
+	if header.MsgType == "" {
+		return missing("data.msgtype", m.Wsid)
+	}
+	m.MsgType = header.MsgType
+	return nil
+}
+
+func (m *SubscribeMessage) Validate() error {
+	if m.Wsid == "" {
+		return missing("wsid", "")
+	}
+	for _, sn := range m.Sns {
+		if err := checkSn("sns", sn, m.Wsid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *UnsubscribeMessage) Validate() error {
+	return nil
+}
+
+// Decode parses and validates a message received from a smarthome client.
+// The returned error is always an *ErrorMessage suitable as a reply.
+func Decode(raw []byte) (Message, error) {
+	var envelope struct {
+		Type string `json:"type"`
+		Wsid string `json:"wsid"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, NewError(CodeBadMessage, "", "invalid JSON: "+err.Error())
+	}
+
+	var msg Message
+	switch {
+	case envelope.Type == "":
+		return nil, missing("type", envelope.Wsid)
+	case envelope.Type == TypeAuth:
+		msg = &AuthMessage{}
+	case envelope.Type == TypeConnect:
+		msg = &ConnectMessage{}
+	case envelope.Type == TypeRest:
+		msg = &RestMessage{}
+	case envelope.Type == TypeNotification:
+		msg = &NotificationMessage{}
+	case envelope.Type == TypeSubscribe:
+		msg = &SubscribeMessage{}
+	case envelope.Type == TypeUnsubscribe:
+		msg = &UnsubscribeMessage{}
+	case envelope.Type == TypeOTACheck:
+		msg = &OTACheckMessage{}
+	case envelope.Type == TypeOTAStart:
+		msg = &OTAStartMessage{}
+	case envelope.Type == TypeOTAAck:
+		msg = &OTAAckMessage{}
+	case envelope.Type == TypeOTAResult:
+		msg = &OTAResultMessage{}
+	case envelope.Type == TypeSchedule:
+		msg = &ScheduleMessage{}
+	case builtinTypes[envelope.Type]:
+		return nil, NewError(CodeUnknownType, envelope.Wsid, fmt.Sprintf("%s messages are sent by the broker only", envelope.Type))
+	default:
+		msg = &CustomMessage{}
+	}
+
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return nil, NewError(CodeBadMessage, envelope.Wsid, "invalid "+envelope.Type+" message: "+err.Error())
+	}
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// NewError creates an ErrorMessage for given code.
+func NewError(code, wsid, message string) error {
+	return &ErrorMessage{Type: TypeError, Code: code, Wsid: wsid, Message: message}
+}
+
+// ErrorReply turns err into a message for the client. Errors that did not
+// come from this package are reported with given code.
+func ErrorReply(code, wsid string, err error) *ErrorMessage {
+	if reply, ok := err.(*ErrorMessage); ok {
+		return reply
+	}
+	return &ErrorMessage{Type: TypeError, Code: code, Wsid: wsid, Message: err.Error()}
+}
+
+func (e *ErrorMessage) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// NewDeviceStateNotification builds the "devicestate" notification the broker
+// sends to rest clients when a device goes online or offline.
+func NewDeviceStateNotification(sn, ctype, state string) *NotificationMessage {
+	data, _ := json.Marshal(map[string]string{
+		"msgtype":    "devicestate",
+		"devicetype": ctype,
+		"state":      state,
+	})
+	return &NotificationMessage{
+		Type:    TypeNotification,
+		Wsid:    "1234567890",
+		From:    sn,
+		Data:    data,
+		MsgType: "devicestate",
+	}
+}
+
+// ValidSn reports whether sn may be used to address a smarthome client.
+// It allows letters, digits and ".", "_", "-", ":" and "@", up to 128 bytes.
+func ValidSn(sn string) bool {
+	if len(sn) == 0 || len(sn) > 128 {
+		return false
+	}
+	for i := 0; i < len(sn); i++ {
+		c := sn[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-', c == ':', c == '@':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func checkSn(field, sn, wsid string) error {
+	if sn == "" {
+		return missing(field, wsid)
+	}
+	if !ValidSn(sn) {
+		return NewError(CodeBadMessage, wsid, fmt.Sprintf("invalid %s %q", field, sn))
+	}
+	return nil
+}
+
+func missing(field, wsid string) error {
+	return NewError(CodeBadMessage, wsid, "missing "+field)
+}
+
+func isObject(data json.RawMessage) bool {
+	return firstByte(data) == '{'
+}
+
+func isArray(data json.RawMessage) bool {
+	return firstByte(data) == '['
+}
+
+func firstByte(data json.RawMessage) byte {
+	for _, c := range data {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c
+	}
+	return 0
+}
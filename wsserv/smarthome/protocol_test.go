@@ -0,0 +1,220 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smarthome
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var decodeTests = []struct {
+	name string
+	raw  string
+	want Message
+	code string // expected error code, empty if the message is valid
+	wsid string // wsid expected in the error
+}{
+	// malformed frames
+	{"not json", `hello`, nil, CodeBadMessage, ""},
+	{"json array", `[1,2]`, nil, CodeBadMessage, ""},
+	{"missing type", `{"sn":"a"}`, nil, CodeBadMessage, ""},
+	{"type not a string", `{"type":1}`, nil, CodeBadMessage, ""},
+	{"custom type", `{"type":"reboot","wsid":"w1"}`, &CustomMessage{Type: "reboot", Wsid: "w1"}, "", ""},
+	{"broker type", `{"type":"snapshot","wsid":"w1"}`, nil, CodeUnknownType, "w1"},
+
+	// auth
+	{"auth", `{"type":"auth","sn":"router-1","mac":"00:11","secret":"s"}`,
+		&AuthMessage{Type: "auth", Sn: "router-1", Mac: "00:11", Secret: "s"}, "", ""},
+	{"auth without sn", `{"type":"auth","mac":"00:11","secret":"s"}`, nil, CodeBadMessage, ""},
+	{"auth without mac", `{"type":"auth","sn":"router-1","secret":"s"}`, nil, CodeBadMessage, ""},
+	{"auth without secret", `{"type":"auth","sn":"router-1","mac":"00:11"}`, nil, CodeBadMessage, ""},
+	{"auth with bad sn", `{"type":"auth","sn":"../etc","mac":"00:11","secret":"s"}`, nil, CodeBadMessage, ""},
+	{"auth with numeric sn", `{"type":"auth","sn":12,"mac":"00:11","secret":"s"}`, nil, CodeBadMessage, ""},
+
+	// connect
+	{"connect", `{"type":"connect","sn":"router-1","token":"1.ab","c_type":"router"}`,
+		&ConnectMessage{Type: "connect", Sn: "router-1", Token: "1.ab", CType: "router"}, "", ""},
+	{"connect without token", `{"type":"connect","sn":"router-1","c_type":"router"}`, nil, CodeBadMessage, ""},
+	{"connect without c_type", `{"type":"connect","sn":"router-1","token":"1.ab"}`, nil, CodeBadMessage, ""},
+
+	// rest
+	{"rest", `{"type":"rest","wsid":"w1","sn":"tv-1","data":{"cmd":"on"}}`,
+		&RestMessage{Type: "rest", Wsid: "w1", Sn: "tv-1", Data: json.RawMessage(`{"cmd":"on"}`)}, "", ""},
+	{"rest without wsid", `{"type":"rest","sn":"tv-1","data":{}}`, nil, CodeBadMessage, ""},
+	{"rest without sn", `{"type":"rest","wsid":"w1","data":{}}`, nil, CodeBadMessage, "w1"},
+	{"rest without data", `{"type":"rest","wsid":"w1","sn":"tv-1"}`, nil, CodeBadMessage, "w1"},
+	{"rest with array data", `{"type":"rest","wsid":"w1","sn":"tv-1","data":[]}`, nil, CodeBadMessage, "w1"},
+	{"rest with numeric wsid", `{"type":"rest","wsid":1,"sn":"tv-1","data":{}}`, nil, CodeBadMessage, ""},
+	{"rest to sns", `{"type":"rest","wsid":"w1","sns":["tv-1","tv-2"],"data":{}}`,
+		&RestMessage{Type: "rest", Wsid: "w1", Sns: []string{"tv-1", "tv-2"}, Data: json.RawMessage(`{}`)}, "", ""},
+	{"rest to group", `{"type":"rest","wsid":"w1","group":"living","data":{}}`,
+		&RestMessage{Type: "rest", Wsid: "w1", Group: "living", Data: json.RawMessage(`{}`)}, "", ""},
+	{"rest to sn and group", `{"type":"rest","wsid":"w1","sn":"tv-1","group":"living","data":{}}`, nil, CodeBadMessage, "w1"},
+	{"rest to sns and group", `{"type":"rest","wsid":"w1","sns":["tv-1"],"group":"living","data":{}}`, nil, CodeBadMessage, "w1"},
+	{"rest to empty sns", `{"type":"rest","wsid":"w1","sns":[],"data":{}}`, nil, CodeBadMessage, "w1"},
+	{"rest to duplicate sns", `{"type":"rest","wsid":"w1","sns":["tv-1","tv-1"],"data":{}}`, nil, CodeBadMessage, "w1"},
+	{"rest to invalid group", `{"type":"rest","wsid":"w1","group":"living room","data":{}}`, nil, CodeBadMessage, "w1"},
+	{"persistent rest to group", `{"type":"rest","wsid":"w1","group":"living","data":{},"persist":true}`, nil, CodeBadMessage, "w1"},
+
+	// responses and other custom messages
+	{"router response", `{"type":"router","wsid":"w1","from":"app-1","data":{"ok":true}}`,
+		&CustomMessage{Type: "router", Wsid: "w1", From: "app-1", Data: json.RawMessage(`{"ok":true}`)}, "", ""},
+	{"curtain message to sn", `{"type":"curtain","wsid":"w1","sn":"curtain-1","data":{"open":50}}`,
+		&CustomMessage{Type: "curtain", Wsid: "w1", Sn: "curtain-1", Data: json.RawMessage(`{"open":50}`)}, "", ""},
+	{"custom message with bad from", `{"type":"cond","wsid":"w1","from":"a b","data":{}}`, nil, CodeBadMessage, "w1"},
+	{"custom message with bad sn", `{"type":"cond","wsid":"w1","sn":"../x"}`, nil, CodeBadMessage, "w1"},
+
+	// notifications
+	{"notification", `{"type":"notification","wsid":"w1","from":"tv-1","data":{"msgtype":"devicestate","state":"on"}}`,
+		&NotificationMessage{Type: "notification", Wsid: "w1", From: "tv-1",
+			Data: json.RawMessage(`{"msgtype":"devicestate","state":"on"}`), MsgType: "devicestate"}, "", ""},
+	{"notification without from", `{"type":"notification","data":{"msgtype":"x"}}`, nil, CodeBadMessage, ""},
+	{"notification without msgtype", `{"type":"notification","from":"tv-1","data":{"state":"on"}}`, nil, CodeBadMessage, ""},
+	{"notification with numeric msgtype", `{"type":"notification","from":"tv-1","data":{"msgtype":3}}`, nil, CodeBadMessage, ""},
+	{"notification without data", `{"type":"notification","from":"tv-1"}`, nil, CodeBadMessage, ""},
+
+	// subscriptions
+	{"subscribe", `{"type":"subscribe","wsid":"s1","sns":["tv-1"],"msgtypes":["devicestate"]}`,
+		&SubscribeMessage{Type: "subscribe", Wsid: "s1", Sns: []string{"tv-1"}, MsgTypes: []string{"devicestate"}}, "", ""},
+	{"subscribe to everything", `{"type":"subscribe","wsid":"s1"}`, &SubscribeMessage{Type: "subscribe", Wsid: "s1"}, "", ""},
+	{"subscribe without wsid", `{"type":"subscribe","sns":["tv-1"]}`, nil, CodeBadMessage, ""},
+	{"subscribe with bad sn", `{"type":"subscribe","wsid":"s1","sns":["a b"]}`, nil, CodeBadMessage, "s1"},
+	{"subscribe with sn list of numbers", `{"type":"subscribe","wsid":"s1","sns":[1]}`, nil, CodeBadMessage, "s1"},
+	{"unsubscribe all", `{"type":"unsubscribe"}`, &UnsubscribeMessage{Type: "unsubscribe"}, "", ""},
+
+	// firmware updates
+	{"ota check", `{"type":"ota_check","wsid":"o1","version":"1.0"}`,
+		&OTACheckMessage{Type: "ota_check", Wsid: "o1", Version: "1.0"}, "", ""},
+	{"ota check without wsid", `{"type":"ota_check","version":"1.0"}`, nil, CodeBadMessage, ""},
+	{"ota start", `{"type":"ota_start","wsid":"o1","version":"1.1","chunk":2}`,
+		&OTAStartMessage{Type: "ota_start", Wsid: "o1", Version: "1.1", Chunk: 2}, "", ""},
+	{"ota start without version", `{"type":"ota_start","wsid":"o1","chunk":0}`, nil, CodeBadMessage, "o1"},
+	{"ota ack", `{"type":"ota_ack","wsid":"o1","version":"1.1","chunk":0,"ok":true}`,
+		&OTAAckMessage{Type: "ota_ack", Wsid: "o1", Version: "1.1", Ok: true}, "", ""},
+	{"ota ack negative chunk", `{"type":"ota_ack","wsid":"o1","version":"1.1","chunk":-1}`, nil, CodeBadMessage, "o1"},
+	{"ota result", `{"type":"ota_result","wsid":"o1","version":"1.1","status":"failed","message":"flash"}`,
+		&OTAResultMessage{Type: "ota_result", Wsid: "o1", Version: "1.1", Status: "failed", Message: "flash"}, "", ""},
+	{"ota result bad status", `{"type":"ota_result","wsid":"o1","version":"1.1","status":"maybe"}`, nil, CodeBadMessage, "o1"},
+	{"ota chunk from client", `{"type":"ota_chunk","wsid":"o1"}`, nil, CodeUnknownType, "o1"},
+
+	// schedules
+	{"schedule create", `{"type":"schedule","wsid":"c1","action":"create","cron":"0 23 * * 1-5","sn":"cond-1","data":{"cmd":"off"}}`,
+		&ScheduleMessage{Type: "schedule", Wsid: "c1", Action: "create", Cron: "0 23 * * 1-5", Sn: "cond-1", Data: json.RawMessage(`{"cmd":"off"}`)}, "", ""},
+	{"schedule create without cron", `{"type":"schedule","wsid":"c1","action":"create","sn":"cond-1","data":{}}`, nil, CodeBadMessage, "c1"},
+	{"schedule create without data", `{"type":"schedule","wsid":"c1","action":"create","cron":"* * * * *","sn":"cond-1"}`, nil, CodeBadMessage, "c1"},
+	{"schedule list", `{"type":"schedule","wsid":"c1","action":"list"}`, &ScheduleMessage{Type: "schedule", Wsid: "c1", Action: "list"}, "", ""},
+	{"schedule delete without id", `{"type":"schedule","wsid":"c1","action":"delete"}`, nil, CodeBadMessage, "c1"},
+	{"schedule unknown action", `{"type":"schedule","wsid":"c1","action":"pause"}`, nil, CodeBadMessage, "c1"},
+}
+
+func TestDecode(t *testing.T) {
+	for _, testcase := range decodeTests {
+		msg, err := Decode([]byte(testcase.raw))
+		if testcase.code == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", testcase.name, err)
+			} else if !reflect.DeepEqual(msg, testcase.want) {
+				t.Errorf("%s: decoded %#v, expected %#v", testcase.name, msg, testcase.want)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected %s error, got %#v", testcase.name, testcase.code, msg)
+			continue
+		}
+		reply, ok := err.(*ErrorMessage)
+		if !ok {
+			t.Errorf("%s: error %#v is not an *ErrorMessage", testcase.name, err)
+			continue
+		}
+		if reply.Type != TypeError || reply.Code != testcase.code || reply.Wsid != testcase.wsid {
+			t.Errorf("%s: got error %#v, expected code %s and wsid %q", testcase.name, reply, testcase.code, testcase.wsid)
+		}
+	}
+}
+
+var responseTests = []struct {
+	name string
+	raw  string
+	code string // expected error code, empty if the response is valid
+}{
+	{"router response", `{"type":"router","wsid":"w1","from":"app-1","data":{"ok":true}}`, ""},
+	{"tv response with list", `{"type":"tv","wsid":"w1","from":"app-1","data":[1,2]}`, ""},
+	{"cond response without from", `{"type":"cond","wsid":"w1","data":{}}`, CodeBadMessage},
+	{"cond response with string data", `{"type":"cond","wsid":"w1","from":"app-1","data":"x"}`, CodeBadMessage},
+	{"response without wsid", `{"type":"router","from":"app-1","data":{}}`, CodeBadMessage},
+}
+
+func TestCustomMessageResponse(t *testing.T) {
+	for _, testcase := range responseTests {
+		msg, err := Decode([]byte(testcase.raw))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", testcase.name, err)
+			continue
+		}
+		reply, err := msg.(*CustomMessage).Response()
+		switch {
+		case testcase.code == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", testcase.name, err)
+		case testcase.code == "" && (reply.Type != msg.MessageType() || reply.From != "app-1"):
+			t.Errorf("%s: unexpected response %#v", testcase.name, reply)
+		case testcase.code != "" && (err == nil || err.(*ErrorMessage).Code != testcase.code):
+			t.Errorf("%s: expected %s error, got %v", testcase.name, testcase.code, err)
+		}
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	_, err := Decode([]byte(`{"type":"rest","wsid":"w1"}`))
+	data, _ := json.Marshal(ErrorReply(CodeNotConnected, "", err))
+	if string(data) != `{"type":"error","code":"bad_message","wsid":"w1","message":"missing sn"}` {
+		t.Errorf("unexpected reply %s", data)
+	}
+
+	data, _ = json.Marshal(ErrorReply(CodeAuthFailed, "", errString("bad device credentials")))
+	if string(data) != `{"type":"error","code":"auth_failed","message":"bad device credentials"}` {
+		t.Errorf("unexpected reply %s", data)
+	}
+}
+
+type errString string
+
+func (e errString) Error() string { return string(e) }
+
+func TestDeviceStateNotification(t *testing.T) {
+	data, _ := json.Marshal(NewDeviceStateNotification("tv-1", "tv", "online"))
+	msg, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := msg.(*NotificationMessage)
+	if n.From != "tv-1" || n.MsgType != "devicestate" {
+		t.Errorf("unexpected notification %s", data)
+	}
+}
+
+var validSnTests = []struct {
+	sn    string
+	valid bool
+}{
+	{"router-1", true},
+	{"00:11:22:33:44:55", true},
+	{"user@example.com", true},
+	{"", false},
+	{"a b", false},
+	{"../x", false},
+	{"sn\n", false},
+	{string(make([]byte, 129)), false},
+}
+
+func TestValidSn(t *testing.T) {
+	for _, testcase := range validSnTests {
+		if ValidSn(testcase.sn) != testcase.valid {
+			t.Errorf("ValidSn(%q) should be %v", testcase.sn, testcase.valid)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2013 Joe Walnes and the websocketd team.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smarthome
+
+import (
+	"encoding/json"
+)
+
+// TypeSchedule manages commands the broker sends at scheduled times.
+const TypeSchedule = "schedule"
+
+// Actions of ScheduleMessage.
+const (
+	ScheduleCreate = "create"
+	ScheduleList   = "list"
+	ScheduleDelete = "delete"
+)
+
+// CodeNoSchedule rejects schedule messages naming a schedule that does not
+// exist or does not belong to the client.
+const CodeNoSchedule = "no_schedule"
+
+// ScheduleMessage creates, lists or deletes scheduled commands of the client:
+//
+//	{"type":"schedule","wsid":...,"action":"create","name":"ac-off",
+//	 "cron":"0 23 * * 1-5","sn":"cond-1","data":{...}}
+//	{"type":"schedule","wsid":...,"action":"list"}
+//	{"type":"schedule","wsid":...,"action":"delete","id":...}
+//
+// A created schedule sends Data to Sn as a rest command whenever the cron
+// expression Cron matches.
+type ScheduleMessage struct {
+	Type   string          `json:"type"`
+	Wsid   string          `json:"wsid"`
+	Action string          `json:"action"`
+	Id     string          `json:"id,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Cron   string          `json:"cron,omitempty"`
+	Sn     string          `json:"sn,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+func (m *ScheduleMessage) MessageType() string { return TypeSchedule }
+
+func (m *ScheduleMessage) Validate() error {
+	if m.Wsid == "" {
+		return missing("wsid", "")
+	}
+	switch m.Action {
+	case ScheduleCreate:
+		if m.Cron == "" {
+			return missing("cron", m.Wsid)
+		}
+		if err := checkSn("sn", m.Sn, m.Wsid); err != nil {
+			return err
+		}
+		if !isObject(m.Data) {
+			return NewError(CodeBadMessage, m.Wsid, "data must be an object")
+		}
+	case ScheduleList:
+	case ScheduleDelete:
+		if m.Id == "" {
+			return missing("id", m.Wsid)
+		}
+	case "":
+		return missing("action", m.Wsid)
+	default:
+		return NewError(CodeBadMessage, m.Wsid, "unknown action "+m.Action)
+	}
+	return nil
+}